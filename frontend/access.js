@@ -0,0 +1,29 @@
+// explainDenied shows why the websocket can't be opened if it's denied by the
+// access policy, the browser doesn't expose the response of the handshake.
+function explainDenied(term, namespace, pod, container, action) {
+	if (pod == false || pod.indexOf("/") != -1 || pod.indexOf("%2F") != -1) {
+		return
+	}
+	let url = "/api/v1/"+namespace+"/"+pod+"/access?action="+action
+	if (container != false) {
+		url = url+"&container="+container
+	}
+	fetch(url).then(function(resp) {
+		return resp.json()
+	}).then(function(body) {
+		if (body.code != 600) {
+			term.writeln("")
+			term.writeln("\x1b[31m" + body.msg + "\x1b[0m")
+		}
+	})
+}
+
+// withCSRF adds the CSRF token issued with the page to the url of the
+// websocket, the browsers can't open websockets without it.
+function withCSRF(url) {
+	let meta = document.querySelector('meta[name="ratel-csrf"]')
+	if (meta == null) {
+		return url
+	}
+	return url + (url.indexOf("?") == -1 ? "?" : "&") + "csrf=" + encodeURIComponent(meta.content)
+}
@@ -8,27 +8,124 @@ function getQueryVariable(variable) {
 	return(false);
 }
 
+const logColors = [31, 32, 33, 34, 35, 36, 91, 92, 93, 94, 95, 96]
+const encoder = new TextEncoder()
+const decoder = new TextDecoder()
+
+// colorize wraps the string with an ANSI color, the same string always has
+// the same color.
+function colorize(s) {
+	let h = 0
+	for (let i = 0; i < s.length; i++) {
+		h = (h * 31 + s.charCodeAt(i)) >>> 0
+	}
+	return "\x1b[" + logColors[h % logColors.length] + "m" + s + "\x1b[0m"
+}
+
+// formatLine renders a LogLine, the highlights are byte offsets of data.
+function formatLine(line) {
+	let text = ""
+	if (line.timestamp) {
+		text += "\x1b[2m" + line.timestamp + "\x1b[0m "
+	}
+	if (line.source) {
+		text += line.source.split(" ").map(colorize).join(" ") + " "
+	}
+	if (!line.highlights) {
+		return text + line.data
+	}
+	let data = encoder.encode(line.data)
+	let last = 0
+	for (const [start, end] of line.highlights) {
+		text += decoder.decode(data.slice(last, start))
+		text += "\x1b[1;30;43m" + decoder.decode(data.slice(start, end)) + "\x1b[0m"
+		last = end
+	}
+	return text + decoder.decode(data.slice(last))
+}
+
+// writeMessage writes a LogMessage to the terminal, every line is written
+// with the prefix.
+function writeMessage(term, msg, prefix) {
+	switch (msg.op) {
+	case "lines":
+		for (const line of msg.lines) {
+			term.writeln(prefix + formatLine(line))
+		}
+		break
+	case "error":
+		term.writeln(prefix + "\x1b[31m" + msg.data + "\x1b[0m")
+		break
+	case "skipped":
+		term.writeln(prefix + "\x1b[33m[" + msg.skipped + " lines skipped]\x1b[0m")
+		break
+	}
+}
+
 function connect(){
 	namespace=getQueryVariable("namespace")
 	pod=getQueryVariable("pod")
 	container_name=getQueryVariable("container")
 	tail=getQueryVariable("tail")
 	follow=getQueryVariable("follow")
+	selector=getQueryVariable("selector")
+	aggregate=getQueryVariable("aggregate")
 	if (namespace == false) {
 		namespace="default"
 	}
 	// container_name="nginx-2"
-	if (namespace == false || pod == false) {
+	if (namespace == false || (pod == false && selector == false)) {
 		alert("cannot get pod")
 		return
 	}
 	url = "ws://"+document.location.host+"/ws/"+namespace+"/"+pod+"/"+container_name+"/logs?"
+	// pod is a workload reference like "deployment/api", or the pod is selected
+	// by label selector, or the default container of the pod is used.
+	if (aggregate == "true" || pod == false || pod.indexOf("/") != -1 || pod.indexOf("%2F") != -1 || container_name == false) {
+		url = "ws://"+document.location.host+"/ws/"+namespace+"/logs?"
+		// follow all containers of the pod, or all pods matched, in one stream.
+		if (aggregate == "true") {
+			url = "ws://"+document.location.host+"/ws/"+namespace+"/logs/aggregate?"
+		}
+		if (pod != false) {
+			url = url+"&pod="+pod
+		}
+		if (container_name != false) {
+			url = url+"&container="+container_name
+		}
+		if (selector != false) {
+			url = url+"&selector="+selector
+		}
+	}
 	if (tail != false) {
 		url = url+"&tail="+tail
 	}
 	if (follow != false) {
 		url = url+"&follow="+follow
 	}
+	for (const param of ["previous", "sinceSeconds", "sinceTime", "timestamps", "limitBytes", "include", "exclude", "level", "levelField"]) {
+		let value = getQueryVariable(param)
+		if (value != false) {
+			url = url+"&"+param+"="+value
+		}
+	}
+
+	// download the logs of a specific container, all containers of the pod are
+	// downloaded as a zip archive in aggregate mode.
+	if (pod != false && pod.indexOf("/") == -1 && pod.indexOf("%2F") == -1 && (container_name != false || aggregate == "true")) {
+		let download = document.getElementById("download")
+		download.href = "/api/v1/"+namespace+"/"+pod+"/"+(container_name || "_")+"/logs/download?"
+		if (aggregate == "true") {
+			download.href += "&archive=zip"
+		}
+		for (const param of ["previous", "sinceSeconds", "sinceTime", "timestamps", "limitBytes"]) {
+			let value = getQueryVariable(param)
+			if (value != false) {
+				download.href += "&"+param+"="+value
+			}
+		}
+		download.style.display = ""
+	}
 
 	console.log(url);
 	let term = new Terminal({
@@ -39,22 +136,41 @@ function connect(){
 		// term.write("logs "+ pod + "...");
 		term.toggleFullScreen(true);
 		term.fit();
-		term.on('data', function (data) {
-			conn.send(data)
-		});
-		conn = new WebSocket(url);
+		conn = new WebSocket(withCSRF(url));
+		// change the server-side log filter mid-stream.
+		document.getElementById("filter-form").onsubmit = function (e) {
+			e.preventDefault()
+			msg = {
+				op: "filter",
+				include: document.getElementById("filter-include").value,
+				exclude: document.getElementById("filter-exclude").value,
+				level: document.getElementById("filter-level").value,
+			}
+			conn.send(JSON.stringify(msg))
+		};
+		let opened = false
 		conn.onopen = function(e) {
+			opened = true
 		};
 		conn.onmessage = function(event) {
-			term.writeln(event.data)
-			// term.write(event.data)
+			writeMessage(term, JSON.parse(event.data), "")
 		};
+		// show the events of the pod and its owners next to the logs.
+		if (getQueryVariable("events") == "true" && pod != false && pod.indexOf("/") == -1 && pod.indexOf("%2F") == -1) {
+			let events = new WebSocket(withCSRF("ws://"+document.location.host+"/ws/"+namespace+"/"+pod+"/events"))
+			events.onmessage = function(event) {
+				writeMessage(term, JSON.parse(event.data), "\x1b[1;35m[event]\x1b[0m ")
+			};
+		}
 		conn.onclose = function(event) {
 			if (event.wasClean) {
 				console.log(`[close] Connection closed cleanly, code=${event.code} reason=${event.reason}`);
 			} else {
 				console.log('[close] Connection died');
 				term.writeln("")
+				if (!opened) {
+					explainDenied(term, namespace, pod, container_name, "logs")
+				}
 			}
 			// term.write('Connection Reset By Peer! Try Refresh.');
 		};
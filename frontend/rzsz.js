@@ -0,0 +1,130 @@
+// ZMODEM and trzsz file transfer in the terminal.
+//
+// The server switches to binary messages when "sz"/"rz" or "tsz"/"trz" starts
+// in the container, and the transfer is handled by zmodem.js
+// (https://github.com/FGasper/zmodemjs) or trzsz.js
+// (https://github.com/trzsz/trzsz.js), which should be put into
+// "frontend/dist/zmodem.js" and "frontend/dist/trzsz.js".
+//
+// newTransfer returns the transfer of the protocol, or null if the library is
+// not loaded. sendBinary sends the data to the container, and end is called
+// once after the transfer finished.
+function newTransfer(protocol, term, sendBinary, end) {
+	let ended = false
+	let finish = function() {
+		if (!ended) {
+			ended = true
+			end()
+		}
+	}
+	if (protocol == "zmodem" && window.Zmodem) {
+		return zmodemTransfer(term, sendBinary, finish)
+	}
+	if (protocol == "trzsz" && window.TrzszFilter) {
+		return trzszTransfer(term, sendBinary, finish)
+	}
+	return null
+}
+
+// cancelTransfer stops "sz"/"rz" or "tsz"/"trz" in the container when the
+// library is not loaded.
+function cancelTransfer(protocol, sendBinary) {
+	if (protocol == "zmodem") {
+		sendBinary(new Uint8Array([24, 24, 24, 24, 24, 24, 24, 24, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8]))
+	} else {
+		sendBinary(new Uint8Array([3]))
+	}
+}
+
+function zmodemTransfer(term, sendBinary, end) {
+	let zsession = null
+	let sentry = new Zmodem.Sentry({
+		to_terminal: function(octets) {
+			term.write(new TextDecoder().decode(new Uint8Array(octets)))
+		},
+		sender: function(octets) {
+			sendBinary(new Uint8Array(octets))
+		},
+		on_retract: function() {},
+		on_detect: function(detection) {
+			zsession = detection.confirm()
+			zsession.on("session_end", end)
+			if (zsession.type === "receive") {
+				// "sz" in the container, save the files offered.
+				zsession.on("offer", function(xfer) {
+					let buffers = []
+					xfer.on("input", function(payload) {
+						buffers.push(new Uint8Array(payload))
+					})
+					xfer.accept().then(function() {
+						Zmodem.Browser.save_to_disk(buffers, xfer.get_details().name)
+					})
+				})
+				zsession.start()
+				return
+			}
+			// "rz" in the container, choose the files to send.
+			let input = document.createElement("input")
+			input.type = "file"
+			input.multiple = true
+			input.onchange = function() {
+				Zmodem.Browser.send_files(zsession, input.files, {
+					on_progress: function(obj, xfer) {
+						let details = xfer.get_details()
+						term.write("\r" + details.name + ": " + xfer.get_offset() + " / " + details.size + " bytes")
+					},
+				}).then(function() {
+					return zsession.close()
+				}).catch(function(err) {
+					console.log("zmodem send error: " + err)
+					zsession.abort()
+				})
+			}
+			input.click()
+		},
+	})
+	return {
+		consume: function(data) {
+			sentry.consume(data)
+		},
+		// the terminal input would break the transfer, except ctrl-c aborting it.
+		input: function(data) {
+			if (data == "\x03" && zsession) {
+				zsession.abort()
+				end()
+			}
+		},
+	}
+}
+
+function trzszTransfer(term, sendBinary, end) {
+	let filter = new TrzszFilter({
+		writeToTerminal: function(output) {
+			term.write(typeof output === "string" ? output : new TextDecoder().decode(new Uint8Array(output)))
+		},
+		sendToServer: function(input) {
+			sendBinary(typeof input === "string" ? new TextEncoder().encode(input) : input)
+		},
+		terminalColumns: term.cols,
+	})
+	// trzsz.js doesn't tell when the transfer ends.
+	let started = false
+	let checks = 0
+	let timer = setInterval(function() {
+		checks++
+		if (filter.isTransferringFiles()) {
+			started = true
+		} else if (started || checks > 10) {
+			clearInterval(timer)
+			end()
+		}
+	}, 500)
+	return {
+		consume: function(data) {
+			filter.processServerOutput(data)
+		},
+		input: function(data) {
+			filter.processTerminalInput(data)
+		},
+	}
+}
@@ -10,17 +10,64 @@ function getQueryVariable(variable) {
 	return(false);
 }
 
+// showToast shows the warning of the server for a while, e.g. a dangerous
+// command is blocked.
+function showToast(text) {
+	let toast = document.getElementById("toast")
+	toast.textContent = text
+	toast.style.display = ""
+	clearTimeout(toast.timer)
+	toast.timer = setTimeout(function() {
+		toast.style.display = "none"
+	}, 5000)
+}
+
 function connect(){
 	namespace=getQueryVariable("namespace")
 	pod=getQueryVariable("pod")
 	container=getQueryVariable("container")
+	mode=getQueryVariable("mode")
+	if (mode != "attach" && mode != "debug" && mode != "copy") {
+		mode = "shell"
+	}
+	image=getQueryVariable("image")
+	node=getQueryVariable("node")
+	selector=getQueryVariable("selector")
+	// join a shared session by the view or drive token.
+	join=getQueryVariable("session")
+	joinToken=getQueryVariable("token")
 	console.log(namespace ,pod ,container)
-	if (namespace == false || pod == false || container == false) {
+	if (join == false && node == false && (namespace == false || (pod == false && selector == false))) {
 		alert("无法获取到容器，请联系管理员")
 		return
 	}
 	console.log(namespace ,pod ,container)
-	url = "ws://"+document.location.host+"/ws/"+namespace+"/"+pod+"/"+container+"/shell"
+	url = "ws://"+document.location.host+"/ws/"+namespace+"/"+pod+"/"+container+"/"+mode
+	// pod is a workload reference like "deployment/api", or the pod is selected
+	// by label selector, or the default container of the pod is used.
+	if (mode == "shell" && (pod == false || pod.indexOf("/") != -1 || pod.indexOf("%2F") != -1 || container == false)) {
+		url = "ws://"+document.location.host+"/ws/"+namespace+"/shell?"
+		if (pod != false) {
+			url = url+"&pod="+pod
+		}
+		if (container != false) {
+			url = url+"&container="+container
+		}
+		if (selector != false) {
+			url = url+"&selector="+selector
+		}
+	}
+	if (mode == "debug" && image != false) {
+		url = url+"?image="+image
+	}
+	if (node != false) {
+		pod = node
+		url = "ws://"+document.location.host+"/ws/nodes/"+node+"/shell"
+	}
+	if (join != false) {
+		pod = "session " + join
+		url = "ws://"+document.location.host+"/ws/sessions/"+join+"?token="+joinToken
+	}
 	console.log(url);
 	let term = new Terminal({
 		"cursorBlink":true,
@@ -31,44 +78,127 @@ function connect(){
 		term.fit();
 		// term.toggleFullScreen(true);
 		term.on('data', function (data) {
+			if (transfer) {
+				transfer.input(data)
+				return
+			}
 			msg = {op: "stdin", data: data}
 			conn.send(JSON.stringify(msg))
 		});
 		term.on('resize', function (size) {
 			console.log("resize: " + size)
-			msg = {op: "resize", cols: size.cols, rows: rows}
+			msg = {op: "resize", cols: size.cols, rows: size.rows}
 			conn.send(JSON.stringify(msg))
 		});
 
-		conn = new WebSocket(url);
-		conn.onopen = function(e) {
-			term.write("\r");
-			msg = {op: "stdin", data: "export TERM=xterm && clear \r"}
-			conn.send(JSON.stringify(msg))
-			// term.clear()
-		};
-		conn.onmessage = function(event) {
-			msg = JSON.parse(event.data)
-			if (msg.op === "stdout") {
-				term.write(msg.data)
-			} else {
-				console.log("invalid msg op: "+msg)
-			}
-		};
-		conn.onclose = function(event) {
-			if (event.wasClean) {
-				console.log(`[close] Connection closed cleanly, code=${event.code} reason=${event.reason}`);
-			} else {
-				console.log('[close] Connection died');
-				term.writeln("")
-			}
-			term.write('Connection Reset By Peer! Try Refresh.');
-		};
-		conn.onerror = function(error) {
-			console.log('[error] Connection error');
-			term.write("error: "+error.message);
-			term.destroy();
-		};
+		// session and token are used to reconnect to the session after the
+		// websocket closed unexpectedly, offset is the end of the output received.
+		let session = join
+		let token = joinToken
+		let offset = 0
+		let retries = 0
+		// transfer is the ZMODEM or trzsz file transfer in progress, the output
+		// is received as binary messages until the transfer ends.
+		let transfer = null
+		let sendBinary = function(data) {
+			conn.send(data)
+		}
+		let endTransfer = function() {
+			transfer = null
+			conn.send(JSON.stringify({op: "transfer", data: "end"}))
+		}
+		let open = function(url, reconnecting) {
+			let opened = false
+			conn = new WebSocket(withCSRF(url));
+			conn.binaryType = "arraybuffer"
+			conn.onopen = function(e) {
+				opened = true
+				retries = 0
+				if (reconnecting || join != false) {
+					// the container resizes the terminal to the size before disconnected.
+					msg = {op: "resize", cols: term.cols, rows: term.rows}
+					conn.send(JSON.stringify(msg))
+					return
+				}
+				term.write("\r");
+				// attach to the container main process, don't type anything into it.
+				if (mode == "attach" || mode == "debug") {
+					return
+				}
+				msg = {op: "stdin", data: "export TERM=xterm && clear \r"}
+				conn.send(JSON.stringify(msg))
+				// term.clear()
+			};
+			conn.onmessage = function(event) {
+				if (event.data instanceof ArrayBuffer) {
+					if (transfer) {
+						transfer.consume(event.data)
+					}
+					return
+				}
+				msg = JSON.parse(event.data)
+				if (msg.op === "stdout") {
+					term.write(msg.data)
+					if (msg.offset) {
+						offset = msg.offset
+					}
+				} else if (msg.op === "session") {
+					session = msg.session
+					if (msg.token) {
+						token = msg.token
+					}
+					// only the owner can share the session.
+					if (msg.viewToken) {
+						let link = document.location.origin+"/terminal?session="+session+"&token="
+						document.getElementById("share-view").href = link+msg.viewToken
+						document.getElementById("share-drive").href = link+msg.driveToken
+						document.getElementById("share").style.display = ""
+					}
+				} else if (msg.op === "transfer") {
+					transfer = newTransfer(msg.data, term, sendBinary, endTransfer)
+					if (!transfer) {
+						term.write("\r\n\x1b[33m[" + msg.data + " is not supported, see frontend/rzsz.js]\x1b[0m\r\n")
+						cancelTransfer(msg.data, sendBinary)
+						endTransfer()
+					}
+				} else if (msg.op === "warning") {
+					showToast(msg.data)
+				} else if (msg.op === "notice") {
+					term.write("\r\n\x1b[36m[" + msg.data + "]\x1b[0m\r\n")
+				} else {
+					console.log("invalid msg op: "+msg)
+				}
+			};
+			conn.onclose = function(event) {
+				// the transfer is canceled by the server.
+				transfer = null
+				console.log(`[close] Connection closed, code=${event.code} reason=${event.reason}`);
+				if (!opened && !reconnecting && join == false && node == false) {
+					explainDenied(term, namespace, pod, container, "exec")
+				}
+				// the session is closed by the server, or there is no session to
+				// reconnect to.
+				if (event.code == 1000 || session == false || retries >= 30) {
+					term.writeln("")
+					if (event.reason) {
+						term.writeln("\x1b[33msession closed: " + event.reason + "\x1b[0m")
+					}
+					term.write('Connection Reset By Peer! Try Refresh.');
+					return
+				}
+				retries++
+				if (retries == 1) {
+					term.write("\r\n\x1b[33mconnection lost, reconnecting...\x1b[0m\r\n")
+				}
+				setTimeout(function() {
+					open("ws://"+document.location.host+"/ws/sessions/"+session+"?token="+token+"&offset="+offset, true)
+				}, 2000)
+			};
+			conn.onerror = function(error) {
+				console.log('[error] Connection error');
+			};
+		}
+		open(url, false)
 	} else {
 		var item = document.getElementById("terminal");
 		item.innerHTML = "<h2>Your browser does not support WebSockets.</h2>";
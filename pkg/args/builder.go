@@ -3,6 +3,7 @@ package args
 import (
 	"net"
 	"sync"
+	"time"
 )
 
 var builder = &holderBuilder{holder: ratelHolder}
@@ -62,6 +63,294 @@ func (h *holderBuilder) SetLogFile(logFile string) *holderBuilder {
 	return h
 }
 
+// SetDebugImage sets '--debug-image' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetDebugImage(debugImage string) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.debugImage = debugImage
+	return h
+}
+
+// SetAllowedDebugImages sets '--allowed-debug-image' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetAllowedDebugImages(allowedDebugImages []string) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.allowedDebugImages = allowedDebugImages
+	return h
+}
+
+// SetEnableNodeShell sets '--enable-node-shell' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetEnableNodeShell(enableNodeShell bool) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.enableNodeShell = enableNodeShell
+	return h
+}
+
+// SetEnableCopy sets '--enable-copy' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetEnableCopy(enableCopy bool) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.enableCopy = enableCopy
+	return h
+}
+
+// SetSlowClientPolicy sets '--slow-client-policy' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetSlowClientPolicy(slowClientPolicy string) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.slowClientPolicy = slowClientPolicy
+	return h
+}
+
+// SetSendQueueSize sets '--send-queue-size' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetSendQueueSize(sendQueueSize int) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.sendQueueSize = sendQueueSize
+	return h
+}
+
+// SetWriteTimeout sets '--write-timeout' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetWriteTimeout(writeTimeout time.Duration) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.writeTimeout = writeTimeout
+	return h
+}
+
+// SetSessionGracePeriod sets '--session-grace-period' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetSessionGracePeriod(sessionGracePeriod time.Duration) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.sessionGracePeriod = sessionGracePeriod
+	return h
+}
+
+// SetSessionIdleTimeout sets '--session-idle-timeout' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetSessionIdleTimeout(sessionIdleTimeout time.Duration) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.sessionIdleTimeout = sessionIdleTimeout
+	return h
+}
+
+// SetSessionMaxDuration sets '--session-max-duration' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetSessionMaxDuration(sessionMaxDuration time.Duration) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.sessionMaxDuration = sessionMaxDuration
+	return h
+}
+
+// SetMaxFileSize sets '--max-file-size' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetMaxFileSize(maxFileSize int64) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.maxFileSize = maxFileSize
+	return h
+}
+
+// SetPolicyFile sets '--policy-file' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetPolicyFile(policyFile string) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.policyFile = policyFile
+	return h
+}
+
+// SetUserHeader sets '--user-header' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetUserHeader(userHeader string) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.userHeader = userHeader
+	return h
+}
+
+// SetGroupsHeader sets '--groups-header' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetGroupsHeader(groupsHeader string) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.groupsHeader = groupsHeader
+	return h
+}
+
+// SetTrustedProxies sets '--trusted-proxy' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetTrustedProxies(trustedProxies []string) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.trustedProxies = trustedProxies
+	return h
+}
+
+// SetBlockedCommands sets '--blocked-command' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetBlockedCommands(blockedCommands []string) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.blockedCommands = blockedCommands
+	return h
+}
+
+// SetConfirmCommands sets '--confirm-command' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetConfirmCommands(confirmCommands []string) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.confirmCommands = confirmCommands
+	return h
+}
+
+// SetRedact sets '--redact' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetRedact(redact bool) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.redact = redact
+	return h
+}
+
+// SetRedactPatterns sets '--redact-pattern' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetRedactPatterns(redactPatterns []string) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.redactPatterns = redactPatterns
+	return h
+}
+
+// SetRedactSecretEnv sets '--redact-secret-env' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetRedactSecretEnv(redactSecretEnv bool) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.redactSecretEnv = redactSecretEnv
+	return h
+}
+
+// SetAllowedOrigins sets '--allowed-origin' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetAllowedOrigins(allowedOrigins []string) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.allowedOrigins = allowedOrigins
+	return h
+}
+
+// SetSessionRate sets '--session-rate' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetSessionRate(sessionRate float64) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.sessionRate = sessionRate
+	return h
+}
+
+// SetSessionBurst sets '--session-burst' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetSessionBurst(sessionBurst int) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.sessionBurst = sessionBurst
+	return h
+}
+
+// SetMaxShells sets '--max-shells' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetMaxShells(maxShells int) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.maxShells = maxShells
+	return h
+}
+
+// SetMaxShellsPerUser sets '--max-shells-per-user' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetMaxShellsPerUser(maxShellsPerUser int) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.maxShellsPerUser = maxShellsPerUser
+	return h
+}
+
+// SetMaxShellsPerPod sets '--max-shells-per-pod' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetMaxShellsPerPod(maxShellsPerPod int) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.maxShellsPerPod = maxShellsPerPod
+	return h
+}
+
+// SetMaxLogFollowers sets '--max-log-followers' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetMaxLogFollowers(maxLogFollowers int) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.maxLogFollowers = maxLogFollowers
+	return h
+}
+
+// SetOIDCIssuer sets '--oidc-issuer' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetOIDCIssuer(oidcIssuer string) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.oidcIssuer = oidcIssuer
+	return h
+}
+
+// SetOIDCClientID sets '--oidc-client-id' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetOIDCClientID(oidcClientID string) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.oidcClientID = oidcClientID
+	return h
+}
+
+// SetOIDCClientSecret sets '--oidc-client-secret' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetOIDCClientSecret(oidcClientSecret string) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.oidcClientSecret = oidcClientSecret
+	return h
+}
+
+// SetOIDCRedirectURL sets '--oidc-redirect-url' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetOIDCRedirectURL(oidcRedirectURL string) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.oidcRedirectURL = oidcRedirectURL
+	return h
+}
+
+// SetOIDCScopes sets '--oidc-scopes' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetOIDCScopes(oidcScopes []string) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.oidcScopes = oidcScopes
+	return h
+}
+
+// SetOIDCUsernameClaim sets '--oidc-username-claim' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetOIDCUsernameClaim(oidcUsernameClaim string) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.oidcUsernameClaim = oidcUsernameClaim
+	return h
+}
+
+// SetOIDCGroupsClaim sets '--oidc-groups-claim' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetOIDCGroupsClaim(oidcGroupsClaim string) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.oidcGroupsClaim = oidcGroupsClaim
+	return h
+}
+
+// SetOIDCSessionMaxAge sets '--oidc-session-max-age' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetOIDCSessionMaxAge(oidcSessionMaxAge time.Duration) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.oidcSessionMaxAge = oidcSessionMaxAge
+	return h
+}
+
+// SetImpersonate sets '--impersonate' argument of ratel-webterminal binary.
+func (h *holderBuilder) SetImpersonate(impersonate bool) *holderBuilder {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.holder.impersonate = impersonate
+	return h
+}
+
 // NewBuilder returns singleton instance of holder builder.
 func NewBuilder() *holderBuilder {
 	return builder
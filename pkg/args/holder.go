@@ -2,6 +2,7 @@ package args
 
 import (
 	"net"
+	"time"
 )
 
 var ratelHolder = &holder{}
@@ -14,6 +15,53 @@ type holder struct {
 	logLevel       string
 	logFormat      string
 	logFile        string
+	debugImage     string
+
+	allowedDebugImages []string
+
+	enableNodeShell bool
+	enableCopy      bool
+
+	slowClientPolicy string
+	sendQueueSize    int
+	writeTimeout     time.Duration
+
+	sessionGracePeriod time.Duration
+	sessionIdleTimeout time.Duration
+	sessionMaxDuration time.Duration
+
+	maxFileSize int64
+
+	policyFile     string
+	userHeader     string
+	groupsHeader   string
+	trustedProxies []string
+
+	blockedCommands []string
+	confirmCommands []string
+
+	redact          bool
+	redactPatterns  []string
+	redactSecretEnv bool
+
+	allowedOrigins []string
+
+	sessionRate      float64
+	sessionBurst     int
+	maxShells        int
+	maxShellsPerUser int
+	maxShellsPerPod  int
+	maxLogFollowers  int
+
+	oidcIssuer        string
+	oidcClientID      string
+	oidcClientSecret  string
+	oidcRedirectURL   string
+	oidcScopes        []string
+	oidcUsernameClaim string
+	oidcGroupsClaim   string
+	oidcSessionMaxAge time.Duration
+	impersonate       bool
 }
 
 // GetPort returns "--port" argument of ratel-webterminal binary.
@@ -45,3 +93,183 @@ func GetLogFormat() string {
 func GetLogFile() string {
 	return ratelHolder.logFile
 }
+
+// GetDebugImage returns "--debug-image" argument of ratel-webterminal binary.
+func GetDebugImage() string {
+	return ratelHolder.debugImage
+}
+
+// GetAllowedDebugImages returns "--allowed-debug-image" argument of ratel-webterminal binary.
+func GetAllowedDebugImages() []string {
+	return ratelHolder.allowedDebugImages
+}
+
+// GetEnableNodeShell returns "--enable-node-shell" argument of ratel-webterminal binary.
+func GetEnableNodeShell() bool {
+	return ratelHolder.enableNodeShell
+}
+
+// GetEnableCopy returns "--enable-copy" argument of ratel-webterminal binary.
+func GetEnableCopy() bool {
+	return ratelHolder.enableCopy
+}
+
+// GetSlowClientPolicy returns "--slow-client-policy" argument of ratel-webterminal binary.
+func GetSlowClientPolicy() string {
+	return ratelHolder.slowClientPolicy
+}
+
+// GetSendQueueSize returns "--send-queue-size" argument of ratel-webterminal binary.
+func GetSendQueueSize() int {
+	return ratelHolder.sendQueueSize
+}
+
+// GetWriteTimeout returns "--write-timeout" argument of ratel-webterminal binary.
+func GetWriteTimeout() time.Duration {
+	return ratelHolder.writeTimeout
+}
+
+// GetSessionGracePeriod returns "--session-grace-period" argument of ratel-webterminal binary.
+func GetSessionGracePeriod() time.Duration {
+	return ratelHolder.sessionGracePeriod
+}
+
+// GetSessionIdleTimeout returns "--session-idle-timeout" argument of ratel-webterminal binary.
+func GetSessionIdleTimeout() time.Duration {
+	return ratelHolder.sessionIdleTimeout
+}
+
+// GetSessionMaxDuration returns "--session-max-duration" argument of ratel-webterminal binary.
+func GetSessionMaxDuration() time.Duration {
+	return ratelHolder.sessionMaxDuration
+}
+
+// GetMaxFileSize returns "--max-file-size" argument of ratel-webterminal binary.
+func GetMaxFileSize() int64 {
+	return ratelHolder.maxFileSize
+}
+
+// GetPolicyFile returns "--policy-file" argument of ratel-webterminal binary.
+func GetPolicyFile() string {
+	return ratelHolder.policyFile
+}
+
+// GetUserHeader returns "--user-header" argument of ratel-webterminal binary.
+func GetUserHeader() string {
+	return ratelHolder.userHeader
+}
+
+// GetGroupsHeader returns "--groups-header" argument of ratel-webterminal binary.
+func GetGroupsHeader() string {
+	return ratelHolder.groupsHeader
+}
+
+// GetTrustedProxies returns "--trusted-proxy" argument of ratel-webterminal binary.
+func GetTrustedProxies() []string {
+	return ratelHolder.trustedProxies
+}
+
+// GetBlockedCommands returns "--blocked-command" argument of ratel-webterminal binary.
+func GetBlockedCommands() []string {
+	return ratelHolder.blockedCommands
+}
+
+// GetConfirmCommands returns "--confirm-command" argument of ratel-webterminal binary.
+func GetConfirmCommands() []string {
+	return ratelHolder.confirmCommands
+}
+
+// GetRedact returns "--redact" argument of ratel-webterminal binary.
+func GetRedact() bool {
+	return ratelHolder.redact
+}
+
+// GetRedactPatterns returns "--redact-pattern" argument of ratel-webterminal binary.
+func GetRedactPatterns() []string {
+	return ratelHolder.redactPatterns
+}
+
+// GetRedactSecretEnv returns "--redact-secret-env" argument of ratel-webterminal binary.
+func GetRedactSecretEnv() bool {
+	return ratelHolder.redactSecretEnv
+}
+
+// GetAllowedOrigins returns "--allowed-origin" argument of ratel-webterminal binary.
+func GetAllowedOrigins() []string {
+	return ratelHolder.allowedOrigins
+}
+
+// GetSessionRate returns "--session-rate" argument of ratel-webterminal binary.
+func GetSessionRate() float64 {
+	return ratelHolder.sessionRate
+}
+
+// GetSessionBurst returns "--session-burst" argument of ratel-webterminal binary.
+func GetSessionBurst() int {
+	return ratelHolder.sessionBurst
+}
+
+// GetMaxShells returns "--max-shells" argument of ratel-webterminal binary.
+func GetMaxShells() int {
+	return ratelHolder.maxShells
+}
+
+// GetMaxShellsPerUser returns "--max-shells-per-user" argument of ratel-webterminal binary.
+func GetMaxShellsPerUser() int {
+	return ratelHolder.maxShellsPerUser
+}
+
+// GetMaxShellsPerPod returns "--max-shells-per-pod" argument of ratel-webterminal binary.
+func GetMaxShellsPerPod() int {
+	return ratelHolder.maxShellsPerPod
+}
+
+// GetMaxLogFollowers returns "--max-log-followers" argument of ratel-webterminal binary.
+func GetMaxLogFollowers() int {
+	return ratelHolder.maxLogFollowers
+}
+
+// GetOIDCIssuer returns "--oidc-issuer" argument of ratel-webterminal binary.
+func GetOIDCIssuer() string {
+	return ratelHolder.oidcIssuer
+}
+
+// GetOIDCClientID returns "--oidc-client-id" argument of ratel-webterminal binary.
+func GetOIDCClientID() string {
+	return ratelHolder.oidcClientID
+}
+
+// GetOIDCClientSecret returns "--oidc-client-secret" argument of ratel-webterminal binary.
+func GetOIDCClientSecret() string {
+	return ratelHolder.oidcClientSecret
+}
+
+// GetOIDCRedirectURL returns "--oidc-redirect-url" argument of ratel-webterminal binary.
+func GetOIDCRedirectURL() string {
+	return ratelHolder.oidcRedirectURL
+}
+
+// GetOIDCScopes returns "--oidc-scopes" argument of ratel-webterminal binary.
+func GetOIDCScopes() []string {
+	return ratelHolder.oidcScopes
+}
+
+// GetOIDCUsernameClaim returns "--oidc-username-claim" argument of ratel-webterminal binary.
+func GetOIDCUsernameClaim() string {
+	return ratelHolder.oidcUsernameClaim
+}
+
+// GetOIDCGroupsClaim returns "--oidc-groups-claim" argument of ratel-webterminal binary.
+func GetOIDCGroupsClaim() string {
+	return ratelHolder.oidcGroupsClaim
+}
+
+// GetOIDCSessionMaxAge returns "--oidc-session-max-age" argument of ratel-webterminal binary.
+func GetOIDCSessionMaxAge() time.Duration {
+	return ratelHolder.oidcSessionMaxAge
+}
+
+// GetImpersonate returns "--impersonate" argument of ratel-webterminal binary.
+func GetImpersonate() bool {
+	return ratelHolder.impersonate
+}
@@ -0,0 +1,428 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/forbearing/ratel-webterminal/pkg/args"
+	"github.com/forbearing/ratel-webterminal/pkg/errors"
+	"github.com/forbearing/ratel-webterminal/pkg/policy"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+const (
+	sessionCookie = "ratel_session"
+	stateCookie   = "ratel_oidc_state"
+
+	// loginTimeout is how long the user can take to log in to the issuer.
+	loginTimeout = 10 * time.Minute
+	// refreshBefore is how long before the expiry the tokens are refreshed.
+	refreshBefore = 30 * time.Second
+
+	loginPath    = "/auth/login"
+	callbackPath = "/auth/callback"
+	logoutPath   = "/auth/logout"
+)
+
+var (
+	// oidc is nil if "--oidc-issuer" is not set.
+	oidc *oidcAuth
+
+	sessions   = map[string]*session{}
+	sessionsMu sync.Mutex
+	logins     = map[string]*login{}
+	loginsMu   sync.Mutex
+)
+
+type oidcAuth struct {
+	provider *provider
+	config   oauth2.Config
+}
+
+// session is a user logged in, the cookie of the browser is its ID.
+type session struct {
+	l         sync.Mutex
+	id        string
+	user      *policy.User
+	token     *oauth2.Token
+	idToken   string
+	expiry    time.Time
+	createdAt time.Time
+}
+
+// login is a login in progress, keyed by the state parameter.
+type login struct {
+	nonce     string
+	verifier  string
+	redirect  string
+	createdAt time.Time
+}
+
+// Init discovers "--oidc-issuer", the OIDC login is disabled if it's not set.
+func Init() {
+	issuer := args.GetOIDCIssuer()
+	if len(issuer) == 0 {
+		return
+	}
+	if len(args.GetOIDCClientID()) == 0 {
+		log.Fatal("--oidc-client-id is required by --oidc-issuer")
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	p, err := discover(context.TODO(), client, issuer)
+	if err != nil {
+		log.Fatalf("discover oidc issuer %s error: %s", issuer, err.Error())
+	}
+	oidc = &oidcAuth{
+		provider: p,
+		config: oauth2.Config{
+			ClientID:     args.GetOIDCClientID(),
+			ClientSecret: args.GetOIDCClientSecret(),
+			Endpoint:     oauth2.Endpoint{AuthURL: p.AuthURL, TokenURL: p.TokenURL},
+			Scopes:       args.GetOIDCScopes(),
+		},
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			cleanup()
+		}
+	}()
+	log.Infof("oidc login enabled, issuer: %s", issuer)
+}
+
+// Enabled returns whether the OIDC login is enabled.
+func Enabled() bool {
+	return oidc != nil
+}
+
+// Middleware requires the users to log in if the OIDC login is enabled. The
+// pages are redirected to the login, the other requests are responded with
+// 401. The user of the session is set into the context of the request, see
+// policy.UserFrom.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if oidc == nil || public(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		s := currentSession(r)
+		if s != nil {
+			if user, ok := s.refresh(r.Context()); ok {
+				next.ServeHTTP(w, r.WithContext(policy.WithUser(r.Context(), user)))
+				return
+			}
+			deleteSession(s.id)
+		}
+		if page(r.URL.Path) && r.Method == http.MethodGet {
+			http.Redirect(w, r, loginPath+"?redirect="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+		errors.WriteError(w, http.StatusUnauthorized, errors.CodeUnauthorized)
+	})
+}
+
+// public returns whether the path can be requested without login.
+func public(path string) bool {
+	switch path {
+	case loginPath, callbackPath, logoutPath, "/-/healthy", "/-/ready":
+		return true
+	}
+	return strings.HasPrefix(path, "/static/")
+}
+
+// page returns whether the path is a page of the frontend.
+func page(path string) bool {
+	switch path {
+	case "/terminal", "/logs", "/files":
+		return true
+	}
+	return false
+}
+
+// HandleLogin handle "/auth/login" requests, it redirects to the issuer with
+// the authorization code flow and PKCE. The page to return to after the login
+// is the "redirect" query parameter.
+func HandleLogin(w http.ResponseWriter, r *http.Request) {
+	if oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	redirect := r.URL.Query().Get("redirect")
+	// only the local paths, so it's not an open redirect.
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		redirect = "/terminal"
+	}
+	state, nonce, verifier := randomString(), randomString(), randomString()
+	loginsMu.Lock()
+	logins[state] = &login{nonce: nonce, verifier: verifier, redirect: redirect, createdAt: time.Now()}
+	loginsMu.Unlock()
+
+	// the state is bound to the browser by the cookie.
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    state,
+		Path:     callbackPath,
+		MaxAge:   int(loginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   secure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	challenge := sha256.Sum256([]byte(verifier))
+	config := oidc.configFor(r)
+	http.Redirect(w, r, config.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("nonce", nonce),
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	), http.StatusFound)
+}
+
+// HandleCallback handle "/auth/callback" requests, it exchanges the code for
+// the tokens, verifies the ID token and creates the session.
+func HandleCallback(w http.ResponseWriter, r *http.Request) {
+	if oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	query := r.URL.Query()
+	if e := query.Get("error"); len(e) != 0 {
+		log.Warnf("oidc login error: %s: %s", e, query.Get("error_description"))
+		http.Error(w, "login error: "+e, http.StatusUnauthorized)
+		return
+	}
+	state := query.Get("state")
+	cookie, err := r.Cookie(stateCookie)
+	if err != nil || len(state) == 0 || cookie.Value != state {
+		log.Warn("oidc login error: state doesn't match")
+		http.Error(w, "login error: invalid state, please log in again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: stateCookie, Path: callbackPath, MaxAge: -1})
+	loginsMu.Lock()
+	l, ok := logins[state]
+	delete(logins, state)
+	loginsMu.Unlock()
+	if !ok || time.Since(l.createdAt) > loginTimeout {
+		http.Error(w, "login error: login expired, please log in again", http.StatusBadRequest)
+		return
+	}
+
+	config := oidc.configFor(r)
+	token, err := config.Exchange(r.Context(), query.Get("code"), oauth2.SetAuthURLParam("code_verifier", l.verifier))
+	if err != nil {
+		log.Warnf("oidc login error: exchange code: %s", err.Error())
+		http.Error(w, "login error: exchange code failed", http.StatusUnauthorized)
+		return
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	if len(rawIDToken) == 0 {
+		log.Warn("oidc login error: no id_token in the token response")
+		http.Error(w, "login error: no id_token, make sure the 'openid' scope is requested", http.StatusUnauthorized)
+		return
+	}
+	c, err := oidc.provider.verify(r.Context(), rawIDToken, config.ClientID, l.nonce)
+	if err != nil {
+		log.Warnf("oidc login error: verify id token: %s", err.Error())
+		http.Error(w, "login error: invalid id token", http.StatusUnauthorized)
+		return
+	}
+	user, err := userFrom(c)
+	if err != nil {
+		log.Warnf("oidc login error: %s", err.Error())
+		http.Error(w, "login error: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	s := &session{id: randomString(), user: user, token: token, idToken: rawIDToken, createdAt: time.Now()}
+	s.expiry = expiryOf(token, c)
+	sessionsMu.Lock()
+	sessions[s.id] = s
+	sessionsMu.Unlock()
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    s.id,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   secure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	log.Infof("user %s logged in, groups: %s", user.Name, strings.Join(user.Groups, ","))
+	http.Redirect(w, r, l.redirect, http.StatusFound)
+}
+
+// HandleLogout handle "/auth/logout" requests, it deletes the session and
+// logs out of the issuer if it supports RP-initiated logout.
+func HandleLogout(w http.ResponseWriter, r *http.Request) {
+	if oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	s := currentSession(r)
+	if s == nil {
+		http.Redirect(w, r, loginPath, http.StatusFound)
+		return
+	}
+	deleteSession(s.id)
+	log.Infof("user %s logged out", s.user.Name)
+	endSession := oidc.provider.EndSessionEndpoint
+	if len(endSession) == 0 {
+		http.Redirect(w, r, loginPath, http.StatusFound)
+		return
+	}
+	u, err := url.Parse(endSession)
+	if err != nil {
+		http.Redirect(w, r, loginPath, http.StatusFound)
+		return
+	}
+	q := u.Query()
+	q.Set("id_token_hint", s.idToken)
+	q.Set("client_id", oidc.config.ClientID)
+	q.Set("post_logout_redirect_uri", baseURL(r)+"/terminal")
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// refresh returns the user of the session, the tokens are refreshed if they
+// are about to expire. It returns false if the session is expired and can't
+// be refreshed, or exceeds "--oidc-session-max-age".
+func (s *session) refresh(ctx context.Context) (*policy.User, bool) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if maxAge := args.GetOIDCSessionMaxAge(); maxAge > 0 && time.Since(s.createdAt) > maxAge {
+		return nil, false
+	}
+	if time.Now().Add(refreshBefore).Before(s.expiry) {
+		return s.user, true
+	}
+	if len(s.token.RefreshToken) == 0 {
+		return nil, false
+	}
+	// force the refresh, the access token may be valid longer than the ID token.
+	expired := *s.token
+	expired.Expiry = time.Now().Add(-time.Second)
+	token, err := oidc.config.TokenSource(ctx, &expired).Token()
+	if err != nil {
+		log.Warnf("refresh token of user %s error: %s", s.user.Name, err.Error())
+		return nil, false
+	}
+	var c claims
+	if rawIDToken, _ := token.Extra("id_token").(string); len(rawIDToken) != 0 {
+		if c, err = oidc.provider.verify(ctx, rawIDToken, oidc.config.ClientID, ""); err != nil {
+			log.Warnf("refresh token of user %s error: verify id token: %s", s.user.Name, err.Error())
+			return nil, false
+		}
+		user, err := userFrom(c)
+		if err != nil {
+			log.Warnf("refresh token of user %s error: %s", s.user.Name, err.Error())
+			return nil, false
+		}
+		s.user, s.idToken = user, rawIDToken
+	}
+	s.token = token
+	s.expiry = expiryOf(token, c)
+	log.Debugf("token of user %s refreshed", s.user.Name)
+	return s.user, true
+}
+
+// configFor returns the oauth2 config with the redirect URL of the request
+// if "--oidc-redirect-url" is not set.
+func (a *oidcAuth) configFor(r *http.Request) oauth2.Config {
+	config := a.config
+	config.RedirectURL = args.GetOIDCRedirectURL()
+	if len(config.RedirectURL) == 0 {
+		config.RedirectURL = baseURL(r) + callbackPath
+	}
+	return config
+}
+
+// userFrom returns the user of the claims of the ID token.
+func userFrom(c claims) (*policy.User, error) {
+	name := c.string(args.GetOIDCUsernameClaim())
+	if len(name) == 0 {
+		return nil, fmt.Errorf("claim %q not found in id token", args.GetOIDCUsernameClaim())
+	}
+	user := &policy.User{Name: name, Groups: []string{policy.AuthenticatedGroup}}
+	if claim := args.GetOIDCGroupsClaim(); len(claim) != 0 {
+		user.Groups = append(user.Groups, c.strings(claim)...)
+	}
+	return user, nil
+}
+
+// expiryOf returns when the session should be refreshed, the earlier of the
+// access token and the ID token.
+func expiryOf(token *oauth2.Token, c claims) time.Time {
+	expiry := token.Expiry
+	if c != nil && (expiry.IsZero() || c.expiry().Before(expiry)) {
+		expiry = c.expiry()
+	}
+	return expiry
+}
+
+func currentSession(r *http.Request) *session {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	return sessions[cookie.Value]
+}
+
+func deleteSession(id string) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	delete(sessions, id)
+}
+
+// cleanup removes the expired logins, and the sessions can't be refreshed.
+func cleanup() {
+	loginsMu.Lock()
+	for state, l := range logins {
+		if time.Since(l.createdAt) > loginTimeout {
+			delete(logins, state)
+		}
+	}
+	loginsMu.Unlock()
+
+	maxAge := args.GetOIDCSessionMaxAge()
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	for id, s := range sessions {
+		s.l.Lock()
+		expired := len(s.token.RefreshToken) == 0 && time.Now().After(s.expiry)
+		if expired || (maxAge > 0 && time.Since(s.createdAt) > maxAge) {
+			delete(sessions, id)
+		}
+		s.l.Unlock()
+	}
+}
+
+// secure returns whether the cookies should be secure, the request is HTTPS
+// or forwarded from HTTPS by the proxy.
+func secure(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+func baseURL(r *http.Request) string {
+	if secure(r) {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
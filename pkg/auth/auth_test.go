@@ -0,0 +1,297 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/forbearing/ratel-webterminal/pkg/args"
+	"github.com/forbearing/ratel-webterminal/pkg/policy"
+)
+
+// setupOIDC enables the OIDC login with the fake issuer.
+func setupOIDC(t *testing.T) *fakeIssuer {
+	t.Helper()
+	f := newFakeIssuer(t)
+	args.NewBuilder().
+		SetOIDCIssuer(f.URL).
+		SetOIDCClientID(testClientID).
+		SetOIDCClientSecret(testClientSecret).
+		SetOIDCScopes([]string{"openid", "email", "groups"}).
+		SetOIDCUsernameClaim("email").
+		SetOIDCGroupsClaim("groups").
+		SetOIDCSessionMaxAge(time.Hour)
+	Init()
+	t.Cleanup(func() {
+		oidc = nil
+		sessionsMu.Lock()
+		sessions = map[string]*session{}
+		sessionsMu.Unlock()
+		loginsMu.Lock()
+		logins = map[string]*login{}
+		loginsMu.Unlock()
+		args.NewBuilder().SetOIDCIssuer("")
+	})
+	return f
+}
+
+// logIn logs in with the fake issuer, and returns the session cookie.
+func logIn(t *testing.T, f *fakeIssuer) *http.Cookie {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	HandleLogin(rec, httptest.NewRequest(http.MethodGet, "/auth/login?redirect=/logs?pod=nginx", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login status %d", rec.Code)
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(location.String(), f.URL+"/authorize?") {
+		t.Fatalf("login redirected to %s", location)
+	}
+	query := location.Query()
+	if query.Get("code_challenge_method") != "S256" || len(query.Get("code_challenge")) == 0 {
+		t.Fatalf("login without PKCE: %s", location)
+	}
+	if query.Get("redirect_uri") != "http://example.com/auth/callback" {
+		t.Fatalf("unexpected redirect_uri %q", query.Get("redirect_uri"))
+	}
+	state := query.Get("state")
+	stateCookie := cookieOf(t, rec, stateCookie)
+	if stateCookie.Value != state || !stateCookie.HttpOnly {
+		t.Fatalf("unexpected state cookie: %+v", stateCookie)
+	}
+
+	code := f.authorize(query.Get("nonce"), query.Get("code_challenge"))
+	req := httptest.NewRequest(http.MethodGet, "/auth/callback?state="+url.QueryEscape(state)+"&code="+url.QueryEscape(code), nil)
+	req.AddCookie(stateCookie)
+	rec = httptest.NewRecorder()
+	HandleCallback(rec, req)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("callback status %d: %s", rec.Code, rec.Body.String())
+	}
+	if location := rec.Header().Get("Location"); location != "/logs?pod=nginx" {
+		t.Fatalf("callback redirected to %s", location)
+	}
+	cookie := cookieOf(t, rec, sessionCookie)
+	if !cookie.HttpOnly {
+		t.Fatal("session cookie is not HttpOnly")
+	}
+	return cookie
+}
+
+func cookieOf(t *testing.T, rec *httptest.ResponseRecorder, name string) *http.Cookie {
+	t.Helper()
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == name && cookie.MaxAge >= 0 {
+			return cookie
+		}
+	}
+	t.Fatalf("cookie %s not set", name)
+	return nil
+}
+
+// serve sends the request through the middleware, it returns the response
+// and the user seen by the handler.
+func serve(path string, cookie *http.Cookie) (*httptest.ResponseRecorder, *policy.User) {
+	var user *policy.User
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user = policy.UserFrom(r)
+	}))
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec, user
+}
+
+func TestLogin(t *testing.T) {
+	f := setupOIDC(t)
+	cookie := logIn(t, f)
+
+	rec, user := serve("/ws/default/nginx/nginx/shell", cookie)
+	if user == nil {
+		t.Fatalf("request not authenticated, status %d", rec.Code)
+	}
+	if user.Name != "alice@example.com" {
+		t.Errorf("user %q, want alice@example.com", user.Name)
+	}
+	if strings.Join(user.Groups, ",") != policy.AuthenticatedGroup+",dev" {
+		t.Errorf("groups %v, want [%s dev]", user.Groups, policy.AuthenticatedGroup)
+	}
+}
+
+func TestLoginRequired(t *testing.T) {
+	setupOIDC(t)
+
+	rec, user := serve("/terminal?pod=nginx", nil)
+	if user != nil || rec.Code != http.StatusFound || rec.Header().Get("Location") != "/auth/login?redirect="+url.QueryEscape("/terminal?pod=nginx") {
+		t.Errorf("page not redirected to login: %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	rec, user = serve("/ws/default/nginx/nginx/shell", &http.Cookie{Name: sessionCookie, Value: "forged"})
+	if user != nil || rec.Code != http.StatusUnauthorized {
+		t.Errorf("websocket with unknown session: status %d, want 401", rec.Code)
+	}
+	if _, user = serve("/-/healthy", nil); user == nil {
+		t.Error("health check requires login")
+	}
+}
+
+func TestCallbackRejected(t *testing.T) {
+	f := setupOIDC(t)
+	rec := httptest.NewRecorder()
+	HandleLogin(rec, httptest.NewRequest(http.MethodGet, "/auth/login", nil))
+	location, _ := url.Parse(rec.Header().Get("Location"))
+	query := location.Query()
+	state := query.Get("state")
+
+	tests := []struct {
+		name   string
+		cookie string
+		code   string
+	}{
+		// the state must be bound to the browser.
+		{"state not match", "other", f.authorize(query.Get("nonce"), query.Get("code_challenge"))},
+		// the code is not issued to the code verifier of the login.
+		{"wrong code challenge", state, f.authorize(query.Get("nonce"), "other")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/auth/callback?state="+url.QueryEscape(state)+"&code="+url.QueryEscape(tt.code), nil)
+			req.AddCookie(&http.Cookie{Name: stateCookie, Value: tt.cookie})
+			rec := httptest.NewRecorder()
+			HandleCallback(rec, req)
+			if rec.Code == http.StatusFound {
+				t.Fatal("callback accepted")
+			}
+			for _, cookie := range rec.Result().Cookies() {
+				if cookie.Name == sessionCookie {
+					t.Fatal("session cookie set")
+				}
+			}
+		})
+	}
+
+	// the code of the issuer is required even if the state is valid.
+	rec = httptest.NewRecorder()
+	HandleLogin(rec, httptest.NewRequest(http.MethodGet, "/auth/login", nil))
+	location, _ = url.Parse(rec.Header().Get("Location"))
+	state = location.Query().Get("state")
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/auth/callback?state="+url.QueryEscape(state)+"&code=forged", nil)
+	req.AddCookie(&http.Cookie{Name: stateCookie, Value: state})
+	HandleCallback(rec, req)
+	if rec.Code == http.StatusFound {
+		t.Error("callback with forged code accepted")
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	f := setupOIDC(t)
+	cookie := logIn(t, f)
+	expireSession(t, cookie)
+
+	f.mu.Lock()
+	f.groups = []string{"ops"}
+	f.mu.Unlock()
+	_, user := serve("/api/v1/default/nginx/access", cookie)
+	if user == nil {
+		t.Fatal("session not refreshed")
+	}
+	if strings.Join(user.Groups, ",") != policy.AuthenticatedGroup+",ops" {
+		t.Errorf("groups %v not updated by the refresh", user.Groups)
+	}
+	f.mu.Lock()
+	refreshed := f.refreshed
+	f.mu.Unlock()
+	if refreshed != 1 {
+		t.Errorf("refreshed %d times, want 1", refreshed)
+	}
+	// not refreshed again before the new tokens expire.
+	serve("/api/v1/default/nginx/access", cookie)
+	f.mu.Lock()
+	refreshed = f.refreshed
+	f.mu.Unlock()
+	if refreshed != 1 {
+		t.Errorf("refreshed %d times, want 1", refreshed)
+	}
+}
+
+func TestRefreshFailed(t *testing.T) {
+	f := setupOIDC(t)
+	cookie := logIn(t, f)
+	expireSession(t, cookie)
+
+	f.mu.Lock()
+	f.failRefresh = true
+	f.mu.Unlock()
+	rec, user := serve("/api/v1/default/nginx/access", cookie)
+	if user != nil || rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d, want 401", rec.Code)
+	}
+	sessionsMu.Lock()
+	_, ok := sessions[cookie.Value]
+	sessionsMu.Unlock()
+	if ok {
+		t.Error("session not deleted")
+	}
+}
+
+func TestSessionMaxAge(t *testing.T) {
+	f := setupOIDC(t)
+	cookie := logIn(t, f)
+	sessionsMu.Lock()
+	sessions[cookie.Value].createdAt = time.Now().Add(-2 * time.Hour)
+	sessionsMu.Unlock()
+	if rec, user := serve("/api/v1/default/nginx/access", cookie); user != nil || rec.Code != http.StatusUnauthorized {
+		t.Errorf("session exceeds max age: status %d, want 401", rec.Code)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	f := setupOIDC(t)
+	cookie := logIn(t, f)
+	sessionsMu.Lock()
+	idToken := sessions[cookie.Value].idToken
+	sessionsMu.Unlock()
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/logout", nil)
+	req.AddCookie(cookie)
+	rec := httptest.NewRecorder()
+	HandleLogout(rec, req)
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(location.String(), f.URL+"/logout?") {
+		t.Fatalf("logout redirected to %s", location)
+	}
+	query := location.Query()
+	if query.Get("id_token_hint") != idToken || query.Get("post_logout_redirect_uri") != "http://example.com/terminal" {
+		t.Errorf("unexpected logout redirect %s", location)
+	}
+	if rec, user := serve("/api/v1/default/nginx/access", cookie); user != nil || rec.Code != http.StatusUnauthorized {
+		t.Errorf("session still valid after logout, status %d", rec.Code)
+	}
+}
+
+// expireSession makes the tokens of the session expired, so they are
+// refreshed by the next request.
+func expireSession(t *testing.T, cookie *http.Cookie) {
+	t.Helper()
+	sessionsMu.Lock()
+	s, ok := sessions[cookie.Value]
+	sessionsMu.Unlock()
+	if !ok {
+		t.Fatal("session not found")
+	}
+	s.l.Lock()
+	s.expiry = time.Now()
+	s.l.Unlock()
+}
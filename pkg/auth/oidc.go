@@ -0,0 +1,312 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// clockSkew is the leeway of the expiry of ID tokens.
+	clockSkew = time.Minute
+	// jwksRefreshInterval is the min interval to refetch the keys of the
+	// issuer when an unknown key is found, it limits the requests to the
+	// issuer by forged tokens.
+	jwksRefreshInterval = time.Minute
+)
+
+// provider is the OpenID Connect issuer discovered by
+// "/.well-known/openid-configuration".
+type provider struct {
+	Issuer             string `json:"issuer"`
+	AuthURL            string `json:"authorization_endpoint"`
+	TokenURL           string `json:"token_endpoint"`
+	JWKSURL            string `json:"jwks_uri"`
+	EndSessionEndpoint string `json:"end_session_endpoint"`
+
+	client    *http.Client
+	l         sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// discover gets the configuration of the issuer.
+func discover(ctx context.Context, client *http.Client, issuer string) (*provider, error) {
+	wellKnown := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	p := &provider{client: client}
+	if err := getJSON(ctx, client, wellKnown, p); err != nil {
+		return nil, err
+	}
+	// the same check as the spec, so the tokens of other issuers are rejected.
+	if p.Issuer != issuer {
+		return nil, fmt.Errorf("issuer %q in %s doesn't match %q", p.Issuer, wellKnown, issuer)
+	}
+	if len(p.AuthURL) == 0 || len(p.TokenURL) == 0 || len(p.JWKSURL) == 0 {
+		return nil, fmt.Errorf("authorization_endpoint, token_endpoint or jwks_uri not found in %s", wellKnown)
+	}
+	return p, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// jsonWebKey is a public key in the JWK Set of the issuer.
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// key returns the public key of kid, the keys are refetched if kid is not
+// found, since the issuer may have rotated the keys.
+func (p *provider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.fetchedAt) < jwksRefreshInterval {
+		return nil, fmt.Errorf("key %q not found", kid)
+	}
+	p.fetchedAt = time.Now()
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(ctx, p.client, p.JWKSURL, &set); err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// the unsupported keys are skipped.
+		if key, err := k.publicKey(); err == nil {
+			p.keys[k.Kid] = key
+		}
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("key %q not found", kid)
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// claims are the claims of the ID token, the user name and groups are read
+// from the claims configured by "--oidc-username-claim" and
+// "--oidc-groups-claim".
+type claims map[string]interface{}
+
+func (c claims) string(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// strings returns the claim of a string or an array of strings.
+func (c claims) strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// expiry returns the "exp" claim.
+func (c claims) expiry() time.Time {
+	exp, _ := c["exp"].(float64)
+	return time.Unix(int64(exp), 0)
+}
+
+// verify verifies the signature, issuer, audience and expiry of the ID token,
+// and the nonce if it's not empty.
+func (p *provider) verify(ctx context.Context, rawIDToken, clientID, nonce string) (claims, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed id token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed id token header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed id token signature: %w", err)
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var c claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, fmt.Errorf("malformed id token claims: %w", err)
+	}
+	if iss := c.string("iss"); iss != p.Issuer {
+		return nil, fmt.Errorf("id token issued by %q, not %q", iss, p.Issuer)
+	}
+	audience := c.strings("aud")
+	found := false
+	for _, aud := range audience {
+		found = found || aud == clientID
+	}
+	if !found {
+		return nil, fmt.Errorf("id token is not issued to client %q", clientID)
+	}
+	if azp := c.string("azp"); len(audience) > 1 && len(azp) != 0 && azp != clientID {
+		return nil, fmt.Errorf("id token is authorized to %q, not %q", azp, clientID)
+	}
+	if time.Now().After(c.expiry().Add(clockSkew)) {
+		return nil, fmt.Errorf("id token expired at %s", c.expiry().Format(time.RFC3339))
+	}
+	if len(nonce) != 0 && c.string("nonce") != nonce {
+		return nil, fmt.Errorf("id token nonce doesn't match")
+	}
+	return c, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifySignature verifies the JWS signature, only the asymmetric algorithms
+// are supported, "none" and HMAC are always rejected.
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported id token algorithm %q", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	if hash == 0 {
+		return fmt.Errorf("unsupported id token algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			if rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil {
+				return nil
+			}
+		case "PS":
+			if rsa.VerifyPSS(k, hash, digest, signature, nil) == nil {
+				return nil
+			}
+		default:
+			return fmt.Errorf("unsupported id token algorithm %q for RSA key", alg)
+		}
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" {
+			return fmt.Errorf("unsupported id token algorithm %q for EC key", alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(k, digest, r, s) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("invalid id token signature")
+}
@@ -0,0 +1,254 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID     = "ratel-webterminal"
+	testClientSecret = "secret"
+	testRefreshToken = "refresh-token"
+)
+
+// fakeIssuer is a local OpenID Connect issuer, it issues the ID tokens signed
+// by its RSA key.
+type fakeIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]fakeCode
+	// groups are the groups of the ID tokens issued by the refresh.
+	groups    []string
+	refreshed int
+	// failRefresh rejects the refresh token.
+	failRefresh bool
+}
+
+// fakeCode is an authorization code issued to the login.
+type fakeCode struct {
+	nonce     string
+	challenge string
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeIssuer{key: key, codes: make(map[string]fakeCode)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{
+			"issuer":                 f.URL,
+			"authorization_endpoint": f.URL + "/authorize",
+			"token_endpoint":         f.URL + "/token",
+			"jwks_uri":               f.URL + "/keys",
+			"end_session_endpoint":   f.URL + "/logout",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"keys": []map[string]string{{
+			"kid": "test",
+			"kty": "RSA",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", f.handleToken)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+// authorize returns the code of the login, as if the user logged in.
+func (f *fakeIssuer) authorize(nonce, challenge string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	code := randomString()
+	f.codes[code] = fakeCode{nonce: nonce, challenge: challenge}
+	return code
+}
+
+func (f *fakeIssuer) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != testClientID || clientSecret != testClientSecret {
+		tokenError(w, "invalid_client")
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	claims := map[string]interface{}{
+		"iss":   f.URL,
+		"aud":   testClientID,
+		"email": "alice@example.com",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code, ok := f.codes[r.PostForm.Get("code")]
+		delete(f.codes, r.PostForm.Get("code"))
+		if !ok {
+			tokenError(w, "invalid_grant")
+			return
+		}
+		// PKCE with S256.
+		verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(verifier[:]) != code.challenge {
+			tokenError(w, "invalid_grant")
+			return
+		}
+		claims["nonce"] = code.nonce
+		claims["groups"] = []string{"dev"}
+	case "refresh_token":
+		if f.failRefresh || r.PostForm.Get("refresh_token") != testRefreshToken {
+			tokenError(w, "invalid_grant")
+			return
+		}
+		f.refreshed++
+		claims["groups"] = f.groups
+	default:
+		tokenError(w, "unsupported_grant_type")
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"access_token":  randomString(),
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+		"refresh_token": testRefreshToken,
+		"id_token":      signToken(f.key, claims),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+// signToken returns the ID token of the claims signed by RS256.
+func signToken(key *rsa.PrivateKey, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestDiscover(t *testing.T) {
+	f := newFakeIssuer(t)
+	p, err := discover(context.Background(), f.Client(), f.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.TokenURL != f.URL+"/token" || p.JWKSURL != f.URL+"/keys" || p.EndSessionEndpoint != f.URL+"/logout" {
+		t.Errorf("unexpected provider: %+v", p)
+	}
+	// the issuer must be the same as the configured one.
+	if _, err := discover(context.Background(), f.Client(), f.URL+"/"); err == nil {
+		t.Error("discover with a different issuer should fail")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	f := newFakeIssuer(t)
+	p, err := discover(context.Background(), f.Client(), f.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":   f.URL,
+			"aud":   testClientID,
+			"email": "alice@example.com",
+			"nonce": "nonce",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		}
+	}
+	with := func(name string, value interface{}) map[string]interface{} {
+		c := valid()
+		c[name] = value
+		return c
+	}
+	tests := []struct {
+		name    string
+		token   string
+		nonce   string
+		wantErr string
+	}{
+		{"valid", signToken(f.key, valid()), "nonce", ""},
+		{"nonce not checked", signToken(f.key, valid()), "", ""},
+		{"audience in array", signToken(f.key, with("aud", []string{"other", testClientID})), "nonce", ""},
+		{"bad signature", signToken(otherKey, valid()), "nonce", "invalid id token signature"},
+		{"wrong audience", signToken(f.key, with("aud", "other")), "nonce", "not issued to client"},
+		{"wrong issuer", signToken(f.key, with("iss", "https://evil.example.com")), "nonce", "issued by"},
+		{"wrong nonce", signToken(f.key, valid()), "other", "nonce doesn't match"},
+		{"expired", signToken(f.key, with("exp", time.Now().Add(-2*clockSkew).Unix())), "nonce", "expired"},
+		{"malformed", "not-a-token", "nonce", "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := p.verify(context.Background(), tt.token, testClientID, tt.nonce)
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if c.string("email") != "alice@example.com" {
+					t.Errorf("unexpected claims: %v", c)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifySignatureRejectsNone(t *testing.T) {
+	f := newFakeIssuer(t)
+	p, err := discover(context.Background(), f.Client(), f.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := strings.Split(signToken(f.key, map[string]interface{}{"iss": f.URL, "aud": testClientID}), ".")
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"test"}`))
+	if _, err := p.verify(context.Background(), header+"."+token[1]+".", testClientID, ""); err == nil {
+		t.Error("token with alg none should be rejected")
+	}
+}
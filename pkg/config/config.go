@@ -37,7 +37,7 @@ func Init(filename string) error {
 
 	viper.WatchConfig()
 	viper.OnConfigChange(func(e fsnotify.Event) {
-		log.Debug(e.Op.String, e.Name)
+		log.Debug(e.Op.String(), e.Name)
 		if err = viper.Unmarshal(Config); err != nil {
 			return
 		}
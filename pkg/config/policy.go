@@ -0,0 +1,84 @@
+package config
+
+import (
+	"os"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Policy is the access policy file of ratel-webterminal, it decides which users
+// and groups may exec, view logs or transfer files in which pods, independent
+// of the RBAC of the ServiceAccount of ratel-webterminal. For example:
+//
+//	default: deny
+//	rules:
+//	- name: no-kube-system
+//	  effect: deny
+//	  namespaces: ["kube-system"]
+//	- name: developers
+//	  effect: allow
+//	  groups: ["dev"]
+//	  actions: ["exec", "logs", "files"]
+//	  namespaces: ["dev-*"]
+//	  podSelector: "app=web"
+//	  containers: ["web"]
+//	- name: sre-node-shell
+//	  effect: allow
+//	  groups: ["sre"]
+//	  actions: ["node-shell"]
+//	  nodes: ["worker-*"]
+type Policy struct {
+	// Default is the effect of the requests not matched by any rule, "allow"
+	// or "deny", defaults to "deny".
+	Default string       `mapstructure:"default"`
+	Rules   []PolicyRule `mapstructure:"rules"`
+}
+
+// PolicyRule matches the requests by the user, action and target. An empty
+// field matches everything, the deny rules take precedence over the allow
+// rules.
+type PolicyRule struct {
+	Name   string `mapstructure:"name"`
+	Effect string `mapstructure:"effect"`
+	// Users and Groups are the subjects of the rule, "*" matches all users.
+	Users  []string `mapstructure:"users"`
+	Groups []string `mapstructure:"groups"`
+	// Actions are "exec", "logs", "files", "node-shell" or "*", "node-shell"
+	// is only allowed if it's listed explicitly.
+	Actions []string `mapstructure:"actions"`
+	// Namespaces, Containers and Nodes are glob patterns, such as "dev-*".
+	Namespaces  []string `mapstructure:"namespaces"`
+	PodSelector string   `mapstructure:"podSelector"`
+	Containers  []string `mapstructure:"containers"`
+	// Nodes are the nodes of the node shells, the rules of nodes can't set
+	// Namespaces, PodSelector or Containers.
+	Nodes []string `mapstructure:"nodes"`
+}
+
+// LoadPolicy loads the policy file and watches it, onChange is called with
+// the new policy when the file changed.
+func LoadPolicy(filename string, onChange func(*Policy, error)) (*Policy, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+
+	v := viper.New()
+	v.SetConfigFile(filename)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	if err := v.Unmarshal(p); err != nil {
+		return nil, err
+	}
+
+	v.WatchConfig()
+	v.OnConfigChange(func(e fsnotify.Event) {
+		log.Debug(e.Op.String(), e.Name)
+		p := &Policy{}
+		onChange(p, v.Unmarshal(p))
+	})
+	return p, nil
+}
@@ -12,8 +12,13 @@ import (
 	log "github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersapps "k8s.io/client-go/listers/apps/v1"
+	listersbatch "k8s.io/client-go/listers/batch/v1"
 	listerscore "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 )
@@ -24,21 +29,58 @@ var podController = &controller{}
 
 // controller is the controller implementation for Pod resources.
 type controller struct {
+	// clientset is used by the event informers and GetSecret(), it's the
+	// ServiceAccount of ratel-webterminal and never impersonates the users.
+	clientset kubernetes.Interface
 	podLister listerscore.PodLister
 	// podSynced is a flag to determine if pod informer had been synced.
 	podSynced cache.InformerSynced
+
+	// the workload listers are used to resolve the pods of the workloads.
+	deploymentLister  listersapps.DeploymentLister
+	statefulSetLister listersapps.StatefulSetLister
+	daemonSetLister   listersapps.DaemonSetLister
+	replicaSetLister  listersapps.ReplicaSetLister
+	jobLister         listersbatch.JobLister
+	// workloadsSynced are the flags to determine if workload informers had
+	// been synced.
+	workloadsSynced []cache.InformerSynced
 }
 
 // newController returns a new pod controller
 func newController(
+	clientset kubernetes.Interface,
+	informerFactory informers.SharedInformerFactory,
 	podInformer cache.SharedIndexInformer,
 	podLister listerscore.PodLister) *controller {
 
+	deployments := informerFactory.Apps().V1().Deployments()
+	statefulSets := informerFactory.Apps().V1().StatefulSets()
+	daemonSets := informerFactory.Apps().V1().DaemonSets()
+	replicaSets := informerFactory.Apps().V1().ReplicaSets()
+	jobs := informerFactory.Batch().V1().Jobs()
 	controller := &controller{
-		podLister: podLister,
-		podSynced: podInformer.HasSynced,
+		clientset:         clientset,
+		podLister:         podLister,
+		podSynced:         podInformer.HasSynced,
+		deploymentLister:  deployments.Lister(),
+		statefulSetLister: statefulSets.Lister(),
+		daemonSetLister:   daemonSets.Lister(),
+		replicaSetLister:  replicaSets.Lister(),
+		jobLister:         jobs.Lister(),
+		workloadsSynced: []cache.InformerSynced{
+			deployments.Informer().HasSynced,
+			statefulSets.Informer().HasSynced,
+			daemonSets.Informer().HasSynced,
+			replicaSets.Informer().HasSynced,
+			jobs.Informer().HasSynced,
+		},
 	}
 
+	// Set up an event handler for when Pod resources change, it notifies the
+	// pod watchers, see WatchPods().
+	podInformer.AddEventHandler(podEventHandler())
+
 	return controller
 }
 
@@ -53,10 +95,11 @@ func (c *controller) run(stopCh <-chan struct{}) error {
 	log.Infof("Starting ratel-webterminal controller")
 	// Wait for the caches to be synced before starting workers
 	log.Info("Waiting for informer caches to sync")
-	if ok := cache.WaitForCacheSync(stopCh, c.podSynced); !ok {
+	synced := append([]cache.InformerSynced{c.podSynced}, c.workloadsSynced...)
+	if ok := cache.WaitForCacheSync(stopCh, synced...); !ok {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
-	log.Info("Pod synced successfully")
+	log.Info("Pod and workload synced successfully")
 	return nil
 }
 
@@ -67,7 +110,7 @@ func Init() {
 		log.Fatalf("Create a pod handler error: %s", err.Error())
 	}
 
-	podController = newController(podHandler.Informer(), podHandler.Lister())
+	podController = newController(podHandler.Clientset(), podHandler.InformerFactory(), podHandler.Informer(), podHandler.Lister())
 	//stopCh := make(chan struct{})
 	stopCh := setupSignalHandler()
 	podHandler.InformerFactory().Start(stopCh)
@@ -110,3 +153,10 @@ func GetPod(namespace, name string) (*corev1.Pod, error) {
 	}
 	return podObj, nil
 }
+
+// GetSecret gets the secret from apiserver with the ServiceAccount of
+// ratel-webterminal, not the impersonated user, the users may not be allowed
+// to read the Secrets used by the pods.
+func GetSecret(namespace, name string) (*corev1.Secret, error) {
+	return podController.clientset.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+}
@@ -0,0 +1,188 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// eventWatcherBufferSize is the buffer size of the channel returned by
+// WatchEvents, the events are dropped if the channel is full.
+const eventWatcherBufferSize = 100
+
+var (
+	// eventInformers are the shared event informers of the namespaces which
+	// are watched by WatchEvents.
+	eventInformers   = make(map[string]*eventInformer)
+	eventInformersMu sync.Mutex
+)
+
+// eventInformer is the event informer of a namespace shared by all watchers of
+// the namespace, it's stopped after the last watcher leaves.
+type eventInformer struct {
+	informer cache.SharedIndexInformer
+	stopCh   chan struct{}
+	// refs is the number of the watchers, including the ones waiting for
+	// the informer to be synced.
+	refs int
+
+	l        sync.Mutex
+	watchers map[*eventWatcher]struct{}
+}
+
+type eventWatcher struct {
+	match func(*corev1.Event) bool
+	ch    chan *corev1.Event
+	// sent are the resource versions of the existing events returned by
+	// WatchEvents, so they are not sent to the channel again.
+	sent map[types.UID]string
+}
+
+// WatchEvents lists the events in the namespace matched by match, the oldest
+// first, and returns a channel which receives the matched events added or
+// updated later. The events of the namespace are cached by an informer shared
+// by all watchers of the namespace. The channel is closed after ctx is done.
+func WatchEvents(ctx context.Context, namespace string, match func(*corev1.Event) bool) ([]*corev1.Event, <-chan *corev1.Event, error) {
+	inf := acquireEventInformer(namespace)
+	if !cache.WaitForCacheSync(ctx.Done(), inf.informer.HasSynced) {
+		releaseEventInformer(namespace, inf)
+		return nil, nil, fmt.Errorf("wait for events of namespace %s synced: %w", namespace, ctx.Err())
+	}
+
+	watcher := &eventWatcher{
+		match: match,
+		ch:    make(chan *corev1.Event, eventWatcherBufferSize),
+		sent:  make(map[types.UID]string),
+	}
+	var matched []*corev1.Event
+	// the events can't be dispatched between listing and adding the watcher.
+	inf.l.Lock()
+	for _, obj := range inf.informer.GetStore().List() {
+		if event, ok := obj.(*corev1.Event); ok && match(event) {
+			matched = append(matched, event)
+			watcher.sent[event.UID] = event.ResourceVersion
+		}
+	}
+	inf.watchers[watcher] = struct{}{}
+	inf.l.Unlock()
+	sort.SliceStable(matched, func(i, j int) bool {
+		return EventTime(matched[i]).Time.Before(EventTime(matched[j]).Time)
+	})
+
+	go func() {
+		<-ctx.Done()
+		inf.l.Lock()
+		delete(inf.watchers, watcher)
+		close(watcher.ch)
+		inf.l.Unlock()
+		releaseEventInformer(namespace, inf)
+	}()
+	return matched, watcher.ch, nil
+}
+
+// acquireEventInformer returns the event informer of the namespace, it's
+// started if not exists.
+func acquireEventInformer(namespace string) *eventInformer {
+	eventInformersMu.Lock()
+	defer eventInformersMu.Unlock()
+	if inf, ok := eventInformers[namespace]; ok {
+		inf.refs++
+		return inf
+	}
+	inf := &eventInformer{
+		informer: coreinformers.NewEventInformer(podController.clientset, namespace, 0, cache.Indexers{}),
+		stopCh:   make(chan struct{}),
+		refs:     1,
+		watchers: make(map[*eventWatcher]struct{}),
+	}
+	inf.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    inf.dispatch,
+		UpdateFunc: func(_, obj interface{}) { inf.dispatch(obj) },
+	})
+	eventInformers[namespace] = inf
+	go inf.informer.Run(inf.stopCh)
+	log.Debugf("event informer of namespace %s started", namespace)
+	return inf
+}
+
+// releaseEventInformer stops the event informer of the namespace if it's the
+// last watcher.
+func releaseEventInformer(namespace string, inf *eventInformer) {
+	eventInformersMu.Lock()
+	defer eventInformersMu.Unlock()
+	if inf.refs--; inf.refs > 0 {
+		return
+	}
+	delete(eventInformers, namespace)
+	close(inf.stopCh)
+	log.Debugf("event informer of namespace %s stopped", namespace)
+}
+
+// dispatch sends the event to the watchers matching it, the event is dropped
+// for the watcher whose channel is full, so a slow watcher doesn't block the
+// others.
+func (inf *eventInformer) dispatch(obj interface{}) {
+	event, ok := obj.(*corev1.Event)
+	if !ok {
+		return
+	}
+	inf.l.Lock()
+	defer inf.l.Unlock()
+	for watcher := range inf.watchers {
+		if !watcher.match(event) {
+			continue
+		}
+		if rv, ok := watcher.sent[event.UID]; ok {
+			delete(watcher.sent, event.UID)
+			if rv == event.ResourceVersion {
+				continue
+			}
+		}
+		select {
+		case watcher.ch <- event:
+		default:
+			log.Warnf("drop event %s/%s, the watcher is too slow", event.Namespace, event.Name)
+		}
+	}
+}
+
+// EventTime returns the last time the event occurred.
+func EventTime(event *corev1.Event) metav1.Time {
+	switch {
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp
+	case !event.EventTime.IsZero():
+		return metav1.Time{Time: event.EventTime.Time}
+	}
+	return event.FirstTimestamp
+}
+
+// EventObjects returns the objects whose events are shown with the pod, as
+// "Kind/Name" keys: the pod itself, its owners, and the Deployment owning its
+// ReplicaSet.
+func EventObjects(pod *corev1.Pod) map[string]bool {
+	objects := map[string]bool{"Pod/" + pod.Name: true}
+	for _, owner := range pod.OwnerReferences {
+		objects[owner.Kind+"/"+owner.Name] = true
+		if owner.Kind != "ReplicaSet" {
+			continue
+		}
+		rs, err := podController.replicaSetLister.ReplicaSets(pod.Namespace).Get(owner.Name)
+		if err != nil {
+			log.Warnf("get replicaset %s/%s error: %s", pod.Namespace, owner.Name, err.Error())
+			continue
+		}
+		for _, rsOwner := range rs.OwnerReferences {
+			objects[rsOwner.Kind+"/"+rsOwner.Name] = true
+		}
+	}
+	return objects
+}
@@ -0,0 +1,152 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// DefaultContainerAnnotation is the annotation used by kubectl to select the
+// default container of the pod.
+const DefaultContainerAnnotation = "kubectl.kubernetes.io/default-container"
+
+// ResolvePod resolves a workload reference or a label selector to a ready pod
+// from the pod lister.
+//
+// ref is a pod name or a workload reference in "kind/name" format, such as
+// "deployment/api", "statefulset/db", "daemonset/agent", "replicaset/api-xxxx",
+// "job/migrate" or "pod/nginx". Short names like "deploy", "sts", "ds", "rs"
+// are also supported. If ref is empty, selector is used to select pods.
+// Only the workload is got by calling apiserver API directly for its selector,
+// the pods are always listed from the pod lister.
+func ResolvePod(namespace, ref, selector string) (*corev1.Pod, error) {
+	if len(ref) == 0 && len(selector) == 0 {
+		return nil, fmt.Errorf("neither pod nor label selector is set")
+	}
+	if kind, name, ok := strings.Cut(ref, "/"); ok {
+		switch strings.ToLower(kind) {
+		case "pod", "pods", "po":
+			return GetPod(namespace, name)
+		}
+	} else if len(ref) != 0 {
+		return GetPod(namespace, ref)
+	}
+
+	sel, err := PodSelector(namespace, ref, selector)
+	if err != nil {
+		return nil, err
+	}
+	pods, err := ListPods(namespace, sel)
+	if err != nil {
+		return nil, err
+	}
+	// prefer the newest ready pod.
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[j].CreationTimestamp.Before(&pods[i].CreationTimestamp)
+	})
+	for _, p := range pods {
+		if p.DeletionTimestamp == nil && isPodReady(p) {
+			return p, nil
+		}
+	}
+	if len(ref) != 0 {
+		return nil, fmt.Errorf("no ready pod found for '%s' in namespace '%s'", ref, namespace)
+	}
+	return nil, fmt.Errorf("no ready pod found for selector '%s' in namespace '%s'", selector, namespace)
+}
+
+// PodSelector returns the pod selector of the workload reference in "kind/name"
+// format, or parses the label selector if ref is empty.
+func PodSelector(namespace, ref, selector string) (labels.Selector, error) {
+	if len(ref) != 0 {
+		return workloadSelector(namespace, ref)
+	}
+	sel, err := labels.Parse(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid label selector '%s': %s", selector, err.Error())
+	}
+	return sel, nil
+}
+
+// ListPods lists the pods matched the selector in the namespace from pod lister.
+func ListPods(namespace string, selector labels.Selector) ([]*corev1.Pod, error) {
+	return podController.podLister.Pods(namespace).List(selector)
+}
+
+// DefaultContainer returns the default container name of the pod.
+// It's the container specified by the "kubectl.kubernetes.io/default-container"
+// annotation, or the first container of the pod.
+func DefaultContainer(podObj *corev1.Pod) string {
+	if name := podObj.Annotations[DefaultContainerAnnotation]; len(name) != 0 {
+		for _, c := range podObj.Spec.Containers {
+			if c.Name == name {
+				return name
+			}
+		}
+	}
+	if len(podObj.Spec.Containers) != 0 {
+		return podObj.Spec.Containers[0].Name
+	}
+	return ""
+}
+
+// workloadSelector returns the pod selector of the workload referenced by
+// "kind/name", the workload is got from the informer cache.
+func workloadSelector(namespace, ref string) (labels.Selector, error) {
+	kind, name, _ := strings.Cut(ref, "/")
+	if len(name) == 0 {
+		return nil, fmt.Errorf("invalid workload reference '%s'", ref)
+	}
+
+	var (
+		selector *metav1.LabelSelector
+		err      error
+	)
+	switch strings.ToLower(kind) {
+	case "deployment", "deployments", "deploy":
+		obj, e := podController.deploymentLister.Deployments(namespace).Get(name)
+		if err = e; err == nil {
+			selector = obj.Spec.Selector
+		}
+	case "statefulset", "statefulsets", "sts":
+		obj, e := podController.statefulSetLister.StatefulSets(namespace).Get(name)
+		if err = e; err == nil {
+			selector = obj.Spec.Selector
+		}
+	case "daemonset", "daemonsets", "ds":
+		obj, e := podController.daemonSetLister.DaemonSets(namespace).Get(name)
+		if err = e; err == nil {
+			selector = obj.Spec.Selector
+		}
+	case "replicaset", "replicasets", "rs":
+		obj, e := podController.replicaSetLister.ReplicaSets(namespace).Get(name)
+		if err = e; err == nil {
+			selector = obj.Spec.Selector
+		}
+	case "job", "jobs":
+		obj, e := podController.jobLister.Jobs(namespace).Get(name)
+		if err = e; err == nil {
+			selector = obj.Spec.Selector
+		}
+	default:
+		return nil, fmt.Errorf("unsupported workload kind '%s'", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return metav1.LabelSelectorAsSelector(selector)
+}
+
+// isPodReady check whether the pod is ready.
+func isPodReady(podObj *corev1.Pod) bool {
+	for _, cond := range podObj.Status.Conditions {
+		if cond.Type == corev1.PodReady && cond.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
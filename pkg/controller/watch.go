@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"sync"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+// podWatchers stores all the channels which should be notified when any pod
+// changed, the value is the namespace watched.
+var (
+	podWatchers = make(map[chan struct{}]string)
+	watchersMu  sync.Mutex
+)
+
+// WatchPods returns a channel which receives a notification whenever any pod
+// in the namespace is added, updated or deleted in the pod informer, and a
+// function to stop watching.
+//
+// The notifications are coalesced, the receiver should list the pods from the
+// pod lister again after it is notified, instead of relying on every event.
+func WatchPods(namespace string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	watchersMu.Lock()
+	podWatchers[ch] = namespace
+	watchersMu.Unlock()
+
+	return ch, func() {
+		watchersMu.Lock()
+		delete(podWatchers, ch)
+		watchersMu.Unlock()
+	}
+}
+
+// podEventHandler returns the event handler registered to the pod informer,
+// which notifies all pod watchers.
+func podEventHandler() cache.ResourceEventHandler {
+	notify := func(obj interface{}) {
+		key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+		if err != nil {
+			return
+		}
+		namespace, _, err := cache.SplitMetaNamespaceKey(key)
+		if err != nil {
+			return
+		}
+
+		watchersMu.Lock()
+		defer watchersMu.Unlock()
+		for ch, ns := range podWatchers {
+			if ns != namespace {
+				continue
+			}
+			// never block the informer, there is already a pending notification.
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    notify,
+		UpdateFunc: func(_, newObj interface{}) { notify(newObj) },
+		DeleteFunc: notify,
+	}
+}
@@ -1,6 +1,7 @@
 package errors
 
 import (
+	"encoding/json"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -19,6 +20,41 @@ const (
 	CodeContainerNotSet
 	CodeInvalidParam
 	CodeInternalError
+	CodeInvalidTailLines
+	CodeInvalidSinceSeconds
+	CodeInvalidSinceTime
+	CodeInvalidLimitBytes
+	CodeInvalidPrevious
+	CodeInvalidTimestamps
+	CodeInvalidFollow
+	CodeConflictSince
+	CodeInvalidLogFilter
+	CodeInvalidLogFormat
+	CodeInvalidLogArchive
+	CodeSessionNotFound
+	CodeInvalidSessionToken
+	CodeInvalidFilePath
+	CodeFileNotFound
+	CodeFileTooLarge
+	CodeLengthRequired
+	CodeCopyFileFailed
+	CodeFilePermissionDenied
+	CodeListFilesFailed
+	CodeNotRegularFile
+	CodeInvalidRange
+	CodeIsDirectory
+	CodeDeleteFileFailed
+	CodeInvalidPort
+	CodePortForwardFailed
+	CodeActionDenied
+	CodeNamespaceDenied
+	CodePodDenied
+	CodeContainerDenied
+	CodeSessionRateLimited
+	CodeTooManySessions
+	CodeUnauthorized
+	CodeDebugImageDenied
+	CodeNodeDenied
 )
 
 var codeMsgMap = map[ResponseCode]string{
@@ -31,6 +67,48 @@ var codeMsgMap = map[ResponseCode]string{
 	CodeContainerNotSet:   "container not set",
 	CodeInvalidParam:      "invalid parameters",
 	CodeInternalError:     "internal server error",
+
+	CodeInvalidTailLines:    "invalid tail, must be a non-negative integer",
+	CodeInvalidSinceSeconds: "invalid sinceSeconds, must be a positive integer",
+	CodeInvalidSinceTime:    "invalid sinceTime, must be a RFC3339 timestamp",
+	CodeInvalidLimitBytes:   "invalid limitBytes, must be a positive integer",
+	CodeInvalidPrevious:     "invalid previous, must be a boolean",
+	CodeInvalidTimestamps:   "invalid timestamps, must be a boolean",
+	CodeInvalidFollow:       "invalid follow, must be a boolean",
+	CodeConflictSince:       "only one of sinceSeconds or sinceTime may be set",
+	CodeInvalidLogFilter:    "invalid log filter",
+	CodeInvalidLogFormat:    "invalid format, must be one of 'text' or 'gzip'",
+	CodeInvalidLogArchive:   "invalid archive, must be one of 'zip' or 'tar'",
+	CodeSessionNotFound:     "terminal session not found or already closed",
+	CodeInvalidSessionToken: "invalid terminal session token",
+	CodeInvalidFilePath:     "invalid path, must be an absolute path without '..'",
+	CodeFileNotFound:        "file not found in container",
+	CodeFileTooLarge:        "file is too large",
+	CodeLengthRequired:      "Content-Length is required",
+	CodeCopyFileFailed:      "copy file error, make sure tar exists in container",
+
+	CodeFilePermissionDenied: "permission denied in container",
+	CodeListFilesFailed:      "list files error, make sure find or stat exists in container",
+	CodeNotRegularFile:       "not a regular file",
+	CodeInvalidRange:         "invalid range",
+	CodeIsDirectory:          "path is a directory, set recursive=true to delete it",
+	CodeDeleteFileFailed:     "delete file error",
+
+	CodeInvalidPort:       "invalid port, must be an integer between 1 and 65535",
+	CodePortForwardFailed: "port forward error",
+
+	CodeActionDenied:    "the action is denied by policy",
+	CodeNamespaceDenied: "the namespace is denied by policy",
+	CodePodDenied:       "the pod is denied by policy",
+	CodeContainerDenied: "the container is denied by policy",
+
+	CodeSessionRateLimited: "too many sessions, retry later",
+	CodeTooManySessions:    "too many concurrent sessions",
+
+	CodeUnauthorized: "login required",
+
+	CodeDebugImageDenied: "the debug image is not allowed, see --allowed-debug-image",
+	CodeNodeDenied:       "the node is denied by policy",
 }
 
 func (c ResponseCode) Msg() string {
@@ -71,6 +149,44 @@ func ResponseSuccess(c *gin.Context, data interface{}) {
 	})
 }
 
+// WriteError writes the error response with given http status code to
+// http.ResponseWriter, it is used by the handlers not based on gin.
+func WriteError(w http.ResponseWriter, statusCode int, code ResponseCode) {
+	WriteErrorWithMsg(w, statusCode, code, code.Msg())
+}
+
+// WriteErrorWithMsg is the same as WriteError, but with custom message.
+func WriteErrorWithMsg(w http.ResponseWriter, statusCode int, code ResponseCode, msg interface{}) {
+	data, err := json.Marshal(&ResponseData{
+		Code: code,
+		Msg:  msg,
+		Data: nil,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(statusCode)
+	w.Write(data)
+}
+
+// WriteSuccess writes the success response with data to http.ResponseWriter,
+// it is used by the handlers not based on gin.
+func WriteSuccess(w http.ResponseWriter, data interface{}) {
+	body, err := json.Marshal(&ResponseData{
+		Code: CodeSuccess,
+		Msg:  CodeSuccess.Msg(),
+		Data: data,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
+
 // IsForbiddenError returns true if give error is http.StatusForbidden, false otherwise.
 func IsForbiddenError(err error) bool {
 	status, ok := err.(*errors.StatusError)
@@ -0,0 +1,191 @@
+package janitor
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/forbearing/k8s/pod"
+	"github.com/forbearing/ratel-webterminal/pkg/args"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The janitor garbage-collects the short-lived pods created by ratel-webterminal,
+// such as the node shell pods and the copied debug pods.
+//
+// Every managed pod is labeled with the instance name of ratel-webterminal which
+// created it. The pod should be deleted by its session when the session ends,
+// if ratel-webterminal crashed before that, the pod will be deleted by:
+// 1. the kubernetes garbage collector, if the pod is in the same namespace with
+//    ratel-webterminal, because the ratel-webterminal pod is its owner.
+// 2. the janitor loop of any ratel-webterminal instance, if the instance which
+//    created it no longer exists.
+
+const (
+	LabelManagedBy         = "app.kubernetes.io/managed-by"
+	LabelInstance          = "ratel-webterminal/instance"
+	LabelInstanceNamespace = "ratel-webterminal/instance-namespace"
+
+	managedBy       = "ratel-webterminal"
+	collectInterval = time.Minute
+)
+
+var (
+	// instanceName and instanceNamespace are the name and namespace of the
+	// ratel-webterminal pod, they are injected by downward API, see
+	// deploy/ratel-webterminal.yaml.
+	instanceName      = os.Getenv("NAME")
+	instanceNamespace = os.Getenv("NAMESPACE")
+
+	clientset      kubernetes.Interface
+	ownerReference *metav1.OwnerReference
+
+	// tracked stores all managed pods which are still used by sessions.
+	tracked = make(map[string]struct{})
+	l       sync.Mutex
+)
+
+// Init creates the clientset used by the janitor, resolves the ratel-webterminal
+// pod as the owner of managed pods, and starts the janitor loop. It does nothing
+// if neither node shell nor copy mode is enabled, no managed pod is created.
+func Init() {
+	if !args.GetEnableNodeShell() && !args.GetEnableCopy() {
+		return
+	}
+	podHandler, err := pod.New(context.TODO(), args.GetKubeConfigFile(), "")
+	if err != nil {
+		log.Fatalf("create pod handler error in janitor: %s", err.Error())
+	}
+	clientset = podHandler.Clientset()
+
+	// not running in cluster, use hostname as the instance name.
+	if len(instanceName) == 0 || len(instanceNamespace) == 0 {
+		if instanceName, err = os.Hostname(); err != nil {
+			log.Fatalf("get hostname error in janitor: %s", err.Error())
+		}
+		instanceNamespace = ""
+	} else {
+		self, err := clientset.CoreV1().Pods(instanceNamespace).Get(context.TODO(), instanceName, metav1.GetOptions{})
+		if err != nil {
+			log.Warnf("get ratel-webterminal pod %s/%s error: %s", instanceNamespace, instanceName, err.Error())
+		} else {
+			ownerReference = metav1.NewControllerRef(self, corev1.SchemeGroupVersion.WithKind("Pod"))
+		}
+	}
+
+	go wait.Forever(collect, collectInterval)
+}
+
+// Namespace returns the namespace of ratel-webterminal, managed pods created in
+// this namespace are owned by ratel-webterminal pod.
+// It returns empty string if ratel-webterminal is not running in cluster.
+func Namespace() string {
+	return instanceNamespace
+}
+
+// Labels returns the labels should be set to the managed pods.
+func Labels() map[string]string {
+	return map[string]string{
+		LabelManagedBy:         managedBy,
+		LabelInstance:          instanceName,
+		LabelInstanceNamespace: instanceNamespace,
+	}
+}
+
+// OwnerReferences returns the owner references should be set to the managed pod
+// created in the given namespace. Owner references can't cross namespace, so it
+// returns nil if the namespace is not the namespace of ratel-webterminal.
+func OwnerReferences(namespace string) []metav1.OwnerReference {
+	if ownerReference == nil || namespace != instanceNamespace {
+		return nil
+	}
+	return []metav1.OwnerReference{*ownerReference}
+}
+
+// Track marks the managed pod as in use, the janitor won't delete it.
+func Track(namespace, name string) {
+	l.Lock()
+	defer l.Unlock()
+	tracked[namespace+"/"+name] = struct{}{}
+}
+
+// Release deletes the managed pod and stops tracking it.
+func Release(namespace, name string) {
+	l.Lock()
+	delete(tracked, namespace+"/"+name)
+	l.Unlock()
+
+	if err := deletePod(namespace, name); err != nil {
+		log.Errorf("delete pod %s/%s error: %s, janitor will retry later", namespace, name, err.Error())
+	}
+}
+
+// collect deletes the managed pods which no longer used by any session. Only the
+// pods created by the instances in the same namespace are listed, the instances
+// in other namespaces collect their own pods.
+func collect() {
+	selector := labels.SelectorFromSet(labels.Set{
+		LabelManagedBy:         managedBy,
+		LabelInstanceNamespace: instanceNamespace,
+	}).String()
+	podList, err := clientset.CoreV1().Pods(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		log.Error("janitor list managed pods error: ", err)
+		return
+	}
+
+	instances := make(map[string]bool)
+	for _, p := range podList.Items {
+		if p.DeletionTimestamp != nil {
+			continue
+		}
+		instance, namespace := p.Labels[LabelInstance], p.Labels[LabelInstanceNamespace]
+		if instance == instanceName && namespace == instanceNamespace {
+			l.Lock()
+			_, ok := tracked[p.Namespace+"/"+p.Name]
+			l.Unlock()
+			if ok {
+				continue
+			}
+		} else {
+			alive, ok := instances[namespace+"/"+instance]
+			if !ok {
+				alive = instanceAlive(namespace, instance)
+				instances[namespace+"/"+instance] = alive
+			}
+			if alive {
+				continue
+			}
+		}
+		log.Infof("janitor delete unused pod %s/%s", p.Namespace, p.Name)
+		if err := deletePod(p.Namespace, p.Name); err != nil {
+			log.Errorf("janitor delete pod %s/%s error: %s", p.Namespace, p.Name, err.Error())
+		}
+	}
+}
+
+// instanceAlive checks whether the ratel-webterminal instance still exists.
+// Instances running out of cluster can't be checked, they are always alive.
+func instanceAlive(namespace, instance string) bool {
+	if len(namespace) == 0 {
+		return true
+	}
+	_, err := clientset.CoreV1().Pods(namespace).Get(context.TODO(), instance, metav1.GetOptions{})
+	return !apierrors.IsNotFound(err)
+}
+
+func deletePod(namespace, name string) error {
+	gracePeriod := int64(0)
+	err := clientset.CoreV1().Pods(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{GracePeriodSeconds: &gracePeriod})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,419 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"sync/atomic"
+
+	"github.com/forbearing/ratel-webterminal/pkg/args"
+	"github.com/forbearing/ratel-webterminal/pkg/config"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Action is what the user does to the pod.
+type Action string
+
+const (
+	// ActionExec is running commands in the pod: shell, attach, debug, copy
+	// and port forward.
+	ActionExec Action = "exec"
+	// ActionLogs is viewing the logs and events of the pod.
+	ActionLogs Action = "logs"
+	// ActionFiles is browsing, uploading and downloading files of the pod.
+	ActionFiles Action = "files"
+	// ActionNodeShell is opening a root shell on the node. It's only allowed
+	// by the allow rules listing it in actions, "*" and empty actions don't
+	// allow it.
+	ActionNodeShell Action = "node-shell"
+)
+
+// actionVerbs are the verbs of the actions in the denial messages.
+var actionVerbs = map[Action]string{
+	ActionExec:      "exec",
+	ActionLogs:      "view logs",
+	ActionFiles:     "access files",
+	ActionNodeShell: "open node shells",
+}
+
+const (
+	effectAllow = "allow"
+	effectDeny  = "deny"
+)
+
+// Level is which part of the request is denied by the policy.
+type Level int
+
+const (
+	// LevelAction means the user may not do the action anywhere.
+	LevelAction Level = iota
+	// LevelNamespace means the user may not do the action in the namespace.
+	LevelNamespace
+	// LevelPod means the user may not do the action in the pod.
+	LevelPod
+	// LevelContainer means the user may not do the action in the container.
+	LevelContainer
+	// LevelNode means the user may not open the node shell on the node.
+	LevelNode
+)
+
+// DeniedError is returned if the request is denied by the policy.
+type DeniedError struct {
+	Level Level
+	// Rule is the name of the deny rule, empty if no allow rule matched.
+	Rule string
+	msg  string
+}
+
+func (e *DeniedError) Error() string {
+	return e.msg
+}
+
+// current is the *policy in use, nil if "--policy-file" is not set.
+var current atomic.Value
+
+type policy struct {
+	defaultAllow bool
+	rules        []*rule
+}
+
+type rule struct {
+	name        string
+	deny        bool
+	users       []string
+	groups      []string
+	actions     []string
+	namespaces  []string
+	podSelector labels.Selector
+	containers  []string
+	nodes       []string
+}
+
+// Init parses "--trusted-proxy" and loads "--policy-file", the policy is reloaded when the file changed,
+// and the previous one is kept if the new one is invalid.
+func Init() {
+	initTrustedProxies()
+	filename := args.GetPolicyFile()
+	if len(filename) == 0 {
+		return
+	}
+	conf, err := config.LoadPolicy(filename, func(conf *config.Policy, err error) {
+		if err == nil {
+			err = set(conf)
+		}
+		if err != nil {
+			log.Errorf("reload policy file %s error, keep the previous policy: %s", filename, err.Error())
+			return
+		}
+		log.Infof("policy file %s reloaded", filename)
+	})
+	if err != nil {
+		log.Fatalf("load policy file %s error: %s", filename, err.Error())
+	}
+	if err := set(conf); err != nil {
+		log.Fatalf("load policy file %s error: %s", filename, err.Error())
+	}
+	log.Infof("policy file %s loaded", filename)
+}
+
+// set validates the policy and uses it.
+func set(conf *config.Policy) error {
+	p := &policy{}
+	switch conf.Default {
+	case effectAllow:
+		p.defaultAllow = true
+	case effectDeny, "":
+	default:
+		return fmt.Errorf("invalid default '%s', must be one of 'allow' or 'deny'", conf.Default)
+	}
+	for i, r := range conf.Rules {
+		name := r.Name
+		if len(name) == 0 {
+			name = fmt.Sprintf("rules[%d]", i)
+		}
+		compiled := &rule{
+			name:       name,
+			users:      r.Users,
+			groups:     r.Groups,
+			actions:    r.Actions,
+			namespaces: r.Namespaces,
+			containers: r.Containers,
+			nodes:      r.Nodes,
+		}
+		switch r.Effect {
+		case effectAllow:
+		case effectDeny:
+			compiled.deny = true
+		default:
+			return fmt.Errorf("invalid effect '%s' of rule '%s', must be one of 'allow' or 'deny'", r.Effect, name)
+		}
+		for _, action := range r.Actions {
+			switch Action(action) {
+			case ActionExec, ActionLogs, ActionFiles, ActionNodeShell, "*":
+			default:
+				return fmt.Errorf("invalid action '%s' of rule '%s'", action, name)
+			}
+		}
+		// the rules of nodes only match the node shells.
+		if len(r.Nodes) != 0 && (len(r.Namespaces) != 0 || len(r.PodSelector) != 0 || len(r.Containers) != 0) {
+			return fmt.Errorf("nodes of rule '%s' can't be set with namespaces, podSelector or containers", name)
+		}
+		for _, pattern := range append(append(append([]string(nil), r.Namespaces...), r.Containers...), r.Nodes...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern '%s' of rule '%s'", pattern, name)
+			}
+		}
+		if len(r.PodSelector) != 0 {
+			selector, err := labels.Parse(r.PodSelector)
+			if err != nil {
+				return fmt.Errorf("invalid podSelector of rule '%s': %s", name, err.Error())
+			}
+			compiled.podSelector = selector
+		}
+		p.rules = append(p.rules, compiled)
+	}
+	current.Store(p)
+	return nil
+}
+
+// Enabled returns whether the policy file is loaded. If not, all requests are
+// allowed.
+func Enabled() bool {
+	p, _ := current.Load().(*policy)
+	return p != nil
+}
+
+// CheckNamespace checks the policy before the pod is got, so the requests to
+// the denied namespaces are rejected early. The rules with podSelector or
+// containers are decided by Check.
+func CheckNamespace(user *User, action Action, namespace string) error {
+	p, _ := current.Load().(*policy)
+	if p == nil {
+		return nil
+	}
+	for _, r := range p.rules {
+		if r.deny && r.podSelector == nil && len(r.containers) == 0 && r.matchNamespace(user, action, namespace) {
+			return denied(r.level(), r.name, user, action, namespace, "", "")
+		}
+	}
+	if p.defaultAllow {
+		return nil
+	}
+	for _, r := range p.rules {
+		if !r.deny && r.matchNamespace(user, action, namespace) {
+			return nil
+		}
+	}
+	return denied(p.closest(user, action, namespace, nil), "", user, action, namespace, "", "")
+}
+
+// Check checks the policy of the container in the pod. containerName is
+// empty if the action is on the whole pod, such as port forwarding, then the
+// allow rules with containers are not matched, and the deny rules with
+// containers are matched if any container of the pod is denied.
+func Check(user *User, action Action, podObj *corev1.Pod, containerName string) error {
+	p, _ := current.Load().(*policy)
+	if p == nil {
+		return nil
+	}
+	for _, r := range p.rules {
+		if r.deny && r.match(user, action, podObj, containerName) {
+			return denied(r.level(), r.name, user, action, podObj.Namespace, podObj.Name, containerName)
+		}
+	}
+	if p.defaultAllow {
+		return nil
+	}
+	for _, r := range p.rules {
+		if !r.deny && r.match(user, action, podObj, containerName) {
+			return nil
+		}
+	}
+	return denied(p.closest(user, action, podObj.Namespace, podObj), "", user, action, podObj.Namespace, podObj.Name, containerName)
+}
+
+// CheckNode checks the policy of the node shell on the node. Only the rules
+// without namespaces, podSelector and containers are matched, and the node
+// shell must be listed in the actions of the allow rules explicitly, even if
+// the default is "allow".
+func CheckNode(user *User, nodeName string) error {
+	p, _ := current.Load().(*policy)
+	if p == nil {
+		return nil
+	}
+	for _, r := range p.rules {
+		if r.deny && r.matchNode(user) && matchPattern(r.nodes, nodeName) {
+			level := LevelAction
+			if len(r.nodes) != 0 {
+				level = LevelNode
+			}
+			return nodeDenied(level, r.name, user, nodeName)
+		}
+	}
+	level := LevelAction
+	for _, r := range p.rules {
+		if r.deny || !containsString(r.actions, string(ActionNodeShell)) || !r.matchNode(user) {
+			continue
+		}
+		if matchPattern(r.nodes, nodeName) {
+			return nil
+		}
+		level = LevelNode
+	}
+	return nodeDenied(level, "", user, nodeName)
+}
+
+// closest returns how far the allow rules of the user matched the request, so
+// the denial can be explained.
+func (p *policy) closest(user *User, action Action, namespace string, podObj *corev1.Pod) Level {
+	level := LevelAction
+	for _, r := range p.rules {
+		if r.deny || len(r.nodes) != 0 || !r.matchAction(user, action) {
+			continue
+		}
+		if level < LevelNamespace {
+			level = LevelNamespace
+		}
+		if !matchPattern(r.namespaces, namespace) || podObj == nil {
+			continue
+		}
+		if level < LevelPod {
+			level = LevelPod
+		}
+		if r.podSelector == nil || r.podSelector.Matches(labels.Set(podObj.Labels)) {
+			level = LevelContainer
+		}
+	}
+	return level
+}
+
+// level returns the most specific part of the request matched by the rule.
+func (r *rule) level() Level {
+	switch {
+	case len(r.containers) != 0:
+		return LevelContainer
+	case r.podSelector != nil:
+		return LevelPod
+	case len(r.namespaces) != 0:
+		return LevelNamespace
+	}
+	return LevelAction
+}
+
+func denied(level Level, ruleName string, user *User, action Action, namespace, podName, containerName string) error {
+	var msg string
+	verb := actionVerbs[action]
+	switch level {
+	case LevelAction:
+		msg = fmt.Sprintf("user '%s' may not %s", user.Name, verb)
+	case LevelNamespace:
+		msg = fmt.Sprintf("user '%s' may not %s in namespace '%s'", user.Name, verb, namespace)
+	case LevelPod:
+		msg = fmt.Sprintf("user '%s' may not %s in pod '%s/%s'", user.Name, verb, namespace, podName)
+	case LevelContainer:
+		if len(containerName) == 0 && len(ruleName) != 0 {
+			msg = fmt.Sprintf("user '%s' may not %s in pod '%s/%s' which has denied containers", user.Name, verb, namespace, podName)
+		} else if len(containerName) == 0 {
+			msg = fmt.Sprintf("user '%s' may not %s in all containers of pod '%s/%s'", user.Name, verb, namespace, podName)
+		} else {
+			msg = fmt.Sprintf("user '%s' may not %s in container '%s' of pod '%s/%s'", user.Name, verb, containerName, namespace, podName)
+		}
+	}
+	if len(ruleName) != 0 {
+		msg += fmt.Sprintf(", denied by rule '%s'", ruleName)
+	}
+	return &DeniedError{Level: level, Rule: ruleName, msg: msg}
+}
+
+func nodeDenied(level Level, ruleName string, user *User, nodeName string) error {
+	msg := fmt.Sprintf("user '%s' may not %s", user.Name, actionVerbs[ActionNodeShell])
+	if level == LevelNode {
+		msg += fmt.Sprintf(" on node '%s'", nodeName)
+	}
+	if len(ruleName) != 0 {
+		msg += fmt.Sprintf(", denied by rule '%s'", ruleName)
+	}
+	return &DeniedError{Level: level, Rule: ruleName, msg: msg}
+}
+
+func (r *rule) matchAction(user *User, action Action) bool {
+	if len(r.users) != 0 || len(r.groups) != 0 {
+		matched := matchString(r.users, user.Name)
+		for _, group := range user.Groups {
+			matched = matched || matchString(r.groups, group)
+		}
+		if !matched {
+			return false
+		}
+	}
+	return len(r.actions) == 0 || matchString(r.actions, string(action))
+}
+
+func (r *rule) matchNamespace(user *User, action Action, namespace string) bool {
+	return len(r.nodes) == 0 && r.matchAction(user, action) && matchPattern(r.namespaces, namespace)
+}
+
+// matchNode returns whether the rule matches the node shell of the user, the
+// rules of namespaces, pods or containers never match it.
+func (r *rule) matchNode(user *User) bool {
+	return len(r.namespaces) == 0 && r.podSelector == nil && len(r.containers) == 0 && r.matchAction(user, ActionNodeShell)
+}
+
+func (r *rule) match(user *User, action Action, podObj *corev1.Pod, containerName string) bool {
+	if !r.matchNamespace(user, action, podObj.Namespace) {
+		return false
+	}
+	if r.podSelector != nil && !r.podSelector.Matches(labels.Set(podObj.Labels)) {
+		return false
+	}
+	if len(r.containers) == 0 {
+		return true
+	}
+	if len(containerName) != 0 {
+		return matchPattern(r.containers, containerName)
+	}
+	if !r.deny {
+		return false
+	}
+	for _, c := range append(append([]corev1.Container(nil), podObj.Spec.InitContainers...), podObj.Spec.Containers...) {
+		if matchPattern(r.containers, c.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchString returns whether s is in list, "*" matches everything.
+func matchString(list []string, s string) bool {
+	for _, item := range list {
+		if item == "*" || item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// containsString returns whether s is in list, "*" is not special.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern returns whether s matches any glob pattern in patterns, empty
+// patterns match everything.
+func matchPattern(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, s); matched {
+			return true
+		}
+	}
+	return false
+}
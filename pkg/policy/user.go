@@ -0,0 +1,140 @@
+package policy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/forbearing/ratel-webterminal/pkg/args"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// AnonymousUser is the user of the requests without user, the same as
+	// kube-apiserver.
+	AnonymousUser = "system:anonymous"
+	// UnauthenticatedGroup is the group of AnonymousUser.
+	UnauthenticatedGroup = "system:unauthenticated"
+	// AuthenticatedGroup is the group of all authenticated users.
+	AuthenticatedGroup = "system:authenticated"
+)
+
+// User is who sends the request.
+type User struct {
+	Name   string
+	Groups []string
+}
+
+type userKey struct{}
+
+// trustedProxies are the networks of "--trusted-proxy".
+var trustedProxies []*net.IPNet
+
+func initTrustedProxies() {
+	for _, proxy := range args.GetTrustedProxies() {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			log.Fatalf("invalid trusted proxy '%s': %s", proxy, err.Error())
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+	if len(args.GetUserHeader()) != 0 && len(trustedProxies) == 0 {
+		log.Warn("--trusted-proxy is not set, --user-header and --groups-header are ignored")
+	}
+}
+
+// fromTrustedProxy returns whether the request is sent by "--trusted-proxy".
+func fromTrustedProxy(r *http.Request) bool {
+	return isTrustedProxy(remoteIP(r))
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// ClientIP returns the IP of the client which sends the request. If the
+// request is sent from "--trusted-proxy", it's the last address in the
+// X-Forwarded-For header which is not a trusted proxy, the addresses before it
+// can be forged by the client.
+func ClientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if ip == nil {
+		return r.RemoteAddr
+	}
+	if !isTrustedProxy(ip) {
+		return ip.String()
+	}
+	var forwarded []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(value, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// WithUser returns a copy of ctx with the authenticated user.
+func WithUser(ctx context.Context, user *User) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// UserFrom returns the user of the request. It's the user set by WithUser, or
+// the user in "--user-header" and "--groups-header" set by the trusted
+// authenticating proxy, otherwise AnonymousUser. The headers are only honored
+// if the request is sent from "--trusted-proxy", and the proxy must remove
+// them from the requests of the clients.
+func UserFrom(r *http.Request) *User {
+	if user, ok := r.Context().Value(userKey{}).(*User); ok {
+		return user
+	}
+	var name string
+	if header := args.GetUserHeader(); len(header) != 0 && fromTrustedProxy(r) {
+		name = strings.TrimSpace(r.Header.Get(header))
+	}
+	if len(name) == 0 {
+		return &User{Name: AnonymousUser, Groups: []string{UnauthenticatedGroup}}
+	}
+	user := &User{Name: name, Groups: []string{AuthenticatedGroup}}
+	if header := args.GetGroupsHeader(); len(header) != 0 {
+		for _, value := range r.Header.Values(header) {
+			for _, group := range strings.Split(value, ",") {
+				if group = strings.TrimSpace(group); len(group) != 0 {
+					user.Groups = append(user.Groups, group)
+				}
+			}
+		}
+	}
+	return user
+}
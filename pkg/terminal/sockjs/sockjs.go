@@ -62,7 +62,7 @@ func HandleExecShell(ctx *gin.Context) {
 	log.Info("Function: HandleExecShell")
 	sessionID, err := GenTerminalSessionID()
 	if err != nil {
-		log.Errorf("session.GenTerminalSessionID error: ", err)
+		log.Error("session.GenTerminalSessionID error: ", err)
 		errors.ResponseError(ctx, errors.CodeInternalError)
 	}
 
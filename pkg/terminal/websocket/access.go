@@ -0,0 +1,103 @@
+package websocket
+
+import (
+	"net/http"
+
+	"github.com/forbearing/ratel-webterminal/pkg/errors"
+	"github.com/forbearing/ratel-webterminal/pkg/policy"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// deniedCodes are the error codes of the policy denials, so the frontend can
+// explain which part of the request is denied.
+var deniedCodes = map[policy.Level]errors.ResponseCode{
+	policy.LevelAction:    errors.CodeActionDenied,
+	policy.LevelNamespace: errors.CodeNamespaceDenied,
+	policy.LevelPod:       errors.CodePodDenied,
+	policy.LevelContainer: errors.CodeContainerDenied,
+	policy.LevelNode:      errors.CodeNodeDenied,
+}
+
+// HandleAccess handle "GET /api/v1/{namespace}/{pod}/access" requests.
+//
+// It checks the access policy of the query parameters "action" and
+// "container" without doing anything, so the frontend can explain why the
+// websocket can't be opened, the browser doesn't expose the response of the
+// failed websocket handshake.
+func HandleAccess(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	namespace := pathParams["namespace"]
+	podName := pathParams["pod"]
+	query := r.URL.Query()
+	action := policy.Action(query.Get("action"))
+	switch action {
+	case policy.ActionExec, policy.ActionLogs, policy.ActionFiles:
+	default:
+		errors.WriteErrorWithMsg(w, http.StatusBadRequest, errors.CodeInvalidParam, "invalid action, must be one of 'exec', 'logs' or 'files'")
+		return
+	}
+	if !checkAccess(w, r, action, namespace, podName, query.Get("container")) {
+		return
+	}
+	errors.WriteSuccess(w, map[string]interface{}{"user": policy.UserFrom(r).Name})
+}
+
+// checkNamespaceAccess checks the access policy before the pod is got, so the
+// requests to the denied namespaces don't reach the pod lister or apiserver.
+// If denied, the error is written to w.
+func checkNamespaceAccess(w http.ResponseWriter, r *http.Request, action policy.Action, namespace string) bool {
+	user := policy.UserFrom(r)
+	if err := policy.CheckNamespace(user, action, namespace); err != nil {
+		writeDenied(w, user, err)
+		return false
+	}
+	return true
+}
+
+// checkPodAccess checks the access policy of the container in the pod,
+// containerName is empty if the action is on the whole pod. If denied, the
+// error is written to w.
+func checkPodAccess(w http.ResponseWriter, r *http.Request, action policy.Action, podObj *corev1.Pod, containerName string) bool {
+	user := policy.UserFrom(r)
+	if err := policy.Check(user, action, podObj, containerName); err != nil {
+		writeDenied(w, user, err)
+		return false
+	}
+	return true
+}
+
+// checkAccess is the same as checkNamespaceAccess and checkPodAccess, for the
+// handlers which don't get the pod themselves. The pod is only got if the
+// policy is enabled.
+func checkAccess(w http.ResponseWriter, r *http.Request, action policy.Action, namespace, podName, containerName string) bool {
+	if !policy.Enabled() {
+		return true
+	}
+	if !checkNamespaceAccess(w, r, action, namespace) {
+		return false
+	}
+	podHandler, err := newPodHandler(r, namespace)
+	if err != nil {
+		log.Error("get pod handler error: ", err)
+		errors.WriteError(w, http.StatusInternalServerError, errors.CodeInternalError)
+		return false
+	}
+	podObj, err := getPod(podHandler, namespace, podName)
+	if err != nil {
+		log.Error("get pod error: ", err)
+		errors.WriteErrorWithMsg(w, http.StatusNotFound, errors.CodePodNotFound, err.Error())
+		return false
+	}
+	return checkPodAccess(w, r, action, podObj, containerName)
+}
+
+func writeDenied(w http.ResponseWriter, user *policy.User, err error) {
+	log.Warnf("access denied: user: %s, groups: %v: %s", user.Name, user.Groups, err.Error())
+	code := errors.CodeActionDenied
+	if denied, ok := err.(*policy.DeniedError); ok {
+		code = deniedCodes[denied.Level]
+	}
+	errors.WriteErrorWithMsg(w, http.StatusForbidden, code, err.Error())
+}
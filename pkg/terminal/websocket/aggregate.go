@@ -0,0 +1,258 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/forbearing/k8s/pod"
+	"github.com/forbearing/ratel-webterminal/pkg/controller"
+	"github.com/forbearing/ratel-webterminal/pkg/errors"
+	"github.com/forbearing/ratel-webterminal/pkg/policy"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// HandleWsAggregateLogs handle "/ws/{namespace}/logs/aggregate" connections.
+//
+// It follows every container of a pod, or every pod matching a label selector
+// or a workload reference, merging lines into one websocket stream with the
+// "pod container" source of every line, similar to stern.
+// The pods are selected by query parameters "pod", "selector" and "container".
+// pod is a pod name or a workload reference like "deployment/api", selector is
+// used when pod is not set, and only the container named container is followed
+// if it's set. The log options are the same as HandleWsLogs.
+// New pods that appear in the pod informer are picked up automatically, and
+// the terminated pods are dropped.
+func HandleWsAggregateLogs(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+	query := r.URL.Query()
+	podName := query.Get("pod")
+	selector := query.Get("selector")
+	containerName := query.Get("container")
+	if !checkNamespaceAccess(w, r, policy.ActionLogs, namespace) {
+		return
+	}
+
+	var match func(*corev1.Pod) bool
+	if len(podName) != 0 && !strings.Contains(podName, "/") {
+		match = func(p *corev1.Pod) bool { return p.Name == podName }
+	} else {
+		if len(podName) == 0 && len(selector) == 0 {
+			errors.WriteErrorWithMsg(w, http.StatusBadRequest, errors.CodePodNotSet, "neither pod nor label selector is set")
+			return
+		}
+		sel, err := controller.PodSelector(namespace, podName, selector)
+		if err != nil {
+			log.Error("get pod selector error: ", err)
+			errors.WriteErrorWithMsg(w, http.StatusBadRequest, errors.CodeInvalidParam, err.Error())
+			return
+		}
+		match = func(p *corev1.Pod) bool { return sel.Matches(labels.Set(p.Labels)) }
+	}
+	logOptions, code, err := parseLogOptions(query)
+	if err != nil {
+		log.Error("parse log options error: ", err)
+		errors.WriteErrorWithMsg(w, http.StatusBadRequest, code, err.Error())
+		return
+	}
+	filter, code, err := parseLogFilter(r.URL.Query())
+	if err != nil {
+		log.Error("parse log filter error: ", err)
+		errors.WriteErrorWithMsg(w, http.StatusBadRequest, code, err.Error())
+		return
+	}
+	release, ok := acquireLogs(w, r, logOptions.Follow)
+	if !ok {
+		return
+	}
+	defer release()
+	log.Infof("aggregate pod logs: namespace: %s, pod: %s, selector: %s, container: %s", namespace, podName, selector, containerName)
+
+	podHandler, err := newPodHandler(r, namespace)
+	if err != nil {
+		log.Error("get pod handler error: ", err)
+		errors.WriteError(w, http.StatusInternalServerError, errors.CodeInternalError)
+		return
+	}
+	writer, err := NewLogger(w, r, nil)
+	if err != nil {
+		log.Error("websocket.NewLogger error: ", err)
+		return
+	}
+	defer func() {
+		log.Println("close aggregate logs session.")
+		writer.Close()
+	}()
+	writer.SetFilter(filter)
+	writer.SetTimestamps(logOptions.Timestamps)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-writer.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	aggregator := &logAggregator{
+		ctx:        ctx,
+		cancel:     cancel,
+		podHandler: podHandler,
+		namespace:  namespace,
+		container:  containerName,
+		match:      match,
+		user:       policy.UserFrom(r),
+		logOptions: logOptions,
+		writer:     writer,
+		streams:    make(map[string]*logStream),
+	}
+	aggregator.run()
+}
+
+// logAggregator follows the logs of all matched containers and writes them
+// to one Logger.
+type logAggregator struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	podHandler *pod.Handler
+	namespace  string
+	container  string
+	match      func(*corev1.Pod) bool
+	// user is who follows the logs, the containers denied by the policy are
+	// skipped.
+	user       *policy.User
+	logOptions corev1.PodLogOptions
+	writer     *Logger
+
+	// streams stores the log streams, the key is "pod/container".
+	streams map[string]*logStream
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+}
+
+// logStream is the log stream of one container.
+type logStream struct {
+	restartCount int32
+	active       bool
+	cancel       context.CancelFunc
+}
+
+// run reconciles the log streams whenever the pods in namespace changed, until
+// the websocket closed.
+// If follow is false, it streams the logs of the current containers once.
+func (a *logAggregator) run() {
+	if !a.logOptions.Follow {
+		a.reconcile()
+		a.wg.Wait()
+		return
+	}
+
+	notifyCh, stop := controller.WatchPods(a.namespace)
+	defer stop()
+	a.reconcile()
+	for {
+		select {
+		case <-notifyCh:
+			a.reconcile()
+		case <-a.ctx.Done():
+			a.wg.Wait()
+			return
+		}
+	}
+}
+
+// reconcile starts the log streams for the new running containers and stops
+// the log streams of the pods no longer exist.
+func (a *logAggregator) reconcile() {
+	pods, err := controller.ListPods(a.namespace, labels.Everything())
+	if err != nil {
+		log.Error("list pods error: ", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	exists := make(map[string]bool)
+	for _, p := range pods {
+		if p.DeletionTimestamp != nil || !a.match(p) {
+			continue
+		}
+		for _, status := range p.Status.ContainerStatuses {
+			if len(a.container) != 0 && status.Name != a.container {
+				continue
+			}
+			if policy.Check(a.user, policy.ActionLogs, p, status.Name) != nil {
+				continue
+			}
+			key := p.Name + "/" + status.Name
+			exists[key] = true
+			if status.State.Running == nil {
+				continue
+			}
+			// the stream is still active, or the stream of this container
+			// instance has already ended.
+			stream, ok := a.streams[key]
+			if ok && (stream.active || stream.restartCount == status.RestartCount) {
+				continue
+			}
+			a.start(p, status.Name, status.RestartCount)
+		}
+	}
+
+	for key, stream := range a.streams {
+		if exists[key] {
+			continue
+		}
+		if stream.active {
+			stream.cancel()
+		}
+		delete(a.streams, key)
+	}
+}
+
+// start starts following the logs of the container in a new goroutine, the
+// logs are redacted with the Secret values of the container before merged.
+// The caller must hold a.mu.
+func (a *logAggregator) start(podObj *corev1.Pod, containerName string, restartCount int32) {
+	podName := podObj.Name
+	key := podName + "/" + containerName
+	ctx, cancel := context.WithCancel(a.ctx)
+	stream := &logStream{restartCount: restartCount, active: true, cancel: cancel}
+	a.streams[key] = stream
+
+	logOptions := a.logOptions.DeepCopy()
+	logOptions.Container = containerName
+	source := podName + " " + containerName
+	writer := newLineWriter(func(line []byte) error {
+		return a.writer.WriteLine(LogLine{Source: source, Data: string(line)})
+	})
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer cancel()
+		a.writer.WriteLine(LogLine{Source: "+ " + source})
+		rw := newContainerRedactWriter(writer, podObj, containerName)
+		if err := streamLogs(ctx, a.podHandler, a.namespace, podName, logOptions, rw); err != nil && ctx.Err() == nil {
+			log.Errorf("stream logs of %s/%s error: %s", a.namespace, key, err.Error())
+		}
+		rw.Flush()
+		writer.Flush()
+		if err := a.writer.WriteLine(LogLine{Source: "- " + source}); err != nil {
+			// the websocket is broken, stop all streams.
+			a.cancel()
+		}
+
+		a.mu.Lock()
+		stream.active = false
+		a.mu.Unlock()
+	}()
+}
@@ -0,0 +1,138 @@
+package websocket
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/forbearing/k8s/pod"
+	"github.com/forbearing/ratel-webterminal/pkg/controller"
+	"github.com/forbearing/ratel-webterminal/pkg/policy"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// HandleWsAttach handle "/ws/{namespace}/{pod}/{container}/attach" connections.
+//
+// Unlike HandleWsTerminal, it doesn't start a new shell process in the container,
+// it attaches the TerminalSession to the container's main process (PID 1), just
+// like "kubectl attach -it". Whether stdin and tty are attached is detected from
+// the container spec, a container without "stdin: true" can only be watched.
+func HandleWsAttach(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	namespace := pathParams["namespace"]
+	podName := pathParams["pod"]
+	containerName := pathParams["container"]
+	log.Infof("attach pod: %s/%s, container: %s", namespace, podName, containerName)
+
+	if !checkNamespaceAccess(w, r, policy.ActionExec, namespace) {
+		return
+	}
+	podHandler, err := newPodHandler(r, namespace)
+	if err != nil {
+		log.Error("get pod handler error: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	podObj, err := getPod(podHandler, namespace, podName)
+	if err != nil {
+		log.Error("get pod error: ", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	container, err := getContainer(podObj, containerName)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !checkPodAccess(w, r, policy.ActionExec, podObj, container.Name) {
+		return
+	}
+	release, ok := acquireShell(w, r, podObj.Namespace+"/"+podObj.Name)
+	if !ok {
+		return
+	}
+	defer release()
+
+	terminalSession, err := NewTerminalSession(w, r, nil)
+	if err != nil {
+		log.Error("create terminal session error: ", err)
+		return
+	}
+	defer func() {
+		log.Info("close attach session")
+		terminalSession.Close()
+	}()
+	terminalSession.redactSecrets(podObj, container.Name)
+
+	if err := attachContainer(podHandler, podObj.Namespace, podObj.Name, container.Name, container.Stdin, container.TTY, terminalSession); err != nil {
+		log.Error("attach pod error: ", err)
+	}
+}
+
+// attachContainer attaches the PtyHandler to the main process of the container
+// by "pods/attach" subresource and reuse the PtyHandler as the terminal size queue.
+// stdin and tty should be the same as the container spec.
+func attachContainer(podHandler *pod.Handler, namespace, podName, containerName string, stdin, tty bool, pty PtyHandler) error {
+	req := podHandler.RESTClient().Post().
+		Namespace(namespace).
+		Resource("pods").
+		Name(podName).
+		SubResource("attach").
+		VersionedParams(&corev1.PodAttachOptions{
+			Container: containerName,
+			Stdin:     stdin,
+			Stdout:    true,
+			// with a tty, stderr is merged into stdout by the container runtime.
+			Stderr: !tty,
+			TTY:    tty,
+		}, scheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(podHandler.RESTConfig(), "POST", req.URL())
+	if err != nil {
+		return err
+	}
+
+	streamOptions := remotecommand.StreamOptions{
+		Stdout: pty,
+		Tty:    tty,
+	}
+	if stdin {
+		streamOptions.Stdin = pty
+	}
+	if tty {
+		streamOptions.TerminalSizeQueue = pty
+	} else {
+		streamOptions.Stderr = pty
+	}
+	return executor.Stream(streamOptions)
+}
+
+// getPod get the pod from the pod lister first, if the pod is not found in the
+// pod lister, get it by calling apiserver API directly.
+func getPod(podHandler *pod.Handler, namespace, name string) (*corev1.Pod, error) {
+	podObj, err := controller.GetPod(namespace, name)
+	if err == nil {
+		return podObj, nil
+	}
+	log.Warn(err)
+	return podHandler.Get(name)
+}
+
+// getContainer returns the container with the given name in the pod, the
+// default container is returned if the name is empty, see
+// controller.DefaultContainer.
+func getContainer(podObj *corev1.Pod, containerName string) (*corev1.Container, error) {
+	if len(containerName) == 0 {
+		containerName = controller.DefaultContainer(podObj)
+	}
+	for i := range podObj.Spec.Containers {
+		if podObj.Spec.Containers[i].Name == containerName {
+			return &podObj.Spec.Containers[i], nil
+		}
+	}
+	return nil, fmt.Errorf("container '%s' not found in pod '%s/%s'", containerName, podObj.Namespace, podObj.Name)
+}
@@ -0,0 +1,150 @@
+package websocket
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/forbearing/k8s/pod"
+	"github.com/forbearing/ratel-webterminal/pkg/args"
+	"github.com/forbearing/ratel-webterminal/pkg/janitor"
+	"github.com/forbearing/ratel-webterminal/pkg/policy"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+)
+
+// HandleWsCopy handle "/ws/{namespace}/{pod}/{container}/copy" connections.
+//
+// For pods in CrashLoopBackOff there's nothing to exec into. HandleWsCopy clones
+// the pod with the container's command overridden to "sleep", probes stripped and
+// labels changed so Services don't route to it, then opens a shell in the copy,
+// just like "kubectl debug --copy-to". The copy will be deleted after the session
+// ends, if ratel-webterminal crashed before that, it will be deleted by the janitor.
+// Copy mode is disabled by default, it must be enabled by "--enable-copy".
+func HandleWsCopy(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	namespace := pathParams["namespace"]
+	podName := pathParams["pod"]
+	containerName := pathParams["container"]
+	if !args.GetEnableCopy() {
+		log.Warnf("copy mode is disabled, reject pod: %s/%s", namespace, podName)
+		http.Error(w, "copy mode is disabled", http.StatusForbidden)
+		return
+	}
+	log.Infof("copy pod: %s/%s, container: %s", namespace, podName, containerName)
+
+	if !checkNamespaceAccess(w, r, policy.ActionExec, namespace) {
+		return
+	}
+	podHandler, err := newPodHandler(r, namespace)
+	if err != nil {
+		log.Error("get pod handler error: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	podObj, err := getPod(podHandler, namespace, podName)
+	if err != nil {
+		log.Error("get pod error: ", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	container, err := getContainer(podObj, containerName)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !checkPodAccess(w, r, policy.ActionExec, podObj, container.Name) {
+		return
+	}
+	release, ok := acquireShell(w, r, podObj.Namespace+"/"+podObj.Name)
+	if !ok {
+		return
+	}
+	defer release()
+
+	terminalSession, err := NewTerminalSession(w, r, nil)
+	if err != nil {
+		log.Error("create terminal session error: ", err)
+		return
+	}
+	defer func() {
+		log.Info("close copy session")
+		terminalSession.Close()
+	}()
+	// the copy has the same environment variables as the pod.
+	terminalSession.redactSecrets(podObj, container.Name)
+
+	podCopy := newPodCopy(podObj, container.Name)
+	janitor.Track(podCopy.Namespace, podCopy.Name)
+	defer janitor.Release(podCopy.Namespace, podCopy.Name)
+
+	terminalSession.Write([]byte(fmt.Sprintf("creating copy of pod %s: %s...\r\n", podObj.Name, podCopy.Name)))
+	if _, err = podHandler.Create(podCopy); err != nil {
+		log.Error("create pod copy error: ", err)
+		terminalSession.Write([]byte(fmt.Sprintf("create pod copy error: %s\r\n", err.Error())))
+		return
+	}
+	if err = waitForPodRunning(r.Context(), podHandler, podCopy.Namespace, podCopy.Name); err != nil {
+		log.Error("wait for pod copy error: ", err)
+		terminalSession.Write([]byte(fmt.Sprintf("wait for pod copy error: %s\r\n", err.Error())))
+		return
+	}
+
+	if err = executeShell(podHandler, podCopy.Name, container.Name, terminalSession); err != nil {
+		log.Error("create pod shell error: ", err)
+	}
+}
+
+// newPodCopy returns a copy of the pod which can be used to debug the container.
+// The copy:
+// 1. has only the labels of managed pods, so Services and controllers don't select it.
+// 2. has no probes, so it won't be restarted or marked unready.
+// 3. runs "sleep" instead of the command of the debugged container.
+func newPodCopy(podObj *corev1.Pod, containerName string) *corev1.Pod {
+	// pod name is used as the hostname, it must be no more than 63 characters.
+	name, suffix := podObj.Name, fmt.Sprintf("-debug-%s", utilrand.String(5))
+	if len(name)+len(suffix) > 63 {
+		name = strings.TrimRight(name[:63-len(suffix)], "-.")
+	}
+	name += suffix
+	gracePeriod := int64(0)
+
+	podCopy := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       podObj.Namespace,
+			Labels:          janitor.Labels(),
+			Annotations:     podObj.Annotations,
+			OwnerReferences: janitor.OwnerReferences(podObj.Namespace),
+		},
+		Spec: *podObj.Spec.DeepCopy(),
+	}
+	podCopy.Spec.NodeName = ""
+	podCopy.Spec.EphemeralContainers = nil
+	podCopy.Spec.RestartPolicy = corev1.RestartPolicyNever
+	podCopy.Spec.TerminationGracePeriodSeconds = &gracePeriod
+	for i := range podCopy.Spec.Containers {
+		c := &podCopy.Spec.Containers[i]
+		c.LivenessProbe = nil
+		c.ReadinessProbe = nil
+		c.StartupProbe = nil
+		if c.Name == containerName {
+			c.Command = []string{"sleep", "2147483647"}
+			c.Args = nil
+		}
+	}
+	return podCopy
+}
+
+// executeShell executes "bash" in the container, and fallback to "sh" if "bash"
+// doesn't exist.
+func executeShell(podHandler *pod.Handler, podName, containerName string, pty PtyHandler) error {
+	if err := podHandler.ExecuteWithPty(podName, containerName, []string{"bash"}, pty); err != nil {
+		return podHandler.ExecuteWithPty(podName, containerName, []string{"sh"}, pty)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/forbearing/k8s/pod"
+	"github.com/forbearing/ratel-webterminal/pkg/args"
+	"github.com/forbearing/ratel-webterminal/pkg/errors"
+	"github.com/forbearing/ratel-webterminal/pkg/policy"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// debugContainerTimeout is the max duration to wait for the ephemeral debug
+// container running, pulling the debug image may take a while.
+const debugContainerTimeout = 2 * time.Minute
+
+// HandleWsDebug handle "/ws/{namespace}/{pod}/{container}/debug" connections.
+//
+// Many images are distroless, there is no "bash" or "sh" in the container to exec.
+// HandleWsDebug adds an ephemeral container into the pod by "pods/ephemeralcontainers"
+// subresource, the ephemeral container targets the process namespace of the
+// selected container, then it attaches the TerminalSession to the ephemeral container,
+// just like "kubectl debug -it --target".
+// The debug image defaults to "--debug-image" and can be overridden by the "image"
+// query parameter, the image must be allowed by "--allowed-debug-image" since the
+// debug container shares the process namespace of the target.
+//
+// Ephemeral containers can't be removed from the pod, the debug container stop
+// after the user exits the shell.
+func HandleWsDebug(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	namespace := pathParams["namespace"]
+	podName := pathParams["pod"]
+	containerName := pathParams["container"]
+	image := r.URL.Query().Get("image")
+	if len(image) == 0 {
+		image = args.GetDebugImage()
+	}
+	log.Infof("debug pod: %s/%s, container: %s, image: %s", namespace, podName, containerName, image)
+	if !debugImageAllowed(image) {
+		log.Warnf("reject debug image %s of user %s", image, policy.UserFrom(r).Name)
+		errors.WriteError(w, http.StatusForbidden, errors.CodeDebugImageDenied)
+		return
+	}
+
+	if !checkNamespaceAccess(w, r, policy.ActionExec, namespace) {
+		return
+	}
+	podHandler, err := newPodHandler(r, namespace)
+	if err != nil {
+		log.Error("get pod handler error: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	podObj, err := getPod(podHandler, namespace, podName)
+	if err != nil {
+		log.Error("get pod error: ", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	container, err := getContainer(podObj, containerName)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !checkPodAccess(w, r, policy.ActionExec, podObj, container.Name) {
+		return
+	}
+	release, ok := acquireShell(w, r, podObj.Namespace+"/"+podObj.Name)
+	if !ok {
+		return
+	}
+	defer release()
+
+	terminalSession, err := NewTerminalSession(w, r, nil)
+	if err != nil {
+		log.Error("create terminal session error: ", err)
+		return
+	}
+	defer func() {
+		log.Info("close debug session")
+		terminalSession.Close()
+	}()
+	terminalSession.redactSecrets(podObj, container.Name)
+
+	terminalSession.Write([]byte(fmt.Sprintf("creating debug container with image %s...\r\n", image)))
+	debugContainer, err := createDebugContainer(podHandler, podObj, container.Name, image)
+	if err != nil {
+		log.Error("create debug container error: ", err)
+		terminalSession.Write([]byte(fmt.Sprintf("create debug container error: %s\r\n", err.Error())))
+		return
+	}
+	terminalSession.Write([]byte(fmt.Sprintf("waiting for debug container %s running...\r\n", debugContainer.Name)))
+	if err = waitForEphemeralContainer(r.Context(), podHandler, podObj.Namespace, podObj.Name, debugContainer.Name); err != nil {
+		log.Error("wait for debug container error: ", err)
+		terminalSession.Write([]byte(fmt.Sprintf("wait for debug container error: %s\r\n", err.Error())))
+		return
+	}
+
+	if err = attachContainer(podHandler, podObj.Namespace, podObj.Name, debugContainer.Name, true, true, terminalSession); err != nil {
+		log.Error("attach debug container error: ", err)
+	}
+}
+
+// debugImageAllowed returns whether the image is "--debug-image" or matches one
+// of "--allowed-debug-image".
+func debugImageAllowed(image string) bool {
+	if image == args.GetDebugImage() {
+		return true
+	}
+	for _, pattern := range args.GetAllowedDebugImages() {
+		if matched, _ := path.Match(pattern, image); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// createDebugContainer adds an ephemeral container which shares the process
+// namespace with target container into the pod.
+func createDebugContainer(podHandler *pod.Handler, podObj *corev1.Pod, target, image string) (*corev1.EphemeralContainer, error) {
+	debugContainer := corev1.EphemeralContainer{
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+			Name:                     fmt.Sprintf("debugger-%s", utilrand.String(5)),
+			Image:                    image,
+			ImagePullPolicy:          corev1.PullIfNotPresent,
+			Stdin:                    true,
+			TTY:                      true,
+			TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+		},
+		TargetContainerName: target,
+	}
+
+	podCopy := podObj.DeepCopy()
+	podCopy.Spec.EphemeralContainers = append(podCopy.Spec.EphemeralContainers, debugContainer)
+	_, err := podHandler.Clientset().CoreV1().Pods(podObj.Namespace).
+		UpdateEphemeralContainers(context.TODO(), podObj.Name, podCopy, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &debugContainer, nil
+}
+
+// waitForEphemeralContainer waits until the ephemeral container is running.
+// It returns error if the ephemeral container terminated or timeout.
+func waitForEphemeralContainer(ctx context.Context, podHandler *pod.Handler, namespace, podName, containerName string) error {
+	return wait.PollImmediateWithContext(ctx, time.Second, debugContainerTimeout, func(ctx context.Context) (bool, error) {
+		podObj, err := podHandler.Clientset().CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		for _, status := range podObj.Status.EphemeralContainerStatuses {
+			if status.Name != containerName {
+				continue
+			}
+			if status.State.Running != nil {
+				return true, nil
+			}
+			if terminated := status.State.Terminated; terminated != nil {
+				return false, fmt.Errorf("debug container %s terminated: %s", containerName, terminated.Reason)
+			}
+			if waiting := status.State.Waiting; waiting != nil && len(waiting.Message) != 0 {
+				log.Debugf("debug container %s waiting: %s", containerName, waiting.Message)
+			}
+		}
+		return false, nil
+	})
+}
@@ -0,0 +1,253 @@
+package websocket
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/forbearing/k8s/pod"
+	"github.com/forbearing/ratel-webterminal/pkg/args"
+	"github.com/forbearing/ratel-webterminal/pkg/errors"
+	"github.com/forbearing/ratel-webterminal/pkg/policy"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// HandleLogsDownload handle "/api/v1/{namespace}/{pod}/{container}/logs/download" requests.
+//
+// It downloads the logs of the container as an attachment, the log options are
+// the same as HandleWsLogs, except that the logs are never followed.
+//
+// PARAMETER  DESCRIPTION
+// ---------------------------------------------------------------------
+// format     "text" (default) or "gzip", the compression of the download
+// archive    "zip" or "tar", download the logs of all containers as an archive
+//
+// The archive contains one "<container>.log" file for every container of the
+// pod, the container in path is ignored, and the tar archive is compressed if
+// format is gzip. The zip archive is always compressed, so format gzip is
+// rejected with it. The logs of every container in the tar archive are limited
+// to "--max-file-size", since they are buffered on the disk.
+func HandleLogsDownload(w http.ResponseWriter, r *http.Request) {
+	if !allowRequest(w, r) {
+		return
+	}
+	pathParams := mux.Vars(r)
+	namespace := pathParams["namespace"]
+	podName := pathParams["pod"]
+	containerName := pathParams["container"]
+	query := r.URL.Query()
+
+	logOptions, code, err := parseLogOptions(query)
+	if err != nil {
+		log.Error("parse log options error: ", err)
+		errors.WriteErrorWithMsg(w, http.StatusBadRequest, code, err.Error())
+		return
+	}
+	// the download must end.
+	logOptions.Follow = false
+
+	format := query.Get("format")
+	switch format {
+	case "":
+		format = "text"
+	case "text", "gzip":
+	default:
+		errors.WriteError(w, http.StatusBadRequest, errors.CodeInvalidLogFormat)
+		return
+	}
+	archive := query.Get("archive")
+	if len(archive) != 0 && archive != "zip" && archive != "tar" {
+		errors.WriteError(w, http.StatusBadRequest, errors.CodeInvalidLogArchive)
+		return
+	}
+	if archive == "zip" && format == "gzip" {
+		errors.WriteErrorWithMsg(w, http.StatusBadRequest, errors.CodeInvalidParam, "format gzip can't be used with archive zip, the zip archive is already compressed")
+		return
+	}
+	log.Infof("download pod logs: namespace: %s, pod: %s, container: %s, format: %s, archive: %s", namespace, podName, containerName, format, archive)
+
+	if !checkNamespaceAccess(w, r, policy.ActionLogs, namespace) {
+		return
+	}
+	podHandler, err := newPodHandler(r, namespace)
+	if err != nil {
+		log.Error("get pod handler error: ", err)
+		errors.WriteError(w, http.StatusInternalServerError, errors.CodeInternalError)
+		return
+	}
+	podObj, err := getPod(podHandler, namespace, podName)
+	if err != nil {
+		log.Error("get pod error: ", err)
+		errors.WriteErrorWithMsg(w, http.StatusNotFound, errors.CodePodNotFound, err.Error())
+		return
+	}
+	// the archive contains the logs of all containers.
+	accessContainer := containerName
+	if len(archive) != 0 {
+		accessContainer = ""
+	}
+	if !checkPodAccess(w, r, policy.ActionLogs, podObj, accessContainer) {
+		return
+	}
+
+	ctx := r.Context()
+	switch archive {
+	case "zip":
+		w.Header().Set("Content-Type", "application/zip")
+		setAttachment(w, podObj.Name+".zip")
+		err = writeLogsZip(ctx, podHandler, podObj, &logOptions, w)
+	case "tar":
+		name := podObj.Name + ".tar"
+		var writer io.Writer = w
+		if format == "gzip" {
+			name += ".gz"
+			w.Header().Set("Content-Type", "application/gzip")
+			gw := gzip.NewWriter(w)
+			defer gw.Close()
+			writer = gw
+		} else {
+			w.Header().Set("Content-Type", "application/x-tar")
+		}
+		setAttachment(w, name)
+		err = writeLogsTar(ctx, podHandler, podObj, &logOptions, writer)
+	default:
+		if _, err := getContainer(podObj, containerName); err != nil {
+			errors.WriteErrorWithMsg(w, http.StatusNotFound, errors.CodeContainerNotFound, err.Error())
+			return
+		}
+		logOptions.Container = containerName
+		name := podObj.Name + "-" + containerName + ".log"
+		var writer io.Writer = w
+		if format == "gzip" {
+			name += ".gz"
+			w.Header().Set("Content-Type", "application/gzip")
+			gw := gzip.NewWriter(w)
+			defer gw.Close()
+			writer = gw
+		} else {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		setAttachment(w, name)
+		rw := newContainerRedactWriter(writer, podObj, containerName)
+		if err = streamLogs(ctx, podHandler, namespace, podObj.Name, &logOptions, rw); err == nil {
+			err = rw.Flush()
+		}
+	}
+	// the response has been started, the error can only be logged.
+	if err != nil && ctx.Err() == nil {
+		log.Errorf("download logs of %s/%s error: %s", namespace, podObj.Name, err.Error())
+	}
+}
+
+// setAttachment sets the Content-Disposition header to download the response
+// as a file.
+func setAttachment(w http.ResponseWriter, filename string) {
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+}
+
+// podContainers returns the names of init containers and containers of the pod.
+func podContainers(podObj *corev1.Pod) []string {
+	var names []string
+	for _, c := range podObj.Spec.InitContainers {
+		names = append(names, c.Name)
+	}
+	for _, c := range podObj.Spec.Containers {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+// writeLogsZip writes the logs of all containers of the pod to a zip archive.
+// The containers whose logs can't be read, such as the init containers not
+// started yet, are skipped.
+func writeLogsZip(ctx context.Context, podHandler *pod.Handler, podObj *corev1.Pod, logOptions *corev1.PodLogOptions, w io.Writer) error {
+	zw := zip.NewWriter(w)
+	for _, name := range podContainers(podObj) {
+		options := logOptions.DeepCopy()
+		options.Container = name
+		readCloser, err := podHandler.Clientset().CoreV1().Pods(podObj.Namespace).GetLogs(podObj.Name, options).Stream(ctx)
+		if err != nil {
+			log.Warnf("skip logs of %s/%s/%s: %s", podObj.Namespace, podObj.Name, name, err.Error())
+			continue
+		}
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: name + ".log", Method: zip.Deflate, Modified: time.Now()})
+		if err == nil {
+			rw := newContainerRedactWriter(fw, podObj, name)
+			if _, err = io.Copy(rw, readCloser); err == nil {
+				err = rw.Flush()
+			}
+		}
+		readCloser.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// writeLogsTar writes the logs of all containers of the pod to a tar archive.
+// The size of every file must be known before writing it to the tar archive,
+// so the logs are buffered in a temporary file first.
+func writeLogsTar(ctx context.Context, podHandler *pod.Handler, podObj *corev1.Pod, logOptions *corev1.PodLogOptions, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for _, name := range podContainers(podObj) {
+		options := logOptions.DeepCopy()
+		options.Container = name
+		if err := writeTarLog(ctx, podHandler, podObj, options, tw); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			log.Warnf("skip logs of %s/%s/%s: %s", podObj.Namespace, podObj.Name, name, err.Error())
+		}
+	}
+	return tw.Close()
+}
+
+// writeTarLog writes the logs of one container as "<container>.log" to the
+// tar archive. The logs are limited to "--max-file-size", so the temporary
+// file can't fill the disk.
+func writeTarLog(ctx context.Context, podHandler *pod.Handler, podObj *corev1.Pod, logOptions *corev1.PodLogOptions, tw *tar.Writer) error {
+	if maxSize := args.GetMaxFileSize(); maxSize > 0 && (logOptions.LimitBytes == nil || *logOptions.LimitBytes > maxSize) {
+		logOptions.LimitBytes = &maxSize
+	}
+	file, err := os.CreateTemp("", "ratel-webterminal-logs-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	// the logs are redacted before written to the disk.
+	rw := newContainerRedactWriter(file, podObj, logOptions.Container)
+	if err = streamLogs(ctx, podHandler, podObj.Namespace, podObj.Name, logOptions, rw); err != nil {
+		return err
+	}
+	if err = rw.Flush(); err != nil {
+		return err
+	}
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err = tw.WriteHeader(&tar.Header{
+		Name:    logOptions.Container + ".log",
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
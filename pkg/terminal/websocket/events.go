@@ -0,0 +1,130 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/forbearing/ratel-webterminal/pkg/controller"
+	"github.com/forbearing/ratel-webterminal/pkg/errors"
+	"github.com/forbearing/ratel-webterminal/pkg/policy"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/duration"
+)
+
+// eventFormat is the format of the event lines, the columns are the same as
+// "kubectl get events -w".
+const eventFormat = "%-20s %-8s %-24s %-48s %s"
+
+// HandleWsEvents handle "/ws/{namespace}/{pod}/events" connections.
+//
+// It streams the events of the pod and its owners, such as the ReplicaSet and
+// Deployment, by watching the events of the namespace, so OOMKilled, image pull errors and probe
+// failures can be shown next to the logs. The existing events are sent first.
+// Every event is sent as a LogLine formatted like "kubectl get events -w", and
+// the filter query parameters are the same as HandleWsLogs. The events are
+// always followed, so they are counted by "--max-log-followers".
+func HandleWsEvents(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	namespace := pathParams["namespace"]
+	podName := pathParams["pod"]
+
+	filter, code, err := parseLogFilter(r.URL.Query())
+	if err != nil {
+		log.Error("parse log filter error: ", err)
+		errors.WriteErrorWithMsg(w, http.StatusBadRequest, code, err.Error())
+		return
+	}
+	if !checkNamespaceAccess(w, r, policy.ActionLogs, namespace) {
+		return
+	}
+	podHandler, err := newPodHandler(r, namespace)
+	if err != nil {
+		log.Error("get pod handler error: ", err)
+		errors.WriteError(w, http.StatusInternalServerError, errors.CodeInternalError)
+		return
+	}
+	podObj, err := getPod(podHandler, namespace, podName)
+	if err != nil {
+		log.Error("get pod error: ", err)
+		errors.WriteErrorWithMsg(w, http.StatusNotFound, errors.CodePodNotFound, err.Error())
+		return
+	}
+	if !checkPodAccess(w, r, policy.ActionLogs, podObj, "") {
+		return
+	}
+	release, ok := acquireLogs(w, r, true)
+	if !ok {
+		return
+	}
+	defer release()
+	log.Infof("watch pod events: namespace: %s, pod: %s", namespace, podName)
+
+	objects := controller.EventObjects(podObj)
+	match := func(event *corev1.Event) bool {
+		return objects[event.InvolvedObject.Kind+"/"+event.InvolvedObject.Name]
+	}
+
+	writer, err := NewLogger(w, r, nil)
+	if err != nil {
+		log.Error("websocket.NewLogger error: ", err)
+		return
+	}
+	defer func() {
+		log.Println("close events session.")
+		writer.Close()
+	}()
+	writer.SetFilter(filter)
+
+	// the watch is stopped when the websocket closed.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	events, eventCh, err := controller.WatchEvents(ctx, namespace, match)
+	if err != nil {
+		log.Error("watch events error: ", err)
+		writer.WriteError("watch events error: " + err.Error())
+		return
+	}
+
+	write := func(event *corev1.Event) error {
+		return writer.WriteLine(LogLine{Data: formatEvent(event)})
+	}
+	if err := writer.WriteLine(LogLine{Data: fmt.Sprintf(eventFormat, "LAST SEEN", "TYPE", "REASON", "OBJECT", "MESSAGE")}); err != nil {
+		return
+	}
+	for _, event := range events {
+		if err := write(event); err != nil {
+			return
+		}
+	}
+	for {
+		select {
+		case event, ok := <-eventCh:
+			if !ok {
+				writer.WriteError("watch events closed")
+				return
+			}
+			if err := write(event); err != nil {
+				return
+			}
+		case <-writer.Done():
+			return
+		}
+	}
+}
+
+// formatEvent formats the event like "kubectl get events -w".
+func formatEvent(event *corev1.Event) string {
+	lastSeen := duration.HumanDuration(time.Since(controller.EventTime(event).Time))
+	if event.Count > 1 && !event.FirstTimestamp.IsZero() {
+		lastSeen = fmt.Sprintf("%s (x%d over %s)", lastSeen, event.Count,
+			duration.HumanDuration(time.Since(event.FirstTimestamp.Time)))
+	}
+	object := strings.ToLower(event.InvolvedObject.Kind) + "/" + event.InvolvedObject.Name
+	message := strings.TrimSpace(event.Message)
+	return fmt.Sprintf(eventFormat, lastSeen, event.Type, event.Reason, object, message)
+}
@@ -0,0 +1,334 @@
+package websocket
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/forbearing/k8s/pod"
+	"github.com/forbearing/ratel-webterminal/pkg/args"
+	"github.com/forbearing/ratel-webterminal/pkg/errors"
+	"github.com/forbearing/ratel-webterminal/pkg/policy"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// HandleFileDownload handle "GET /api/v1/{namespace}/{pod}/{container}/files" requests.
+//
+// It copies the file or directory at the query parameter "path" out of the
+// container, just like "kubectl cp", by streaming "tar cf -" executed in the
+// container, so "tar" must exist in the container. A regular file is
+// downloaded as it is, with the Content-Length set, and a directory is
+// downloaded as a tar archive. The progress is sent to the watcher of the query
+// parameter "transfer", see HandleWsTransfer.
+//
+// The download is aborted if it's larger than "--max-file-size".
+func HandleFileDownload(w http.ResponseWriter, r *http.Request) {
+	if !allowRequest(w, r) {
+		return
+	}
+	pathParams := mux.Vars(r)
+	namespace := pathParams["namespace"]
+	podName := pathParams["pod"]
+	containerName := pathParams["container"]
+	query := r.URL.Query()
+
+	filePath := query.Get("path")
+	dir, member, err := splitFilePath(filePath)
+	if err != nil {
+		errors.WriteErrorWithMsg(w, http.StatusBadRequest, errors.CodeInvalidFilePath, err.Error())
+		return
+	}
+	podHandler, podObj, container, ok := getFileContainer(w, r, namespace, podName, containerName)
+	if !ok {
+		return
+	}
+	log.Infof("download file: namespace: %s, pod: %s, container: %s, path: %s", namespace, podObj.Name, container.Name, filePath)
+	progress := newTransferProgress(r, query.Get("transfer"), transferTarget(namespace, podName, containerName), filePath, 0)
+	maxSize := args.GetMaxFileSize()
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	stderr := new(bytes.Buffer)
+	errCh := make(chan error, 1)
+	go func() {
+		err := execStream(podHandler, namespace, podObj.Name, container.Name,
+			[]string{"tar", "cf", "-", "-C", dir, member}, nil, pw, stderr)
+		pw.CloseWithError(err)
+		errCh <- err
+	}()
+
+	tr := tar.NewReader(pr)
+	hdr, err := tr.Next()
+	if err != nil {
+		// nothing is archived, stderr is safe to read after the exec returned.
+		pr.Close()
+		msg := execErrorMessage(<-errCh, stderr)
+		progress.done(fmt.Errorf("%s", msg))
+		writeFileError(w, errors.CodeCopyFileFailed, msg)
+		return
+	}
+
+	// the first entry of a directory is the directory itself, so the path is a
+	// regular file if the first entry is a regular file with the same name.
+	if hdr.Typeflag == tar.TypeReg && path.Clean(hdr.Name) == path.Clean(member) {
+		if maxSize > 0 && hdr.Size > maxSize {
+			progress.done(fmt.Errorf("file size %d exceeds %d bytes", hdr.Size, maxSize))
+			errors.WriteErrorWithMsg(w, http.StatusRequestEntityTooLarge, errors.CodeFileTooLarge,
+				fmt.Sprintf("file size %d exceeds %d bytes", hdr.Size, maxSize))
+			return
+		}
+		progress.total = hdr.Size
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", fmt.Sprint(hdr.Size))
+		setAttachment(w, path.Base(hdr.Name))
+		_, err = io.Copy(io.MultiWriter(w, progress), tr)
+		progress.done(err)
+		return
+	}
+
+	name := path.Base(path.Clean(filePath))
+	if name == "/" {
+		name = "root"
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	setAttachment(w, name+".tar")
+	tw := tar.NewWriter(io.MultiWriter(w, progress))
+	var size int64
+	for ; err == nil; hdr, err = tr.Next() {
+		// the archive is made by the container, don't let it write outside the
+		// directory when extracted by the user.
+		if entry := path.Clean(hdr.Name); path.IsAbs(entry) || entry == ".." || strings.HasPrefix(entry, "../") {
+			log.Warnf("skip %q in the archive of %s: invalid path", hdr.Name, filePath)
+			continue
+		}
+		if size += hdr.Size; maxSize > 0 && size > maxSize {
+			err = fmt.Errorf("archive size exceeds %d bytes", maxSize)
+			break
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			break
+		}
+		if _, err = io.Copy(tw, tr); err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		err = tw.Close()
+		// drain the padding so tar in the container exits, the files which can't
+		// be read, such as permission denied, are skipped by tar.
+		io.Copy(io.Discard, pr)
+		if execErr := <-errCh; execErr != nil {
+			log.Warnf("download %s: %s", filePath, execErrorMessage(execErr, stderr))
+		}
+	}
+	progress.done(err)
+	if err != nil {
+		// the response has been started, abort it so the client knows the
+		// archive is incomplete.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// HandleFileUpload handle "PUT /api/v1/{namespace}/{pod}/{container}/files" requests.
+//
+// It copies the request body into the container as the file at the query
+// parameter "path", just like "kubectl cp", by streaming a tar archive to
+// "tar xmf -" executed in the container, so "tar" must exist in the container
+// and the parent directory must exist. The Content-Length is required, and must
+// not be larger than "--max-file-size". The progress is sent to the watcher of
+// the query parameter "transfer", see HandleWsTransfer.
+func HandleFileUpload(w http.ResponseWriter, r *http.Request) {
+	if !allowRequest(w, r) {
+		return
+	}
+	pathParams := mux.Vars(r)
+	namespace := pathParams["namespace"]
+	podName := pathParams["pod"]
+	containerName := pathParams["container"]
+	query := r.URL.Query()
+
+	filePath := query.Get("path")
+	dir, member, err := splitFilePath(filePath)
+	if err == nil && member == "." {
+		err = fmt.Errorf("invalid path %q, must be a file", filePath)
+	}
+	if err != nil {
+		errors.WriteErrorWithMsg(w, http.StatusBadRequest, errors.CodeInvalidFilePath, err.Error())
+		return
+	}
+	size := r.ContentLength
+	if size < 0 {
+		errors.WriteError(w, http.StatusLengthRequired, errors.CodeLengthRequired)
+		return
+	}
+	if maxSize := args.GetMaxFileSize(); maxSize > 0 && size > maxSize {
+		errors.WriteErrorWithMsg(w, http.StatusRequestEntityTooLarge, errors.CodeFileTooLarge,
+			fmt.Sprintf("file size %d exceeds %d bytes", size, maxSize))
+		return
+	}
+	podHandler, podObj, container, ok := getFileContainer(w, r, namespace, podName, containerName)
+	if !ok {
+		return
+	}
+	log.Infof("upload file: namespace: %s, pod: %s, container: %s, path: %s, size: %d", namespace, podObj.Name, container.Name, filePath, size)
+	progress := newTransferProgress(r, query.Get("transfer"), transferTarget(namespace, podName, containerName), filePath, size)
+
+	pr, pw := io.Pipe()
+	copyCh := make(chan error, 1)
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     path.Base(member),
+			Mode:     0644,
+			Size:     size,
+			ModTime:  time.Now(),
+		})
+		if err == nil {
+			_, err = io.Copy(tw, io.TeeReader(r.Body, progress))
+		}
+		if err == nil {
+			// tar in the container may exit before reading the padding at the
+			// end, the error is reported by the exec if the archive is incomplete.
+			tw.Close()
+		}
+		pw.CloseWithError(err)
+		copyCh <- err
+	}()
+
+	stderr := new(bytes.Buffer)
+	err = execStream(podHandler, namespace, podObj.Name, container.Name,
+		[]string{"tar", "xmf", "-", "-C", dir}, pr, io.Discard, stderr)
+	// stop the copy if tar exited early.
+	pr.CloseWithError(io.ErrClosedPipe)
+	if copyErr := <-copyCh; err == nil && copyErr != nil {
+		err = copyErr
+	}
+	if err != nil {
+		msg := execErrorMessage(err, stderr)
+		progress.done(fmt.Errorf("%s", msg))
+		writeFileError(w, errors.CodeCopyFileFailed, msg)
+		return
+	}
+	progress.done(nil)
+	errors.WriteSuccess(w, map[string]interface{}{"path": path.Clean(filePath), "size": size})
+}
+
+// splitFilePath validates the path of the file in the container, and splits it
+// into the directory and the member archived by tar. The path must be absolute
+// and must not contain "..", the member is prefixed with "./" so it's never
+// taken as an option of tar.
+func splitFilePath(filePath string) (dir, member string, err error) {
+	if filePath, err = cleanFilePath(filePath); err != nil {
+		return "", "", err
+	}
+	if filePath == "/" {
+		return "/", ".", nil
+	}
+	return path.Dir(filePath), "./" + path.Base(filePath), nil
+}
+
+// cleanFilePath validates the path of the file in the container and returns
+// it cleaned. The path must be absolute and must not contain "..".
+func cleanFilePath(filePath string) (string, error) {
+	if !path.IsAbs(filePath) || strings.ContainsRune(filePath, 0) {
+		return "", fmt.Errorf("invalid path %q, must be an absolute path", filePath)
+	}
+	for _, elem := range strings.Split(filePath, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("invalid path %q, must not contain '..'", filePath)
+		}
+	}
+	return path.Clean(filePath), nil
+}
+
+// writeFileError writes the error response of the failed command operating
+// files in the container, msg is the stderr of the command. code is used if
+// the error is neither not found nor permission denied.
+func writeFileError(w http.ResponseWriter, code errors.ResponseCode, msg string) {
+	switch {
+	case strings.Contains(msg, "No such file"):
+		errors.WriteErrorWithMsg(w, http.StatusNotFound, errors.CodeFileNotFound, msg)
+	case strings.Contains(msg, "Permission denied"):
+		errors.WriteErrorWithMsg(w, http.StatusForbidden, errors.CodeFilePermissionDenied, msg)
+	default:
+		errors.WriteErrorWithMsg(w, http.StatusInternalServerError, code, msg)
+	}
+}
+
+// getFileContainer checks the access policy and gets the pod and container to
+// copy files with, the error response is written if false is returned.
+func getFileContainer(w http.ResponseWriter, r *http.Request, namespace, podName, containerName string) (*pod.Handler, *corev1.Pod, *corev1.Container, bool) {
+	if !checkNamespaceAccess(w, r, policy.ActionFiles, namespace) {
+		return nil, nil, nil, false
+	}
+	podHandler, err := newPodHandler(r, namespace)
+	if err != nil {
+		log.Error("get pod handler error: ", err)
+		errors.WriteError(w, http.StatusInternalServerError, errors.CodeInternalError)
+		return nil, nil, nil, false
+	}
+	podObj, err := getPod(podHandler, namespace, podName)
+	if err != nil {
+		log.Error("get pod error: ", err)
+		errors.WriteErrorWithMsg(w, http.StatusNotFound, errors.CodePodNotFound, err.Error())
+		return nil, nil, nil, false
+	}
+	container, err := getContainer(podObj, containerName)
+	if err != nil {
+		errors.WriteErrorWithMsg(w, http.StatusNotFound, errors.CodeContainerNotFound, err.Error())
+		return nil, nil, nil, false
+	}
+	if !checkPodAccess(w, r, policy.ActionFiles, podObj, container.Name) {
+		return nil, nil, nil, false
+	}
+	return podHandler, podObj, container, true
+}
+
+// execStream executes the command in the container without a tty, so the
+// binary stdin and stdout are not mangled. stdin is not attached if it's nil.
+func execStream(podHandler *pod.Handler, namespace, podName, containerName string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	req := podHandler.RESTClient().Post().
+		Namespace(namespace).
+		Resource("pods").
+		Name(podName).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: containerName,
+			Command:   command,
+			Stdin:     stdin != nil,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(podHandler.RESTConfig(), "POST", req.URL())
+	if err != nil {
+		return err
+	}
+	return executor.Stream(remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+}
+
+// execErrorMessage returns the stderr of the command, which is more helpful
+// than the exit code, or the error if stderr is empty.
+func execErrorMessage(err error, stderr *bytes.Buffer) string {
+	if msg := strings.TrimSpace(stderr.String()); len(msg) != 0 {
+		return msg
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return "no file is archived"
+}
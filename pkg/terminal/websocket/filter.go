@@ -0,0 +1,155 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/forbearing/ratel-webterminal/pkg/errors"
+)
+
+// defaultLevelField is the field of JSON logs used by level filter if
+// levelField is not set.
+const defaultLevelField = "level"
+
+// logLevels maps the log level names to severities, the bigger is more severe.
+var logLevels = map[string]int{
+	"trace":    1,
+	"debug":    2,
+	"info":     3,
+	"warn":     4,
+	"warning":  4,
+	"error":    5,
+	"err":      5,
+	"fatal":    6,
+	"panic":    6,
+	"critical": 6,
+}
+
+// LogControlMessage is the message sent by the frontend JavaScript to change
+// the log filter mid-stream.
+//
+// OP      DIRECTION  FIELD(S) USED                         DESCRIPTION
+// ---------------------------------------------------------------------
+// filter  fe->be     Include, Exclude, Level, LevelField   Replace the log filter
+type LogControlMessage struct {
+	Op         string `json:"op"`
+	Include    string `json:"include"`
+	Exclude    string `json:"exclude"`
+	Level      string `json:"level"`
+	LevelField string `json:"levelField"`
+}
+
+// logFilter filters the log lines server-side, so noisy pods don't flood
+// the browser.
+//
+// If include is set, only the lines matched the regular expression are sent,
+// with the matches as highlight spans. If exclude is set, the lines matched the
+// regular expression are dropped. If level is set, only the JSON logs whose
+// level field is at least this level are sent, the lines not in JSON format
+// or without level field are always sent.
+type logFilter struct {
+	include    *regexp.Regexp
+	exclude    *regexp.Regexp
+	level      int
+	levelField string
+}
+
+// newLogFilter creates a log filter, it returns nil if no filter is set.
+func newLogFilter(include, exclude, level, levelField string) (*logFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 && len(level) == 0 {
+		return nil, nil
+	}
+
+	var err error
+	filter := &logFilter{levelField: levelField}
+	if len(filter.levelField) == 0 {
+		filter.levelField = defaultLevelField
+	}
+	if len(include) != 0 {
+		if filter.include, err = regexp.Compile(include); err != nil {
+			return nil, fmt.Errorf("invalid include regular expression %q: %s", include, err.Error())
+		}
+	}
+	if len(exclude) != 0 {
+		if filter.exclude, err = regexp.Compile(exclude); err != nil {
+			return nil, fmt.Errorf("invalid exclude regular expression %q: %s", exclude, err.Error())
+		}
+	}
+	if len(level) != 0 {
+		var ok bool
+		if filter.level, ok = logLevels[strings.ToLower(level)]; !ok {
+			return nil, fmt.Errorf("invalid level %q, should be one of 'trace', 'debug', 'info', 'warn', 'error' or 'fatal'", level)
+		}
+	}
+	return filter, nil
+}
+
+// parseLogFilter creates the log filter from the query parameters "include",
+// "exclude", "level" and "levelField" of the logs request.
+func parseLogFilter(query url.Values) (*logFilter, errors.ResponseCode, error) {
+	filter, err := newLogFilter(query.Get("include"), query.Get("exclude"), query.Get("level"), query.Get("levelField"))
+	if err != nil {
+		return nil, errors.CodeInvalidLogFilter, err
+	}
+	return filter, errors.CodeSuccess, nil
+}
+
+// apply returns the [start, end) byte offsets of the include matches in the
+// line, and whether the line should be sent.
+func (f *logFilter) apply(line []byte) ([][2]int, bool) {
+	if f.exclude != nil && f.exclude.Match(line) {
+		return nil, false
+	}
+	if f.level != 0 {
+		if level, ok := f.lineLevel(line); ok && level < f.level {
+			return nil, false
+		}
+	}
+	if f.include == nil {
+		return nil, true
+	}
+
+	matches := f.include.FindAllIndex(line, -1)
+	if len(matches) == 0 {
+		return nil, false
+	}
+	highlights := make([][2]int, 0, len(matches))
+	for _, m := range matches {
+		// skip the empty matches.
+		if m[0] == m[1] {
+			continue
+		}
+		highlights = append(highlights, [2]int{m[0], m[1]})
+	}
+	return highlights, true
+}
+
+// lineLevel returns the severity of the JSON log line. The JSON object may be
+// prefixed by something like the log level of klog.
+func (f *logFilter) lineLevel(line []byte) (int, bool) {
+	start := bytes.IndexByte(line, '{')
+	if start == -1 {
+		return 0, false
+	}
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(line[start:], &fields); err != nil {
+		return 0, false
+	}
+	switch value := fields[f.levelField].(type) {
+	case string:
+		level, ok := logLevels[strings.ToLower(value)]
+		return level, ok
+	case float64:
+		// numeric levels used by pino and bunyan: 10 trace, 20 debug, 30 info,
+		// 40 warn, 50 error, 60 fatal.
+		if value < 10 {
+			return 0, false
+		}
+		return int(value) / 10, true
+	}
+	return 0, false
+}
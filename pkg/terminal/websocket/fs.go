@@ -0,0 +1,474 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/forbearing/k8s/pod"
+	"github.com/forbearing/ratel-webterminal/pkg/args"
+	"github.com/forbearing/ratel-webterminal/pkg/errors"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxListEntries is the max number of files returned by HandleFileList.
+	maxListEntries = 10000
+
+	// findFormat is the "-printf" format of GNU find. Every file is printed as
+	// three NUL terminated fields: "type perm size mtime user group", the name
+	// and the link target, so any name can be parsed.
+	findFormat = `%y %m %s %T@ %u %g\0%f\0%l\0`
+	// statFormat is the "stat -c" format supported by both coreutils and
+	// busybox, whose find doesn't support "-printf". The raw mode in hex
+	// contains both the type and the permission.
+	statFormat = "%f %s %Y %U %G"
+	// statListScript lists the directory $1 by stat, the output has the same
+	// fields as findFormat.
+	statListScript = `[ -e "$1" ] || { echo "$1: No such file or directory" >&2; exit 1; }
+cd -- "$1" || exit 1
+for f in * .[!.]* ..?*; do
+	if [ -e "$f" ] || [ -L "$f" ]; then
+		info=$(stat -c '` + statFormat + `' -- "$f") || continue
+		printf '%s\0%s\0%s\0' "$info" "$f" "$(readlink -- "$f")"
+	fi
+done`
+	// statFileScript stats the file $1, the output has the same fields as
+	// findFormat.
+	statFileScript = `info=$(stat -c '` + statFormat + `' -- "$1") || exit 1
+printf '%s\0%s\0%s\0' "$info" "$1" "$(readlink -- "$1")"`
+	// readScript reads $3 bytes from the offset $1 (starts from 1) of the file $2.
+	readScript = `tail -c +"$1" -- "$2" | head -c "$3"`
+
+	fileTypeFile    = "file"
+	fileTypeDir     = "dir"
+	fileTypeSymlink = "symlink"
+	fileTypeOther   = "other"
+)
+
+// FileInfo describes a file in the container.
+// Type:  one of "file", "dir", "symlink" and "other".
+// Mode:  the permission in octal, such as "0644".
+// Link:  the target of the symlink.
+type FileInfo struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"modTime"`
+	User    string    `json:"user"`
+	Group   string    `json:"group"`
+	Link    string    `json:"link,omitempty"`
+}
+
+// HandleFileList handle "GET /api/v1/{namespace}/{pod}/{container}/files/list" requests.
+//
+// It lists the directory at the query parameter "path" in the container, the
+// directories first, then sorted by name. At most maxListEntries files are
+// returned, and "truncated" is true if there are more.
+func HandleFileList(w http.ResponseWriter, r *http.Request) {
+	if !allowRequest(w, r) {
+		return
+	}
+	pathParams := mux.Vars(r)
+	filePath, err := cleanFilePath(r.URL.Query().Get("path"))
+	if err != nil {
+		errors.WriteErrorWithMsg(w, http.StatusBadRequest, errors.CodeInvalidFilePath, err.Error())
+		return
+	}
+	podHandler, podObj, container, ok := getFileContainer(w, r, pathParams["namespace"], pathParams["pod"], pathParams["container"])
+	if !ok {
+		return
+	}
+	t := fileTarget{podHandler, podObj.Namespace, podObj.Name, container.Name}
+
+	infos, msg, err := t.findFiles(filePath, false)
+	if err != nil {
+		writeFileError(w, errors.CodeListFilesFailed, msg)
+		return
+	}
+	if infos[0].Type != fileTypeDir && infos[0].Type != fileTypeSymlink {
+		errors.WriteErrorWithMsg(w, http.StatusBadRequest, errors.CodeInvalidFilePath, filePath+": Not a directory")
+		return
+	}
+	if infos, msg, err = t.findFiles(filePath, true); err != nil {
+		writeFileError(w, errors.CodeListFilesFailed, msg)
+		return
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		if (infos[i].Type == fileTypeDir) != (infos[j].Type == fileTypeDir) {
+			return infos[i].Type == fileTypeDir
+		}
+		return infos[i].Name < infos[j].Name
+	})
+	truncated := len(infos) > maxListEntries
+	if truncated {
+		infos = infos[:maxListEntries]
+	}
+	errors.WriteSuccess(w, map[string]interface{}{"path": filePath, "files": infos, "truncated": truncated})
+}
+
+// HandleFileStat handle "GET /api/v1/{namespace}/{pod}/{container}/files/stat" requests.
+//
+// It returns the FileInfo of the query parameter "path" in the container, the
+// symlink is not followed.
+func HandleFileStat(w http.ResponseWriter, r *http.Request) {
+	if !allowRequest(w, r) {
+		return
+	}
+	pathParams := mux.Vars(r)
+	filePath, err := cleanFilePath(r.URL.Query().Get("path"))
+	if err != nil {
+		errors.WriteErrorWithMsg(w, http.StatusBadRequest, errors.CodeInvalidFilePath, err.Error())
+		return
+	}
+	podHandler, podObj, container, ok := getFileContainer(w, r, pathParams["namespace"], pathParams["pod"], pathParams["container"])
+	if !ok {
+		return
+	}
+	t := fileTarget{podHandler, podObj.Namespace, podObj.Name, container.Name}
+
+	infos, msg, err := t.findFiles(filePath, false)
+	if err != nil {
+		writeFileError(w, errors.CodeListFilesFailed, msg)
+		return
+	}
+	errors.WriteSuccess(w, infos[0])
+}
+
+// HandleFileRead handle "GET /api/v1/{namespace}/{pod}/{container}/files/read" requests.
+//
+// It reads the regular file at the query parameter "path" in the container.
+// A single byte range in the Range header is supported, such as
+// "bytes=-65536" for the last 64KB of a log file. The bytes read must not be
+// more than "--max-file-size", use HandleFileDownload for large files.
+func HandleFileRead(w http.ResponseWriter, r *http.Request) {
+	if !allowRequest(w, r) {
+		return
+	}
+	pathParams := mux.Vars(r)
+	filePath, err := cleanFilePath(r.URL.Query().Get("path"))
+	if err != nil {
+		errors.WriteErrorWithMsg(w, http.StatusBadRequest, errors.CodeInvalidFilePath, err.Error())
+		return
+	}
+	podHandler, podObj, container, ok := getFileContainer(w, r, pathParams["namespace"], pathParams["pod"], pathParams["container"])
+	if !ok {
+		return
+	}
+	t := fileTarget{podHandler, podObj.Namespace, podObj.Name, container.Name}
+
+	infos, msg, err := t.findFiles(filePath, false)
+	if err != nil {
+		writeFileError(w, errors.CodeListFilesFailed, msg)
+		return
+	}
+	info := infos[0]
+	if info.Type != fileTypeFile {
+		errors.WriteErrorWithMsg(w, http.StatusBadRequest, errors.CodeNotRegularFile, fmt.Sprintf("%s is a %s", filePath, info.Type))
+		return
+	}
+	start, length := int64(0), info.Size
+	rangeHeader := r.Header.Get("Range")
+	if len(rangeHeader) != 0 {
+		if start, length, err = parseRange(rangeHeader, info.Size); err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+			errors.WriteErrorWithMsg(w, http.StatusRequestedRangeNotSatisfiable, errors.CodeInvalidRange, err.Error())
+			return
+		}
+	}
+	if maxSize := args.GetMaxFileSize(); maxSize > 0 && length > maxSize {
+		errors.WriteErrorWithMsg(w, http.StatusRequestEntityTooLarge, errors.CodeFileTooLarge,
+			fmt.Sprintf("reading %d bytes exceeds %d bytes, read a range or download it", length, maxSize))
+		return
+	}
+	log.Infof("read file: namespace: %s, pod: %s, container: %s, path: %s, offset: %d, length: %d", t.namespace, t.podName, t.containerName, filePath, start, length)
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	stderr := new(bytes.Buffer)
+	errCh := make(chan error, 1)
+	go func() {
+		err := execStream(t.podHandler, t.namespace, t.podName, t.containerName,
+			[]string{"sh", "-c", readScript, "sh", strconv.FormatInt(start+1, 10), filePath, strconv.FormatInt(length, 10)},
+			nil, pw, stderr)
+		pw.CloseWithError(err)
+		errCh <- err
+	}()
+	// the content type is detected from the beginning of the content.
+	br := bufio.NewReader(pr)
+	head, _ := br.Peek(512)
+	if len(head) == 0 && length != 0 {
+		pr.Close()
+		if err := <-errCh; err != nil {
+			writeFileError(w, errors.CodeListFilesFailed, execErrorMessage(err, stderr))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(head))
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	if len(rangeHeader) != 0 {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, info.Size))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	if _, err := io.Copy(w, br); err != nil && r.Context().Err() == nil {
+		log.Errorf("read %s error: %s", filePath, err.Error())
+	}
+}
+
+// HandleFileDelete handle "DELETE /api/v1/{namespace}/{pod}/{container}/files" requests.
+//
+// It deletes the file at the query parameter "path" in the container. A
+// directory is deleted only if the query parameter "recursive" is true.
+func HandleFileDelete(w http.ResponseWriter, r *http.Request) {
+	if !allowRequest(w, r) {
+		return
+	}
+	pathParams := mux.Vars(r)
+	query := r.URL.Query()
+	filePath, err := cleanFilePath(query.Get("path"))
+	if err == nil && filePath == "/" {
+		err = fmt.Errorf("invalid path %q, can't delete the root directory", filePath)
+	}
+	if err != nil {
+		errors.WriteErrorWithMsg(w, http.StatusBadRequest, errors.CodeInvalidFilePath, err.Error())
+		return
+	}
+	var recursive bool
+	if value := query.Get("recursive"); len(value) != 0 {
+		if recursive, err = strconv.ParseBool(value); err != nil {
+			errors.WriteErrorWithMsg(w, http.StatusBadRequest, errors.CodeInvalidParam, fmt.Sprintf("invalid recursive: %q", value))
+			return
+		}
+	}
+	podHandler, podObj, container, ok := getFileContainer(w, r, pathParams["namespace"], pathParams["pod"], pathParams["container"])
+	if !ok {
+		return
+	}
+	t := fileTarget{podHandler, podObj.Namespace, podObj.Name, container.Name}
+	log.Infof("delete file: namespace: %s, pod: %s, container: %s, path: %s, recursive: %t", t.namespace, t.podName, t.containerName, filePath, recursive)
+
+	command := []string{"rm", "--", filePath}
+	if recursive {
+		command = []string{"rm", "-r", "--", filePath}
+	}
+	if _, msg, err := t.run(command); err != nil {
+		if strings.Contains(msg, "Is a directory") {
+			errors.WriteErrorWithMsg(w, http.StatusBadRequest, errors.CodeIsDirectory, msg)
+			return
+		}
+		writeFileError(w, errors.CodeDeleteFileFailed, msg)
+		return
+	}
+	errors.WriteSuccess(w, map[string]interface{}{"path": filePath})
+}
+
+// fileTarget is the container whose files are operated.
+type fileTarget struct {
+	podHandler    *pod.Handler
+	namespace     string
+	podName       string
+	containerName string
+}
+
+// run executes the command in the container, and returns the stdout, and the
+// error message if failed.
+func (t fileTarget) run(command []string) ([]byte, string, error) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	if err := execStream(t.podHandler, t.namespace, t.podName, t.containerName, command, nil, stdout, stderr); err != nil {
+		return stdout.Bytes(), execErrorMessage(err, stderr), err
+	}
+	return stdout.Bytes(), "", nil
+}
+
+// findFiles returns the files in the directory if list is true, otherwise the
+// file itself. "find -printf" is tried first, and "stat" is the fallback for
+// busybox. It returns the error message if failed.
+func (t fileTarget) findFiles(filePath string, list bool) ([]FileInfo, string, error) {
+	command := []string{"find", filePath, "-maxdepth", "0", "-printf", findFormat}
+	if list {
+		// -H follows the symlink to the directory.
+		command = []string{"find", "-H", filePath, "-mindepth", "1", "-maxdepth", "1", "-printf", findFormat}
+	}
+	output, msg, err := t.run(command)
+	// the files can't be read are skipped.
+	if err == nil || (list && len(output) != 0) {
+		infos, parseErr := parseFileInfos(output, filePath, list, parseFindInfo)
+		if parseErr == nil {
+			return infos, "", nil
+		}
+		log.Warnf("parse find output of %s error: %s", filePath, parseErr.Error())
+	} else if strings.Contains(msg, "No such file") || strings.Contains(msg, "Permission denied") {
+		return nil, msg, err
+	}
+	log.Debugf("find %s error, fallback to stat: %s", filePath, msg)
+
+	script := statFileScript
+	if list {
+		script = statListScript
+	}
+	if output, msg, err = t.run([]string{"sh", "-c", script, "sh", filePath}); err != nil {
+		return nil, msg, err
+	}
+	infos, err := parseFileInfos(output, filePath, list, parseStatInfo)
+	if err != nil {
+		return nil, err.Error(), err
+	}
+	return infos, "", nil
+}
+
+// parseFileInfos parses the output of findFormat or statFormat, every file has
+// three NUL terminated fields: the info parsed by parseInfo, the name and the
+// link target. The files are in the directory filePath if list is true.
+func parseFileInfos(output []byte, filePath string, list bool, parseInfo func([]string, *FileInfo) error) ([]FileInfo, error) {
+	fields := strings.Split(string(output), "\x00")
+	// the last field is empty after the terminating NUL.
+	fields = fields[:len(fields)-1]
+	if len(fields)%3 != 0 || (!list && len(fields) != 3) {
+		return nil, fmt.Errorf("unexpected output: %q", output)
+	}
+	infos := make([]FileInfo, 0, len(fields)/3)
+	for i := 0; i < len(fields); i += 3 {
+		info := FileInfo{Name: path.Base(fields[i+1]), Path: filePath, Link: fields[i+2]}
+		if list {
+			info.Path = path.Join(filePath, info.Name)
+		} else {
+			info.Name = path.Base(filePath)
+		}
+		if err := parseInfo(strings.Fields(fields[i]), &info); err != nil {
+			return nil, fmt.Errorf("parse %q: %s", fields[i], err.Error())
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// parseFindInfo parses "type perm size mtime user group" printed by find.
+func parseFindInfo(fields []string, info *FileInfo) error {
+	if len(fields) != 6 {
+		return fmt.Errorf("expect 6 fields, got %d", len(fields))
+	}
+	switch fields[0] {
+	case "f":
+		info.Type = fileTypeFile
+	case "d":
+		info.Type = fileTypeDir
+	case "l":
+		info.Type = fileTypeSymlink
+	default:
+		info.Type = fileTypeOther
+	}
+	perm, err := strconv.ParseUint(fields[1], 8, 32)
+	if err != nil {
+		return err
+	}
+	info.Mode = fmt.Sprintf("%04o", perm)
+	if info.Size, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+		return err
+	}
+	sec, nsec, _ := strings.Cut(fields[3], ".")
+	if info.ModTime, err = parseUnixTime(sec, nsec); err != nil {
+		return err
+	}
+	info.User, info.Group = fields[4], fields[5]
+	return nil
+}
+
+// parseStatInfo parses "rawmode size mtime user group" printed by stat, the
+// raw mode is in hex.
+func parseStatInfo(fields []string, info *FileInfo) error {
+	if len(fields) != 5 {
+		return fmt.Errorf("expect 5 fields, got %d", len(fields))
+	}
+	mode, err := strconv.ParseUint(fields[0], 16, 32)
+	if err != nil {
+		return err
+	}
+	switch mode & 0170000 {
+	case 0100000:
+		info.Type = fileTypeFile
+	case 0040000:
+		info.Type = fileTypeDir
+	case 0120000:
+		info.Type = fileTypeSymlink
+	default:
+		info.Type = fileTypeOther
+	}
+	info.Mode = fmt.Sprintf("%04o", mode&07777)
+	if info.Size, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return err
+	}
+	if info.ModTime, err = parseUnixTime(fields[2], ""); err != nil {
+		return err
+	}
+	info.User, info.Group = fields[3], fields[4]
+	return nil
+}
+
+// parseUnixTime parses the unix time in seconds, and the fraction of a second
+// if any.
+func parseUnixTime(sec, fraction string) (time.Time, error) {
+	s, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var nsec int64
+	if len(fraction) != 0 {
+		fraction = (fraction + "000000000")[:9]
+		if nsec, err = strconv.ParseInt(fraction, 10, 64); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Unix(s, nsec), nil
+}
+
+// parseRange parses the Range header of a single byte range, such as
+// "bytes=0-1023", "bytes=1024-" or "bytes=-1024", and returns the start and
+// the length of the range in the file of size.
+func parseRange(header string, size int64) (start, length int64, err error) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	if spec == header || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("invalid range %q, only a single byte range is supported", header)
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+	if !ok || (len(first) == 0 && len(last) == 0) {
+		return 0, 0, fmt.Errorf("invalid range %q", header)
+	}
+	if len(first) == 0 {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, fmt.Errorf("invalid range %q for size %d", header, size)
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, nil
+	}
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil || start < 0 || start >= size {
+		return 0, 0, fmt.Errorf("invalid range %q for size %d", header, size)
+	}
+	end := size - 1
+	if len(last) != 0 {
+		e, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || e < start {
+			return 0, 0, fmt.Errorf("invalid range %q for size %d", header, size)
+		}
+		if e < end {
+			end = e
+		}
+	}
+	return start, end - start + 1, nil
+}
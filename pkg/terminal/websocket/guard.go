@@ -0,0 +1,313 @@
+package websocket
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/forbearing/ratel-webterminal/pkg/args"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	commandBlocked   = "blocked"
+	commandConfirm   = "confirm"
+	commandConfirmed = "confirmed"
+	commandCanceled  = "canceled"
+
+	// commandHistorySize is the number of commands kept to reconstruct the
+	// command line recalled by the up and down keys.
+	commandHistorySize = 100
+
+	keyCtrlA     = 0x01
+	keyCtrlC     = 0x03
+	keyCtrlE     = 0x05
+	keyBackspace = 0x08
+	keyCtrlU     = 0x15
+	keyCtrlW     = 0x17
+	keyEscape    = 0x1b
+	keyDelete    = 0x7f
+)
+
+// commandRules are the compiled "--blocked-command" and "--confirm-command".
+var commandRules []commandRule
+
+// guardedCommands counts the guarded commands by the action, it is exported
+// by "/debug/vars".
+var guardedCommands = expvar.NewMap("terminal_commands_guarded_total")
+
+// commandRule blocks the command matched by pattern, or requires confirmation
+// if confirm is true.
+type commandRule struct {
+	pattern *regexp.Regexp
+	confirm bool
+}
+
+// InitCommandGuard compiles "--blocked-command" and "--confirm-command", the
+// guard of terminal sessions is disabled if none is set.
+func InitCommandGuard() {
+	for _, pattern := range args.GetBlockedCommands() {
+		commandRules = append(commandRules, commandRule{pattern: mustCompileCommand(pattern)})
+	}
+	for _, pattern := range args.GetConfirmCommands() {
+		commandRules = append(commandRules, commandRule{pattern: mustCompileCommand(pattern), confirm: true})
+	}
+	if len(commandRules) != 0 {
+		log.Infof("command guard enabled with %d rules", len(commandRules))
+	}
+}
+
+func mustCompileCommand(pattern string) *regexp.Regexp {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Fatalf("invalid command pattern '%s': %s", pattern, err.Error())
+	}
+	return re
+}
+
+// commandEvent is a command guarded by the commandGuard.
+type commandEvent struct {
+	action  string
+	command string
+	pattern string
+}
+
+// message returns the warning shown to the users.
+func (e *commandEvent) message() string {
+	switch e.action {
+	case commandBlocked:
+		return fmt.Sprintf("command blocked: %s", e.command)
+	case commandConfirm:
+		return fmt.Sprintf("dangerous command: %s, press Enter again to run it, or any other key to cancel", e.command)
+	case commandCanceled:
+		return fmt.Sprintf("command canceled: %s", e.command)
+	}
+	return fmt.Sprintf("command confirmed: %s", e.command)
+}
+
+// commandGuard reconstructs the command line typed into the terminal from the
+// input, and blocks the commands matched by the commandRules, or holds the
+// Enter key until the user confirms them.
+//
+// It's a guardrail against mistakes rather than a security boundary, the line
+// can't be known exactly after tab completion, or recalling the history before
+// the session, and scripts or aliases can run anything.
+type commandGuard struct {
+	line   []rune
+	cursor int
+	// escape is the incomplete escape sequence of the special keys.
+	escape []byte
+
+	history []string
+	// recalled is the index in history of the line recalled by the up and
+	// down keys, len(history) if not recalled.
+	recalled int
+
+	// confirming is the command waiting for the confirmation.
+	confirming *commandEvent
+}
+
+// newCommandGuard returns nil if there are no commandRules.
+func newCommandGuard() *commandGuard {
+	if len(commandRules) == 0 {
+		return nil
+	}
+	return &commandGuard{}
+}
+
+// filter inspects the input, and returns the input sent to the container.
+// If a guarded command is submitted, the Enter key is replaced by Ctrl-C to
+// discard the line in the shell, or held until the next input confirms it,
+// and the rest of the input is dropped.
+func (g *commandGuard) filter(p []byte) ([]byte, *commandEvent) {
+	if event := g.confirming; event != nil {
+		g.confirming = nil
+		if string(p) == "\r" || string(p) == "\n" {
+			g.submit(event.command)
+			return p, &commandEvent{action: commandConfirmed, command: event.command, pattern: event.pattern}
+		}
+		g.reset()
+		return []byte{keyCtrlC}, &commandEvent{action: commandCanceled, command: event.command, pattern: event.pattern}
+	}
+
+	out := make([]byte, 0, len(p))
+	for i := 0; i < len(p); {
+		b := p[i]
+		if len(g.escape) != 0 || b == keyEscape {
+			g.escape = append(g.escape, b)
+			if g.escapeComplete() {
+				g.handleEscape()
+				g.escape = g.escape[:0]
+			}
+			out = append(out, b)
+			i++
+			continue
+		}
+
+		switch b {
+		case '\r', '\n':
+			command := strings.Join(strings.Fields(string(g.line)), " ")
+			for _, rule := range commandRules {
+				if !rule.pattern.MatchString(command) {
+					continue
+				}
+				event := &commandEvent{action: commandBlocked, command: command, pattern: rule.pattern.String()}
+				if rule.confirm {
+					event.action = commandConfirm
+					g.confirming = event
+					return out, event
+				}
+				g.reset()
+				return append(out, keyCtrlC), event
+			}
+			g.submit(command)
+		case keyDelete, keyBackspace:
+			if g.cursor > 0 {
+				g.line = append(g.line[:g.cursor-1], g.line[g.cursor:]...)
+				g.cursor--
+			}
+		case keyCtrlU:
+			g.line = append(g.line[:0], g.line[g.cursor:]...)
+			g.cursor = 0
+		case keyCtrlW:
+			start := g.cursor
+			for start > 0 && g.line[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && g.line[start-1] != ' ' {
+				start--
+			}
+			g.line = append(g.line[:start], g.line[g.cursor:]...)
+			g.cursor = start
+		case keyCtrlC:
+			g.reset()
+		case keyCtrlA:
+			g.cursor = 0
+		case keyCtrlE:
+			g.cursor = len(g.line)
+		default:
+			if b >= 0x20 {
+				r, size := utf8.DecodeRune(p[i:])
+				g.line = append(g.line[:g.cursor], append([]rune{r}, g.line[g.cursor:]...)...)
+				g.cursor++
+				out = append(out, p[i:i+size]...)
+				i += size
+				continue
+			}
+		}
+		out = append(out, b)
+		i++
+	}
+	return out, nil
+}
+
+// escapeComplete returns whether g.escape is a complete escape sequence, such
+// as "ESC [ A" of the up key.
+func (g *commandGuard) escapeComplete() bool {
+	switch {
+	case len(g.escape) < 2:
+		return false
+	case g.escape[1] == '[':
+		last := g.escape[len(g.escape)-1]
+		return len(g.escape) > 2 && last >= 0x40 && last <= 0x7e
+	case g.escape[1] == 'O':
+		return len(g.escape) == 3
+	}
+	// Alt with a key.
+	return true
+}
+
+// handleEscape moves the cursor, deletes the character at the cursor, or
+// recalls the history as the shell does.
+func (g *commandGuard) handleEscape() {
+	sequence := string(g.escape[1:])
+	switch sequence {
+	case "[C", "OC":
+		if g.cursor < len(g.line) {
+			g.cursor++
+		}
+	case "[D", "OD":
+		if g.cursor > 0 {
+			g.cursor--
+		}
+	case "[H", "OH", "[1~":
+		g.cursor = 0
+	case "[F", "OF", "[4~":
+		g.cursor = len(g.line)
+	case "[3~":
+		if g.cursor < len(g.line) {
+			g.line = append(g.line[:g.cursor], g.line[g.cursor+1:]...)
+		}
+	case "[A", "OA":
+		if g.recalled > 0 {
+			g.recalled--
+			g.recall()
+		}
+	case "[B", "OB":
+		if g.recalled < len(g.history) {
+			g.recalled++
+			g.recall()
+		}
+	}
+}
+
+// recall replaces the line with the recalled history.
+func (g *commandGuard) recall() {
+	g.line = g.line[:0]
+	if g.recalled < len(g.history) {
+		g.line = append(g.line, []rune(g.history[g.recalled])...)
+	}
+	g.cursor = len(g.line)
+}
+
+// submit records the command in the history and starts a new line.
+func (g *commandGuard) submit(command string) {
+	if len(command) != 0 {
+		g.history = append(g.history, command)
+		if len(g.history) > commandHistorySize {
+			g.history = g.history[len(g.history)-commandHistorySize:]
+		}
+	}
+	g.reset()
+}
+
+// reset starts a new line.
+func (g *commandGuard) reset() {
+	g.line = g.line[:0]
+	g.cursor = 0
+	g.recalled = len(g.history)
+}
+
+// inspect passes the input through the command guard if enabled, the users
+// are warned and the guarded command is logged for audit.
+func (t *TerminalSession) inspect(p []byte) []byte {
+	if t.guard == nil {
+		return p
+	}
+	t.l.Lock()
+	defer t.l.Unlock()
+	// the input of the file transfer is binary data.
+	if t.transfer != nil {
+		t.guard.reset()
+		return p
+	}
+	out, event := t.guard.filter(p)
+	if event == nil {
+		return out
+	}
+	guardedCommands.Add(event.action, 1)
+	log.Warnf("audit: terminal session %s, user: %s, command %s: %s, pattern: %s", t.id, t.user, event.action, event.command, event.pattern)
+	t.warn(event.message())
+	return out
+}
+
+// warn sends the warning to all clients. The caller must hold t.l.
+func (t *TerminalSession) warn(warning string) {
+	data, _ := json.Marshal(TerminalMessage{Op: "warning", Data: warning})
+	for client := range t.clients {
+		client.sender.send(data, 0)
+	}
+}
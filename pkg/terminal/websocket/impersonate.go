@@ -0,0 +1,61 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/forbearing/k8s/pod"
+	"github.com/forbearing/ratel-webterminal/pkg/args"
+	"github.com/forbearing/ratel-webterminal/pkg/policy"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/transport"
+)
+
+// newPodHandler returns the pod handler of the namespace for the request, it
+// impersonates the user of the request, see impersonate.
+func newPodHandler(r *http.Request, namespace string) (*pod.Handler, error) {
+	podHandler, err := pod.New(context.TODO(), args.GetKubeConfigFile(), namespace)
+	if err != nil {
+		return nil, err
+	}
+	if err = impersonate(podHandler, policy.UserFrom(r)); err != nil {
+		return nil, err
+	}
+	return podHandler, nil
+}
+
+// impersonate makes the requests of the pod handler to kube-apiserver as the
+// user and its groups if "--impersonate" is set, so they are authorized by
+// the RBAC of the user. The anonymous user is never impersonated.
+//
+// The clients of the handler share the same http client, its transport is
+// wrapped to impersonate the user. The rest config is set too, it's used by
+// the executor of exec and port forwarding.
+func impersonate(podHandler *pod.Handler, user *policy.User) error {
+	if !args.GetImpersonate() || user.Name == policy.AnonymousUser {
+		return nil
+	}
+	// kube-apiserver adds AuthenticatedGroup to the impersonated users.
+	config := rest.ImpersonationConfig{UserName: user.Name}
+	for _, group := range user.Groups {
+		if group != policy.AuthenticatedGroup {
+			config.Groups = append(config.Groups, group)
+		}
+	}
+	client := podHandler.RESTClient().Client
+	// the default client is shared by the process, it must not be changed.
+	if client == nil || client == http.DefaultClient {
+		return fmt.Errorf("can't impersonate user %s, the http client of kube-apiserver is not dedicated", user.Name)
+	}
+	rt := client.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	client.Transport = transport.NewImpersonatingRoundTripper(transport.ImpersonationConfig{
+		UserName: config.UserName,
+		Groups:   config.Groups,
+	}, rt)
+	podHandler.RESTConfig().Impersonate = config
+	return nil
+}
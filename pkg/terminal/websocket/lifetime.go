@@ -0,0 +1,84 @@
+package websocket
+
+import (
+	"expvar"
+	"fmt"
+	"time"
+
+	"github.com/forbearing/ratel-webterminal/pkg/args"
+)
+
+const (
+	closeReasonExited       = "process exited"
+	closeReasonDisconnected = "client disconnected"
+	closeReasonIdle         = "idle timeout"
+	closeReasonMaxDuration  = "max duration reached"
+
+	// lifetimeWarning is how long before closing the session the clients are
+	// warned.
+	lifetimeWarning = time.Minute
+	// lifetimeCheckInterval is the interval of checking the idle timeout and
+	// max duration.
+	lifetimeCheckInterval = time.Second
+)
+
+// closedSessions counts the closed terminal sessions by close reason, it is
+// exported by "/debug/vars".
+var closedSessions = expvar.NewMap("terminal_sessions_closed_total")
+
+func init() {
+	expvar.Publish("terminal_sessions_active", expvar.Func(func() interface{} {
+		sessionsMu.RLock()
+		defer sessionsMu.RUnlock()
+		return len(sessions)
+	}))
+}
+
+// watchLifetime closes the session if there is no input for
+// "--session-idle-timeout", or it has lived for "--session-max-duration". The
+// clients are warned lifetimeWarning before closing.
+func (t *TerminalSession) watchLifetime() {
+	idleTimeout := args.GetSessionIdleTimeout()
+	maxDuration := args.GetSessionMaxDuration()
+	if idleTimeout <= 0 && maxDuration <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(lifetimeCheckInterval)
+	defer ticker.Stop()
+	var warned time.Time
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.doneCh:
+			return
+		}
+
+		// the earlier deadline takes effect.
+		t.l.Lock()
+		var deadline time.Time
+		var reason string
+		if maxDuration > 0 {
+			deadline, reason = t.startedAt.Add(maxDuration), closeReasonMaxDuration
+		}
+		if idle := t.inputAt.Add(idleTimeout); idleTimeout > 0 && (deadline.IsZero() || idle.Before(deadline)) {
+			deadline, reason = idle, closeReasonIdle
+		}
+		remaining := time.Until(deadline)
+		// the idle deadline moves on every input, warn again for the new deadline.
+		if remaining > 0 && remaining <= lifetimeWarning && !deadline.Equal(warned) {
+			warned = deadline
+			notice := fmt.Sprintf("the session will be closed in %s: %s", remaining.Round(time.Second), reason)
+			if reason == closeReasonIdle {
+				notice += ", type anything to keep it"
+			}
+			t.notify(nil, notice)
+		}
+		t.l.Unlock()
+
+		if remaining <= 0 {
+			t.closeWithReason(reason)
+			return
+		}
+	}
+}
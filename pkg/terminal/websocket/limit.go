@@ -0,0 +1,203 @@
+package websocket
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/forbearing/ratel-webterminal/pkg/args"
+	"github.com/forbearing/ratel-webterminal/pkg/errors"
+	"github.com/forbearing/ratel-webterminal/pkg/policy"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterIdleTimeout is how long the rate limiter of a client is kept
+// after its last session.
+const rateLimiterIdleTimeout = 10 * time.Minute
+
+// rejectedSessions counts the sessions rejected by the limits by the reason,
+// it is exported by "/debug/vars".
+var rejectedSessions = expvar.NewMap("sessions_rejected_total")
+
+// limits counts the running shells and log followers, and limits the rate of
+// new sessions of every client. It protects the kubelet and apiserver from
+// the scripts opening lots of sessions.
+var limits = &sessionLimits{
+	rates:      make(map[string]*clientRate),
+	userShells: make(map[string]int),
+	podShells:  make(map[string]int),
+}
+
+type sessionLimits struct {
+	l          sync.Mutex
+	rates      map[string]*clientRate
+	shells     int
+	userShells map[string]int
+	podShells  map[string]int
+	followers  int
+}
+
+type clientRate struct {
+	limiter *rate.Limiter
+	seenAt  time.Time
+}
+
+// InitLimits starts to clean up the idle rate limiters if "--session-rate"
+// is set.
+func InitLimits() {
+	if args.GetSessionRate() <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			limits.cleanup()
+		}
+	}()
+}
+
+// clientKey returns the user of the request, or the IP of the client if the
+// user is not authenticated, the limits of per user are applied to it.
+func clientKey(r *http.Request) string {
+	if user := policy.UserFrom(r); user.Name != policy.AnonymousUser {
+		return "user:" + user.Name
+	}
+	return "ip:" + policy.ClientIP(r)
+}
+
+// allowRequest checks "--session-rate" of the client for the requests which
+// don't create shells or follow logs, such as the file APIs, port forwarding
+// and creating the proxy. Otherwise 429 is written to w.
+func allowRequest(w http.ResponseWriter, r *http.Request) bool {
+	return limits.allow(w, clientKey(r))
+}
+
+// acquireShell checks the limits before the shell of target is created, target
+// is "namespace/pod" or "nodes/node". The returned release must be called after
+// the shell exits. Otherwise 429 is written to w.
+func acquireShell(w http.ResponseWriter, r *http.Request, target string) (func(), bool) {
+	key := clientKey(r)
+	if !limits.allow(w, key) {
+		return nil, false
+	}
+	limits.l.Lock()
+	defer limits.l.Unlock()
+	var reason string
+	switch {
+	case exceeds(limits.shells, args.GetMaxShells()):
+		reason = "max shells"
+	case exceeds(limits.userShells[key], args.GetMaxShellsPerUser()):
+		reason = "max shells per user"
+	case exceeds(limits.podShells[target], args.GetMaxShellsPerPod()):
+		reason = "max shells per pod"
+	}
+	if len(reason) != 0 {
+		reject(w, key, reason, fmt.Sprintf("too many shells, %s exceeded", reason), 0)
+		return nil, false
+	}
+	limits.shells++
+	limits.userShells[key]++
+	limits.podShells[target]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			limits.l.Lock()
+			defer limits.l.Unlock()
+			limits.shells--
+			if limits.userShells[key]--; limits.userShells[key] == 0 {
+				delete(limits.userShells, key)
+			}
+			if limits.podShells[target]--; limits.podShells[target] == 0 {
+				delete(limits.podShells, target)
+			}
+		})
+	}, true
+}
+
+// acquireLogs checks the limits before the logs are streamed, only the logs
+// followed are counted by "--max-log-followers". The returned release must be
+// called after the logs end. Otherwise 429 is written to w.
+func acquireLogs(w http.ResponseWriter, r *http.Request, follow bool) (func(), bool) {
+	key := clientKey(r)
+	if !limits.allow(w, key) {
+		return nil, false
+	}
+	if !follow {
+		return func() {}, true
+	}
+	limits.l.Lock()
+	defer limits.l.Unlock()
+	if exceeds(limits.followers, args.GetMaxLogFollowers()) {
+		reject(w, key, "max log followers", "too many log followers, max log followers exceeded", 0)
+		return nil, false
+	}
+	limits.followers++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			limits.l.Lock()
+			defer limits.l.Unlock()
+			limits.followers--
+		})
+	}, true
+}
+
+// exceeds returns whether a new session exceeds the max, 0 means unlimited.
+func exceeds(count, max int) bool {
+	return max > 0 && count >= max
+}
+
+// allow checks "--session-rate" of the client, otherwise 429 is written to w
+// with the Retry-After header.
+func (s *sessionLimits) allow(w http.ResponseWriter, key string) bool {
+	if args.GetSessionRate() <= 0 {
+		return true
+	}
+	s.l.Lock()
+	c, ok := s.rates[key]
+	if !ok {
+		c = &clientRate{limiter: rate.NewLimiter(rate.Limit(args.GetSessionRate()), args.GetSessionBurst())}
+		s.rates[key] = c
+	}
+	c.seenAt = time.Now()
+	s.l.Unlock()
+
+	reservation := c.limiter.Reserve()
+	delay := reservation.Delay()
+	if delay == 0 {
+		return true
+	}
+	reservation.Cancel()
+	reject(w, key, "session rate", "too many sessions, retry later", delay)
+	return false
+}
+
+// cleanup removes the rate limiters of the idle clients.
+func (s *sessionLimits) cleanup() {
+	s.l.Lock()
+	defer s.l.Unlock()
+	for key, c := range s.rates {
+		if time.Since(c.seenAt) > rateLimiterIdleTimeout {
+			delete(s.rates, key)
+		}
+	}
+}
+
+// reject writes 429 to w before the websocket is upgraded, the Retry-After
+// header is set if retryAfter is not 0.
+func reject(w http.ResponseWriter, key, reason, msg string, retryAfter time.Duration) {
+	rejectedSessions.Add(reason, 1)
+	log.Warnf("reject session of %s: %s", key, reason)
+	code := errors.CodeTooManySessions
+	if retryAfter != 0 {
+		code = errors.CodeSessionRateLimited
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+	errors.WriteErrorWithMsg(w, http.StatusTooManyRequests, code, msg)
+}
@@ -0,0 +1,55 @@
+package websocket
+
+import (
+	"bytes"
+)
+
+// lineWriter splits the written chunks into complete lines, and calls emit with
+// every line without the trailing newline.
+//
+// The incomplete line is buffered until the newline is written, the buffer is
+// bounded by maxLogLineSize, a longer line is emitted as multiple lines.
+// The line passed to emit is only valid until emit returns.
+type lineWriter struct {
+	buf  []byte
+	emit func(line []byte) error
+}
+
+func newLineWriter(emit func(line []byte) error) *lineWriter {
+	return &lineWriter{emit: emit}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i == -1 {
+			w.buf = append(w.buf, p...)
+			break
+		}
+		w.buf = append(w.buf, p[:i]...)
+		p = p[i+1:]
+		if err := w.emit(bytes.TrimSuffix(w.buf, []byte("\r"))); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[:0]
+	}
+
+	for len(w.buf) >= maxLogLineSize {
+		if err := w.emit(w.buf[:maxLogLineSize]); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[maxLogLineSize:]...)
+	}
+	return n, nil
+}
+
+// Flush emits the buffered incomplete line.
+func (w *lineWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	err := w.emit(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
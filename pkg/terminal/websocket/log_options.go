@@ -0,0 +1,83 @@
+package websocket
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/forbearing/ratel-webterminal/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// parseLogOptions parses the query parameters of logs request to PodLogOptions.
+//
+// PARAMETER     TYPE      DESCRIPTION
+// ---------------------------------------------------------------------
+// tail          int       number of lines from the end of the logs to show
+// previous      bool      show the logs of the previous terminated container
+// sinceSeconds  int       show the logs newer than a relative duration
+// sinceTime     RFC3339   show the logs after a specific time
+// timestamps    bool      prefix each line with RFC3339 timestamp
+// limitBytes    int       max number of bytes of logs to show
+// follow        bool      stream new logs, default is true
+//
+// If any parameter is invalid, the error code and message is returned.
+func parseLogOptions(query url.Values) (corev1.PodLogOptions, errors.ResponseCode, error) {
+	logOptions := corev1.PodLogOptions{Follow: true}
+
+	if tail := query.Get("tail"); len(tail) != 0 {
+		tailLines, err := strconv.ParseInt(tail, 10, 64)
+		if err != nil || tailLines < 0 {
+			return logOptions, errors.CodeInvalidTailLines, fmt.Errorf("%s: %q", errors.CodeInvalidTailLines.Msg(), tail)
+		}
+		logOptions.TailLines = &tailLines
+	}
+	if since := query.Get("sinceSeconds"); len(since) != 0 {
+		sinceSeconds, err := strconv.ParseInt(since, 10, 64)
+		if err != nil || sinceSeconds <= 0 {
+			return logOptions, errors.CodeInvalidSinceSeconds, fmt.Errorf("%s: %q", errors.CodeInvalidSinceSeconds.Msg(), since)
+		}
+		logOptions.SinceSeconds = &sinceSeconds
+	}
+	if since := query.Get("sinceTime"); len(since) != 0 {
+		if logOptions.SinceSeconds != nil {
+			return logOptions, errors.CodeConflictSince, fmt.Errorf("%s", errors.CodeConflictSince.Msg())
+		}
+		sinceTime, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return logOptions, errors.CodeInvalidSinceTime, fmt.Errorf("%s: %q", errors.CodeInvalidSinceTime.Msg(), since)
+		}
+		logOptions.SinceTime = &metav1.Time{Time: sinceTime}
+	}
+	if limit := query.Get("limitBytes"); len(limit) != 0 {
+		limitBytes, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || limitBytes <= 0 {
+			return logOptions, errors.CodeInvalidLimitBytes, fmt.Errorf("%s: %q", errors.CodeInvalidLimitBytes.Msg(), limit)
+		}
+		logOptions.LimitBytes = &limitBytes
+	}
+
+	for _, param := range []struct {
+		name  string
+		code  errors.ResponseCode
+		value *bool
+	}{
+		{"previous", errors.CodeInvalidPrevious, &logOptions.Previous},
+		{"timestamps", errors.CodeInvalidTimestamps, &logOptions.Timestamps},
+		{"follow", errors.CodeInvalidFollow, &logOptions.Follow},
+	} {
+		value := query.Get(param.name)
+		if len(value) == 0 {
+			continue
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return logOptions, param.code, fmt.Errorf("%s: %q", param.code.Msg(), value)
+		}
+		*param.value = b
+	}
+
+	return logOptions, errors.CodeSuccess, nil
+}
@@ -1,23 +1,215 @@
 package websocket
 
 import (
+	"context"
+	"encoding/json"
+	"io"
 	"net/http"
+	"strings"
+	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/forbearing/k8s/pod"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
 )
 
-// Write will writes message by call websocket.WriteMessage.
+const (
+	// maxLogLineSize is the max size of one log line, the longer line is split
+	// into multiple lines.
+	maxLogLineSize = 64 * 1024
+	// maxBatchLines and maxBatchBytes limit the size of one LogMessage, the
+	// batch is sent when either is reached.
+	maxBatchLines = 500
+	maxBatchBytes = 64 * 1024
+	// batchInterval is the max duration a log line waits in the batch.
+	batchInterval = 100 * time.Millisecond
+)
+
+// Write splits p into complete lines and sends them in batches, the incomplete
+// line is buffered until the newline is written. It implements io.Writer.
 func (l *Logger) Write(p []byte) (int, error) {
-	var err error
-	if err = l.conn.WriteMessage(websocket.TextMessage, p); err != nil {
-		return 0, err
+	l.l.Lock()
+	defer l.l.Unlock()
+	return l.partial.Write(p)
+}
+
+// WriteLine sends a complete log line in batches.
+func (l *Logger) WriteLine(line LogLine) error {
+	l.l.Lock()
+	defer l.l.Unlock()
+	return l.appendLine(line)
+}
+
+// WriteError sends an error message to be shown to the user immediately,
+// the error message is never filtered.
+func (l *Logger) WriteError(msg string) error {
+	l.l.Lock()
+	defer l.l.Unlock()
+	if err := l.flush(); err != nil {
+		return err
+	}
+	return l.writeMessage(&LogMessage{Op: "error", Data: msg})
+}
+
+// appendLine parses the timestamp, applies the filter and appends the line
+// to the batch. The caller must hold l.l.
+func (l *Logger) appendLine(line LogLine) error {
+	if l.err != nil {
+		return l.err
+	}
+	if l.timestamps && len(line.Timestamp) == 0 {
+		if timestamp, data, ok := splitTimestamp(line.Data); ok {
+			line.Timestamp, line.Data = timestamp, data
+		}
+	}
+	// the secrets are masked before the filter, so they are never highlighted.
+	if l.redactor != nil {
+		line.Data = string(l.redactor.redactLine([]byte(line.Data)))
+	}
+	if l.filter != nil {
+		highlights, ok := l.filter.apply([]byte(line.Data))
+		// the line is dropped by the filter.
+		if !ok {
+			return nil
+		}
+		line.Highlights = highlights
+	}
+
+	l.batch = append(l.batch, line)
+	l.batchBytes += len(line.Source) + len(line.Timestamp) + len(line.Data)
+	if len(l.batch) >= maxBatchLines || l.batchBytes >= maxBatchBytes {
+		return l.flush()
+	}
+	return nil
+}
+
+// flush sends the batched lines. The caller must hold l.l.
+func (l *Logger) flush() error {
+	if l.err != nil || len(l.batch) == 0 {
+		return l.err
+	}
+	err := l.writeMessage(&LogMessage{Op: "lines", Lines: l.batch})
+	l.batch = l.batch[:0]
+	l.batchBytes = 0
+	return err
+}
+
+// writeMessage queues the LogMessage to be sent, once it failed, all the
+// following writes fail. The caller must hold l.l.
+func (l *Logger) writeMessage(msg *LogMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err = l.sender.send(data, len(msg.Lines)); err != nil {
+		l.err = err
 	}
-	return len(p), nil
+	return err
 }
 
-// Close will close websocket connection.
+// flushLoop sends the batched lines periodically, so a line never waits in the
+// batch longer than batchInterval.
+func (l *Logger) flushLoop() {
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.l.Lock()
+			l.flush()
+			l.l.Unlock()
+		case <-l.stopCh:
+			return
+		}
+	}
+}
+
+// SetTimestamps sets whether to parse the RFC3339 timestamp at the beginning
+// of every line, it should be the same as PodLogOptions.Timestamps.
+func (l *Logger) SetTimestamps(timestamps bool) {
+	l.l.Lock()
+	defer l.l.Unlock()
+	l.timestamps = timestamps
+}
+
+// SetFilter replaces the log filter, nil means no filter.
+func (l *Logger) SetFilter(filter *logFilter) {
+	l.l.Lock()
+	defer l.l.Unlock()
+	l.filter = filter
+}
+
+// Done returns a channel which is closed after the client closed the websocket.
+func (l *Logger) Done() <-chan struct{} {
+	return l.doneCh
+}
+
+// readLoop reads the LogControlMessage from the client until the websocket is
+// closed, the invalid messages are ignored.
+func (l *Logger) readLoop() {
+	defer close(l.doneCh)
+	for {
+		_, message, err := readMessage(l.conn)
+		if err != nil {
+			return
+		}
+		var msg LogControlMessage
+		if err := json.Unmarshal(message, &msg); err != nil {
+			log.Debugf("ignore invalid log control message: %s", message)
+			continue
+		}
+		switch msg.Op {
+		case "filter":
+			filter, err := newLogFilter(msg.Include, msg.Exclude, msg.Level, msg.LevelField)
+			if err != nil {
+				log.Warn("change log filter error: ", err)
+				l.WriteError("change log filter error: " + err.Error())
+				continue
+			}
+			log.Debugf("change log filter: include: %q, exclude: %q, level: %q", msg.Include, msg.Exclude, msg.Level)
+			l.SetFilter(filter)
+		default:
+			log.Debugf("unknown log control message type '%s'", msg.Op)
+		}
+	}
+}
+
+// Close sends the buffered lines and closes websocket connection.
 func (l *Logger) Close() error {
-	return l.conn.Close()
+	close(l.stopCh)
+	l.l.Lock()
+	l.partial.Flush()
+	l.flush()
+	l.l.Unlock()
+	return l.sender.close()
+}
+
+// streamLogs copies the logs stream of the pod to the writer.
+//
+// Unlike pod.Handler.Log, it doesn't require the pod to be ready, so the logs
+// of the previous terminated container in a crashing pod can be read.
+func streamLogs(ctx context.Context, podHandler *pod.Handler, namespace, podName string, logOptions *corev1.PodLogOptions, writer io.Writer) error {
+	readCloser, err := podHandler.Clientset().CoreV1().Pods(namespace).GetLogs(podName, logOptions).Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer readCloser.Close()
+
+	_, err = io.Copy(writer, readCloser)
+	return err
+}
+
+// splitTimestamp splits the RFC3339 timestamp added by PodLogOptions.Timestamps
+// from the line.
+func splitTimestamp(line string) (timestamp, data string, ok bool) {
+	i := strings.IndexByte(line, ' ')
+	if i == -1 {
+		return "", line, false
+	}
+	if _, err := time.Parse(time.RFC3339Nano, line[:i]); err != nil {
+		return "", line, false
+	}
+	return line[:i], line[i+1:], true
 }
 
 // NewLogger will creates a websocket logger.
@@ -26,7 +218,20 @@ func NewLogger(w http.ResponseWriter, r *http.Request, respHeader http.Header) (
 	if err != nil {
 		return nil, err
 	}
-	return &Logger{
-		conn: conn,
-	}, nil
+	logger := &Logger{
+		conn:     conn,
+		redactor: newRedactor(),
+		doneCh:   make(chan struct{}),
+		stopCh:   make(chan struct{}),
+	}
+	logger.sender = newSender(conn, func(n int) []byte {
+		data, _ := json.Marshal(&LogMessage{Op: "skipped", Skipped: n})
+		return data
+	})
+	logger.partial = newLineWriter(func(line []byte) error {
+		return logger.appendLine(LogLine{Data: string(line)})
+	})
+	go logger.readLoop()
+	go logger.flushLoop()
+	return logger, nil
 }
@@ -0,0 +1,159 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/forbearing/k8s/pod"
+	"github.com/forbearing/ratel-webterminal/pkg/args"
+	"github.com/forbearing/ratel-webterminal/pkg/janitor"
+	"github.com/forbearing/ratel-webterminal/pkg/policy"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// nodeShellContainer is the container name of the node shell pod.
+	nodeShellContainer = "shell"
+	// podRunningTimeout is the max duration to wait for the pod created by
+	// ratel-webterminal running.
+	podRunningTimeout = 2 * time.Minute
+)
+
+// nodeShellCommand enters all namespaces of the host PID 1 and starts a login shell.
+var nodeShellCommand = []string{
+	"nsenter", "--target", "1", "--mount", "--uts", "--ipc", "--net", "--pid", "--",
+	"sh", "-c", "command -v bash >/dev/null && exec bash -l || exec sh -l",
+}
+
+// HandleWsNodeShell handle "/ws/nodes/{node}/shell" connections.
+//
+// It schedules a short-lived privileged pod with hostPID and hostNetwork on the
+// node, then execs nsenter into the host namespaces, the pod will be deleted
+// when the session ends. If ratel-webterminal crashed before that, the pod will
+// be deleted by the janitor.
+// Node shell is disabled by default, it must be enabled by "--enable-node-shell",
+// and the user must be allowed by the "node-shell" action of the access policy.
+func HandleWsNodeShell(w http.ResponseWriter, r *http.Request) {
+	nodeName := mux.Vars(r)["node"]
+	if !args.GetEnableNodeShell() {
+		log.Warnf("node shell is disabled, reject node: %s", nodeName)
+		http.Error(w, "node shell is disabled", http.StatusForbidden)
+		return
+	}
+	user := policy.UserFrom(r)
+	if err := policy.CheckNode(user, nodeName); err != nil {
+		writeDenied(w, user, err)
+		return
+	}
+	log.Infof("node shell: %s", nodeName)
+
+	namespace := janitor.Namespace()
+	if len(namespace) == 0 {
+		namespace = metav1.NamespaceDefault
+	}
+	podHandler, err := newPodHandler(r, namespace)
+	if err != nil {
+		log.Error("get pod handler error: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if _, err = podHandler.Clientset().CoreV1().Nodes().Get(context.TODO(), nodeName, metav1.GetOptions{}); err != nil {
+		log.Error("get node error: ", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	release, ok := acquireShell(w, r, "nodes/"+nodeName)
+	if !ok {
+		return
+	}
+	defer release()
+
+	terminalSession, err := NewTerminalSession(w, r, nil)
+	if err != nil {
+		log.Error("create terminal session error: ", err)
+		return
+	}
+	defer func() {
+		log.Info("close node shell session")
+		terminalSession.Close()
+	}()
+
+	podObj := newNodeShellPod(namespace, nodeName)
+	janitor.Track(podObj.Namespace, podObj.Name)
+	defer janitor.Release(podObj.Namespace, podObj.Name)
+
+	terminalSession.Write([]byte(fmt.Sprintf("creating node shell pod %s on node %s...\r\n", podObj.Name, nodeName)))
+	if _, err = podHandler.Create(podObj); err != nil {
+		log.Error("create node shell pod error: ", err)
+		terminalSession.Write([]byte(fmt.Sprintf("create node shell pod error: %s\r\n", err.Error())))
+		return
+	}
+	if err = waitForPodRunning(r.Context(), podHandler, podObj.Namespace, podObj.Name); err != nil {
+		log.Error("wait for node shell pod error: ", err)
+		terminalSession.Write([]byte(fmt.Sprintf("wait for node shell pod error: %s\r\n", err.Error())))
+		return
+	}
+
+	if err = podHandler.ExecuteWithPty(podObj.Name, nodeShellContainer, nodeShellCommand, terminalSession); err != nil {
+		log.Error("create node shell error: ", err)
+	}
+}
+
+// newNodeShellPod returns a privileged pod which shares the host PID, network
+// and IPC namespace, scheduled to the given node.
+func newNodeShellPod(namespace, nodeName string) *corev1.Pod {
+	privileged := true
+	gracePeriod := int64(0)
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            fmt.Sprintf("node-shell-%s", utilrand.String(8)),
+			Namespace:       namespace,
+			Labels:          janitor.Labels(),
+			OwnerReferences: janitor.OwnerReferences(namespace),
+		},
+		Spec: corev1.PodSpec{
+			NodeName:                      nodeName,
+			HostPID:                       true,
+			HostNetwork:                   true,
+			HostIPC:                       true,
+			RestartPolicy:                 corev1.RestartPolicyNever,
+			TerminationGracePeriodSeconds: &gracePeriod,
+			// the node shell pod should be able to run on any node, even the
+			// node is tainted.
+			Tolerations: []corev1.Toleration{{Operator: corev1.TolerationOpExists}},
+			Containers: []corev1.Container{{
+				Name:            nodeShellContainer,
+				Image:           args.GetDebugImage(),
+				ImagePullPolicy: corev1.PullIfNotPresent,
+				Command:         []string{"sleep", "2147483647"},
+				SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+			}},
+		},
+	}
+}
+
+// waitForPodRunning waits until the pod is running.
+// It returns error if the pod completed, timeout or ctx is done, e.g. the
+// browser is closed.
+func waitForPodRunning(ctx context.Context, podHandler *pod.Handler, namespace, name string) error {
+	return wait.PollImmediateWithContext(ctx, time.Second, podRunningTimeout, func(ctx context.Context) (bool, error) {
+		podObj, err := podHandler.Clientset().CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		switch podObj.Status.Phase {
+		case corev1.PodRunning:
+			return true, nil
+		case corev1.PodSucceeded, corev1.PodFailed:
+			return false, fmt.Errorf("pod %s/%s completed: %s", namespace, name, podObj.Status.Phase)
+		}
+		return false, nil
+	})
+}
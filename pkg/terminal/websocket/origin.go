@@ -0,0 +1,188 @@
+package websocket
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/forbearing/ratel-webterminal/pkg/args"
+	"github.com/forbearing/ratel-webterminal/pkg/policy"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// csrfCookie is the HttpOnly cookie of the browser binding, the CSRF
+	// tokens are signed for it. The pages read the token from the meta tag
+	// csrfMeta and send it back as the csrfParam query parameter of the
+	// websockets.
+	csrfCookie = "ratel_csrf"
+	csrfMeta   = "ratel-csrf"
+	csrfParam  = "csrf"
+	// csrfTokenTTL is how long the token of a page load is valid, the page
+	// must be reloaded to open new websockets after that.
+	csrfTokenTTL = 12 * time.Hour
+)
+
+// csrfKey is the key to sign the CSRF tokens, it is generated at startup, so
+// the tokens of the pages loaded before restarting are invalid.
+var csrfKey []byte
+
+// allowedOrigins are the lowercase patterns of "--allowed-origin".
+var allowedOrigins []string
+
+// InitOriginCheck validates "--allowed-origin", only the same origin is
+// allowed if none is set. It also generates the key of the CSRF tokens.
+func InitOriginCheck() {
+	for _, pattern := range args.GetAllowedOrigins() {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "/"))
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatalf("invalid allowed origin '%s': %s", pattern, err.Error())
+		}
+		allowedOrigins = append(allowedOrigins, pattern)
+	}
+	csrfKey = make([]byte, 32)
+	if _, err := rand.Read(csrfKey); err != nil {
+		log.Fatal("generate csrf key error: ", err)
+	}
+	if len(allowedOrigins) != 0 {
+		log.Infof("allowed origins of websockets: %s", strings.Join(allowedOrigins, ", "))
+	}
+}
+
+// checkOrigin is the CheckOrigin of the upgrader, the rejected upgrade is
+// responded with 403 by the upgrader.
+func checkOrigin(r *http.Request) bool {
+	if err := verifyOrigin(r); err != nil {
+		log.Warnf("reject websocket %s from %s, origin: %s, user: %s: %s",
+			r.URL.Path, r.RemoteAddr, r.Header.Get("Origin"), policy.UserFrom(r).Name, err.Error())
+		return false
+	}
+	return true
+}
+
+// verifyOrigin allows the requests without the Origin header, they are not
+// sent by browsers so can't be forged by other sites. The browsers must send
+// the CSRF token issued with the pages, unless the origin is listed in
+// "--allowed-origin" explicitly, since the pages of other origins can't read
+// the token. "*" allows all origins but still requires the token, which is
+// for the pages opened by different host names.
+func verifyOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || len(u.Host) == 0 {
+		return fmt.Errorf("invalid origin")
+	}
+	origin = strings.ToLower(u.Scheme + "://" + u.Host)
+	for _, pattern := range allowedOrigins {
+		if pattern == "*" {
+			return verifyCSRF(r)
+		}
+		if matched, _ := path.Match(pattern, origin); matched {
+			return nil
+		}
+	}
+	if !strings.EqualFold(u.Host, r.Host) {
+		return fmt.Errorf("cross origin not allowed")
+	}
+	return verifyCSRF(r)
+}
+
+// verifyCSRF checks the token of the query parameter against the browser
+// binding in the cookie, the token must be signed for the binding and not
+// expired.
+func verifyCSRF(r *http.Request) error {
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil || len(cookie.Value) == 0 {
+		return fmt.Errorf("missing csrf cookie")
+	}
+	token := r.URL.Query().Get(csrfParam)
+	if len(token) == 0 {
+		return fmt.Errorf("missing csrf token")
+	}
+	i := strings.IndexByte(token, '.')
+	if i == -1 {
+		return fmt.Errorf("invalid csrf token")
+	}
+	expires, err := strconv.ParseInt(token[:i], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid csrf token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(signCSRFToken(cookie.Value, expires))) != 1 {
+		return fmt.Errorf("invalid csrf token")
+	}
+	if time.Now().Unix() > expires {
+		return fmt.Errorf("csrf token expired, reload the page")
+	}
+	return nil
+}
+
+// signCSRFToken returns the token of the browser binding which expires at the
+// unix time expires, in the format "<expires>.<signature>".
+func signCSRFToken(binding string, expires int64) string {
+	exp := strconv.FormatInt(expires, 10)
+	mac := hmac.New(sha256.New, csrfKey)
+	mac.Write([]byte(binding + "." + exp))
+	return exp + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issueCSRFToken returns a new token for the page being served. The browser
+// binding cookie is set if the browser doesn't have one, it is HttpOnly so
+// the scripts, including the pages of "/proxy", can't read it. The token is
+// only embedded in the page, the pages of other origins can't read it.
+func issueCSRFToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	binding := ""
+	if cookie, err := r.Cookie(csrfCookie); err == nil && len(cookie.Value) != 0 {
+		binding = cookie.Value
+	} else {
+		id, err := genRandomID()
+		if err != nil {
+			return "", err
+		}
+		binding = id
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookie,
+			Value:    binding,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+	return signCSRFToken(binding, time.Now().Add(csrfTokenTTL).Unix()), nil
+}
+
+// servePage serves the html page with the CSRF token embedded as the meta tag
+// csrfMeta, the page is never cached since the token is issued per page load.
+func servePage(w http.ResponseWriter, r *http.Request, name string) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		log.Errorf("read page %s error: %s", name, err.Error())
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	token, err := issueCSRFToken(w, r)
+	if err != nil {
+		log.Error("issue csrf token error: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	meta := fmt.Sprintf("<head>\n\t<meta name=%q content=%q>", csrfMeta, token)
+	data = bytes.Replace(data, []byte("<head>"), []byte(meta), 1)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(data)
+}
@@ -0,0 +1,287 @@
+package websocket
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/forbearing/k8s/pod"
+	"github.com/forbearing/ratel-webterminal/pkg/errors"
+	"github.com/forbearing/ratel-webterminal/pkg/policy"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+const (
+	// portForwardBufferSize is the size of the data read from the pod and sent
+	// in a websocket message.
+	portForwardBufferSize = 32 * 1024
+	// portForwardErrorTimeout is how long to wait for the error of the pod
+	// after the connection was closed.
+	portForwardErrorTimeout = time.Second
+)
+
+// HandleWsPortForward handle "/ws/{namespace}/{pod}/portforward/{port}" connections.
+//
+// It tunnels a TCP connection to the port of the pod through the websocket by
+// "pods/portforward" subresource, just like "kubectl port-forward" for a single
+// connection. The data is sent as binary messages both ways. The websocket is
+// closed when the connection is closed by the pod, with the error as the reason
+// if any.
+func HandleWsPortForward(w http.ResponseWriter, r *http.Request) {
+	if !allowRequest(w, r) {
+		return
+	}
+	pathParams := mux.Vars(r)
+	namespace := pathParams["namespace"]
+	podName := pathParams["pod"]
+	port, err := parsePort(pathParams["port"])
+	if err != nil {
+		errors.WriteErrorWithMsg(w, http.StatusBadRequest, errors.CodeInvalidPort, err.Error())
+		return
+	}
+	if !checkNamespaceAccess(w, r, policy.ActionExec, namespace) {
+		return
+	}
+	podHandler, podObj, ok := getPortForwardPod(w, r, namespace, podName)
+	if !ok || !checkPodAccess(w, r, policy.ActionExec, podObj, "") {
+		return
+	}
+	log.Infof("port forward pod: %s/%s, port: %d", namespace, podName, port)
+
+	forwarder, err := newPortForwarder(podHandler, namespace, podName, port)
+	if err != nil {
+		log.Error("port forward error: ", err)
+		errors.WriteErrorWithMsg(w, http.StatusBadGateway, errors.CodePortForwardFailed, err.Error())
+		return
+	}
+	defer forwarder.Close()
+	fconn, err := forwarder.dial()
+	if err != nil {
+		log.Error("port forward error: ", err)
+		errors.WriteErrorWithMsg(w, http.StatusBadGateway, errors.CodePortForwardFailed, err.Error())
+		return
+	}
+	defer fconn.Close()
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Error("upgrade websocket error: ", err)
+		return
+	}
+	s := newSender(conn, nil)
+
+	// websocket -> pod
+	go func() {
+		defer fconn.Close()
+		for {
+			messageType, data, err := readMessage(conn)
+			if err != nil {
+				return
+			}
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+			if _, err := fconn.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+
+	// pod -> websocket
+	buf := make([]byte, portForwardBufferSize)
+	for {
+		n, err := fconn.Read(buf)
+		if n > 0 {
+			if s.sendBinaryWait(append([]byte(nil), buf[:n]...)) != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	reason := "connection closed"
+	if err := fconn.remoteError(); err != nil {
+		reason = err.Error()
+	}
+	log.Infof("port forward pod: %s/%s, port: %d closed: %s", namespace, podName, port, reason)
+	s.closeWithReason(reason)
+}
+
+// parsePort parses the port of the path parameter.
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// getPortForwardPod returns the pod handler and the pod if the pod exists,
+// otherwise the error is written to w.
+func getPortForwardPod(w http.ResponseWriter, r *http.Request, namespace, podName string) (*pod.Handler, *corev1.Pod, bool) {
+	podHandler, err := newPodHandler(r, namespace)
+	if err != nil {
+		log.Error("get pod handler error: ", err)
+		errors.WriteError(w, http.StatusInternalServerError, errors.CodeInternalError)
+		return nil, nil, false
+	}
+	podObj, err := getPod(podHandler, namespace, podName)
+	if err != nil {
+		log.Error("get pod error: ", err)
+		errors.WriteErrorWithMsg(w, http.StatusNotFound, errors.CodePodNotFound, err.Error())
+		return nil, nil, false
+	}
+	return podHandler, podObj, true
+}
+
+// portForwarder opens TCP connections to a port of the pod by "pods/portforward"
+// subresource. All the connections share one SPDY connection, each of them is
+// a pair of error and data streams, the same as "kubectl port-forward".
+type portForwarder struct {
+	namespace string
+	podName   string
+	port      int
+	conn      httpstream.Connection
+	requestID int32
+}
+
+func newPortForwarder(podHandler *pod.Handler, namespace, podName string, port int) (*portForwarder, error) {
+	transport, upgrader, err := spdy.RoundTripperFor(podHandler.RESTConfig())
+	if err != nil {
+		return nil, err
+	}
+	req := podHandler.RESTClient().Post().
+		Namespace(namespace).
+		Resource("pods").
+		Name(podName).
+		SubResource("portforward")
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, req.URL())
+	conn, protocol, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+	if err != nil {
+		return nil, fmt.Errorf("upgrade connection error: %w", err)
+	}
+	if protocol != portforward.PortForwardProtocolV1Name {
+		conn.Close()
+		return nil, fmt.Errorf("unsupported port forward protocol %q", protocol)
+	}
+	return &portForwarder{namespace: namespace, podName: podName, port: port, conn: conn}, nil
+}
+
+// dial opens a new TCP connection to the port of the pod.
+func (f *portForwarder) dial() (*forwardedConn, error) {
+	requestID := strconv.Itoa(int(atomic.AddInt32(&f.requestID, 1)))
+	headers := http.Header{}
+	headers.Set(corev1.StreamType, corev1.StreamTypeError)
+	headers.Set(corev1.PortHeader, strconv.Itoa(f.port))
+	headers.Set(corev1.PortForwardRequestIDHeader, requestID)
+	errorStream, err := f.conn.CreateStream(headers)
+	if err != nil {
+		return nil, fmt.Errorf("create error stream error: %w", err)
+	}
+	// the error stream is only read.
+	errorStream.Close()
+
+	headers.Set(corev1.StreamType, corev1.StreamTypeData)
+	dataStream, err := f.conn.CreateStream(headers)
+	if err != nil {
+		f.conn.RemoveStreams(errorStream)
+		return nil, fmt.Errorf("create data stream error: %w", err)
+	}
+
+	c := &forwardedConn{
+		forwarder:   f,
+		errorStream: errorStream,
+		dataStream:  dataStream,
+		errCh:       make(chan error, 1),
+	}
+	go func() {
+		message, err := io.ReadAll(errorStream)
+		switch {
+		case err != nil:
+			c.errCh <- fmt.Errorf("read error stream error: %w", err)
+		case len(message) > 0:
+			c.errCh <- fmt.Errorf("port forward %s/%s:%d error: %s", f.namespace, f.podName, f.port, message)
+		}
+		close(c.errCh)
+	}()
+	return c, nil
+}
+
+// closed returns a channel closed when the SPDY connection is closed.
+func (f *portForwarder) closed() <-chan bool {
+	return f.conn.CloseChan()
+}
+
+// Close closes all the connections to the pod.
+func (f *portForwarder) Close() error {
+	return f.conn.Close()
+}
+
+// forwardedConn is a TCP connection to the port of the pod. It implements
+// net.Conn so that it can be used by http.Transport, but the deadlines are not
+// supported.
+type forwardedConn struct {
+	forwarder   *portForwarder
+	errorStream httpstream.Stream
+	dataStream  httpstream.Stream
+	errCh       chan error
+	closeOnce   sync.Once
+}
+
+func (c *forwardedConn) Read(p []byte) (int, error) {
+	return c.dataStream.Read(p)
+}
+
+func (c *forwardedConn) Write(p []byte) (int, error) {
+	return c.dataStream.Write(p)
+}
+
+func (c *forwardedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.dataStream.Close()
+		c.dataStream.Reset()
+		c.forwarder.conn.RemoveStreams(c.errorStream, c.dataStream)
+	})
+	return nil
+}
+
+// remoteError returns the error sent by the pod, e.g. nothing listens on the
+// port.
+func (c *forwardedConn) remoteError() error {
+	select {
+	case err := <-c.errCh:
+		return err
+	case <-time.After(portForwardErrorTimeout):
+		return nil
+	}
+}
+
+func (c *forwardedConn) LocalAddr() net.Addr {
+	return portForwardAddr("localhost")
+}
+
+func (c *forwardedConn) RemoteAddr() net.Addr {
+	return portForwardAddr(fmt.Sprintf("%s/%s:%d", c.forwarder.namespace, c.forwarder.podName, c.forwarder.port))
+}
+
+func (c *forwardedConn) SetDeadline(t time.Time) error      { return nil }
+func (c *forwardedConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *forwardedConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// portForwardAddr is the net.Addr of forwardedConn.
+type portForwardAddr string
+
+func (a portForwardAddr) Network() string { return "portforward" }
+func (a portForwardAddr) String() string  { return string(a) }
@@ -0,0 +1,196 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/forbearing/ratel-webterminal/pkg/args"
+	"github.com/forbearing/ratel-webterminal/pkg/errors"
+	"github.com/forbearing/ratel-webterminal/pkg/policy"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// proxyIdleTimeout is how long the port forwarding of the proxy is kept
+	// after the last request.
+	proxyIdleTimeout = 5 * time.Minute
+	// proxyCSP sandboxes the pages of the pod into a unique origin, so they
+	// can't read the cookies of ratel-webterminal or open its websockets with
+	// the CSRF token.
+	proxyCSP = "sandbox allow-scripts allow-forms allow-popups allow-modals allow-downloads"
+)
+
+var (
+	// podProxies are the proxies to the ports of pods, keyed by
+	// "namespace/pod:port".
+	podProxies   = map[string]*podProxy{}
+	podProxiesMu sync.Mutex
+)
+
+// podProxy is a HTTP reverse proxy to the port of the pod. The connections to
+// the pod are opened by the shared portForwarder, which is closed after
+// proxyIdleTimeout without requests.
+type podProxy struct {
+	key       string
+	forwarder *portForwarder
+	proxy     *httputil.ReverseProxy
+	timer     *time.Timer
+}
+
+// HandleProxy handle "/proxy/{namespace}/{pod}/{port}/..." requests.
+//
+// It proxies the HTTP requests to the port of the pod through port forwarding,
+// so the admin UI of the pod can be opened in the browser. The prefix is
+// stripped from the path and set as the "X-Forwarded-Prefix" header, redirects
+// to absolute paths are rewritten to keep the prefix, but the absolute links
+// in the pages are not, the application should use relative links or honor
+// the header. Websocket upgrades are proxied too.
+//
+// The pod is served on the same origin as ratel-webterminal, so the cookies,
+// the Authorization header and the user headers of the request are never sent
+// to the pod, the cookies set by the pod are dropped, and the pages are
+// sandboxed by the Content-Security-Policy header.
+func HandleProxy(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	namespace := pathParams["namespace"]
+	podName := pathParams["pod"]
+	port, err := parsePort(pathParams["port"])
+	if err != nil {
+		errors.WriteErrorWithMsg(w, http.StatusBadRequest, errors.CodeInvalidPort, err.Error())
+		return
+	}
+	prefix := fmt.Sprintf("/proxy/%s/%s/%s", namespace, podName, pathParams["port"])
+	if r.URL.Path == prefix {
+		target := prefix + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+
+	// the policy is checked for every request, it may be changed after the proxy is created.
+	if !checkAccess(w, r, policy.ActionExec, namespace, podName, "") {
+		return
+	}
+	p, ok := getPodProxy(w, r, namespace, podName, port)
+	if !ok {
+		return
+	}
+	log.Infof("proxy pod: %s/%s, port: %d, request: %s %s", namespace, podName, port, r.Method, r.URL.RequestURI())
+
+	r.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+	r.URL.RawPath = ""
+	r.Header.Set("X-Forwarded-Prefix", prefix)
+	p.proxy.ServeHTTP(w, r)
+}
+
+// getPodProxy returns the proxy to the port of the pod, it's created if not
+// exists. Otherwise the error is written to w. The proxies are not shared by
+// the users, since the port forwarding impersonates the user. Only creating
+// the proxy is counted by "--session-rate", a page loads many resources
+// through the same proxy.
+func getPodProxy(w http.ResponseWriter, r *http.Request, namespace, podName string, port int) (*podProxy, bool) {
+	key := fmt.Sprintf("%s/%s:%d", namespace, podName, port)
+	if args.GetImpersonate() {
+		key += "@" + policy.UserFrom(r).Name
+	}
+	podProxiesMu.Lock()
+	if p, ok := podProxies[key]; ok {
+		p.timer.Reset(proxyIdleTimeout)
+		podProxiesMu.Unlock()
+		return p, true
+	}
+	podProxiesMu.Unlock()
+
+	if !allowRequest(w, r) {
+		return nil, false
+	}
+	podHandler, _, ok := getPortForwardPod(w, r, namespace, podName)
+	if !ok {
+		return nil, false
+	}
+	forwarder, err := newPortForwarder(podHandler, namespace, podName, port)
+	if err != nil {
+		log.Error("port forward error: ", err)
+		errors.WriteErrorWithMsg(w, http.StatusBadGateway, errors.CodePortForwardFailed, err.Error())
+		return nil, false
+	}
+
+	podProxiesMu.Lock()
+	defer podProxiesMu.Unlock()
+	if p, ok := podProxies[key]; ok {
+		// created by another request at the same time.
+		forwarder.Close()
+		p.timer.Reset(proxyIdleTimeout)
+		return p, true
+	}
+	p := newPodProxy(key, fmt.Sprintf("%s.%s:%d", podName, namespace, port), forwarder, fmt.Sprintf("/proxy/%s/%s/%d", namespace, podName, port))
+	podProxies[key] = p
+	log.Infof("proxy %s started", key)
+	return p, true
+}
+
+// newPodProxy returns the proxy of the port forwarder, host is the host of the
+// requests to the pod, it's only used by http.Transport to pool connections.
+func newPodProxy(key, host string, forwarder *portForwarder, prefix string) *podProxy {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return forwarder.dial()
+		},
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	p := &podProxy{key: key, forwarder: forwarder}
+	p.proxy = &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = host
+			// the credentials of ratel-webterminal are not for the pod.
+			req.Header.Del("Cookie")
+			req.Header.Del("Authorization")
+			if header := args.GetUserHeader(); len(header) != 0 {
+				req.Header.Del(header)
+			}
+			if header := args.GetGroupsHeader(); len(header) != 0 {
+				req.Header.Del(header)
+			}
+		},
+		Transport: transport,
+		ModifyResponse: func(resp *http.Response) error {
+			// the cookies of the pod may overwrite the cookies of ratel-webterminal.
+			resp.Header.Del("Set-Cookie")
+			resp.Header.Set("Content-Security-Policy", proxyCSP)
+			if location := resp.Header.Get("Location"); strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//") {
+				resp.Header.Set("Location", prefix+location)
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Errorf("proxy %s error: %v", key, err)
+			errors.WriteErrorWithMsg(w, http.StatusBadGateway, errors.CodePortForwardFailed, err.Error())
+		},
+	}
+	p.timer = time.AfterFunc(proxyIdleTimeout, func() {
+		forwarder.Close()
+	})
+	go func() {
+		<-forwarder.closed()
+		p.timer.Stop()
+		transport.CloseIdleConnections()
+		podProxiesMu.Lock()
+		if podProxies[key] == p {
+			delete(podProxies, key)
+		}
+		podProxiesMu.Unlock()
+		log.Infof("proxy %s closed", key)
+	}()
+	return p
+}
@@ -0,0 +1,414 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/forbearing/ratel-webterminal/pkg/args"
+	"github.com/forbearing/ratel-webterminal/pkg/controller"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// redactLookbehind is how much of the output already sent is kept to find
+	// the secrets split across writes.
+	redactLookbehind = 4096
+	// redactMaxHold is the max size of the output held back waiting for the
+	// rest of a secret.
+	redactMaxHold = 4096
+	// redactHoldTimeout is how long the output is held back at most, so the
+	// terminal is still responsive.
+	redactHoldTimeout = 50 * time.Millisecond
+	// minRedactSecretSize is the min size of the Secret values to redact, the
+	// shorter values like "true" are too common in the output.
+	minRedactSecretSize = 6
+	// redactSeparators may be between the prefix of a pattern and the secret
+	// token, such as "key = value".
+	redactSeparators = " \t=:\"'"
+	// redactTerminators end a secret token.
+	redactTerminators = " \t\r\n\"'`"
+)
+
+// defaultRedactPatterns are redacted with "--redact", only the first
+// submatch is masked if the pattern has one.
+var defaultRedactPatterns = []string{
+	`Bearer ([A-Za-z0-9\-._~+/]+=*)`,
+	`AKIA[0-9A-Z]{16}`,
+	`aws_secret_access_key["']?\s*[=:]\s*["']?([A-Za-z0-9/+=]{40})`,
+	`AWS_SECRET_ACCESS_KEY["']?\s*[=:]\s*["']?([A-Za-z0-9/+=]{40})`,
+}
+
+var (
+	keyBeginPattern = regexp.MustCompile(`-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----`)
+	keyEndPattern   = regexp.MustCompile(`-----END [A-Z0-9 ]*PRIVATE KEY-----`)
+	// keyEndPrefix is held back in the private key blocks, so the END marker
+	// split across writes is not masked as the key.
+	keyEndPrefix = []byte("-----END ")
+)
+
+var (
+	// redactRules are the compiled default patterns and "--redact-pattern".
+	redactRules []redactRule
+	// redactKeys is whether to redact the private key blocks.
+	redactKeys bool
+	// redactUnprefixed is whether some patterns have no literal prefix, such
+	// as "(?i)password=\S+", the last token of the output is held back for them.
+	redactUnprefixed bool
+)
+
+// redactRule masks the matches of pattern, prefix is the literal prefix of
+// pattern, the output after it is held back until the token ends.
+type redactRule struct {
+	pattern *regexp.Regexp
+	prefix  string
+}
+
+// InitRedaction compiles the patterns of "--redact" and "--redact-pattern".
+func InitRedaction() {
+	var patterns []string
+	if args.GetRedact() {
+		patterns = append(patterns, defaultRedactPatterns...)
+		redactKeys = true
+	}
+	patterns = append(patterns, args.GetRedactPatterns()...)
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Fatalf("invalid redact pattern '%s': %s", pattern, err.Error())
+		}
+		prefix, _ := re.LiteralPrefix()
+		redactRules = append(redactRules, redactRule{pattern: re, prefix: prefix})
+		redactUnprefixed = redactUnprefixed || len(prefix) == 0
+	}
+	if len(redactRules) != 0 || redactKeys || args.GetRedactSecretEnv() {
+		log.Infof("redaction enabled with %d patterns, private keys: %t, secret env: %t", len(redactRules), redactKeys, args.GetRedactSecretEnv())
+	}
+}
+
+// redactor masks the secrets in the output with '*', the newlines are kept so
+// the layout of the terminal is not changed.
+//
+// The output is a stream of chunks, a secret may be split across them. The
+// output already sent is kept as the lookbehind, so the rest of the secret
+// is masked once it's found. The output after the literal prefix of a
+// pattern, or a prefix of a Secret value, is held back until the token ends,
+// or flushed after redactHoldTimeout, so the part sent before the secret is
+// found is no more than the public prefix of the pattern. If a pattern has no
+// literal prefix, the last token of the output is always held back until it
+// ends, since it may be the beginning of a match.
+type redactor struct {
+	secrets [][]byte
+	// tail is the end of the output already sent, held is the output held
+	// back, inKey is whether the end of tail is in a private key block.
+	tail  []byte
+	held  []byte
+	inKey bool
+}
+
+// newRedactor returns nil if the redaction is disabled.
+func newRedactor() *redactor {
+	if len(redactRules) == 0 && !redactKeys && !args.GetRedactSecretEnv() {
+		return nil
+	}
+	return &redactor{}
+}
+
+// addSecrets adds the Secret values to redact.
+func (r *redactor) addSecrets(values []string) {
+	for _, value := range values {
+		if len(value) < minRedactSecretSize {
+			continue
+		}
+		r.secrets = append(r.secrets, []byte(value))
+	}
+}
+
+// redact returns the output can be sent now, the rest is held back until the
+// next call, or flush.
+func (r *redactor) redact(p []byte) []byte {
+	full := append(append(append([]byte(nil), r.tail...), r.held...), p...)
+	offset := len(r.tail)
+	hold := r.holdFrom(full, offset)
+	out := r.mask(full, offset, hold)
+	r.held = append(r.held[:0], full[hold:]...)
+	r.setTail(full[:hold])
+	return out
+}
+
+// pending returns whether some output is held back.
+func (r *redactor) pending() bool {
+	return len(r.held) != 0
+}
+
+// flush returns the output held back.
+func (r *redactor) flush() []byte {
+	full := append(append([]byte(nil), r.tail...), r.held...)
+	out := r.mask(full, len(r.tail), len(full))
+	r.held = r.held[:0]
+	r.setTail(full)
+	return out
+}
+
+// redactLine redacts a complete log line, nothing is held back. The private
+// key blocks are tracked across lines.
+func (r *redactor) redactLine(line []byte) []byte {
+	return r.mask(line, 0, len(line))
+}
+
+func (r *redactor) setTail(sent []byte) {
+	if len(sent) > redactLookbehind {
+		sent = sent[len(sent)-redactLookbehind:]
+	}
+	r.tail = append(r.tail[:0], sent...)
+}
+
+// holdFrom returns where the output should be held back from, len(full) if
+// nothing is held back.
+func (r *redactor) holdFrom(full []byte, offset int) int {
+	hold := len(full)
+	for _, rule := range redactRules {
+		if len(rule.prefix) == 0 {
+			continue
+		}
+		i := bytes.LastIndex(full, []byte(rule.prefix))
+		if i < 0 || len(full)-i > redactMaxHold {
+			continue
+		}
+		// the token after the prefix is not ended.
+		token := bytes.TrimLeft(full[i+len(rule.prefix):], redactSeparators)
+		if !bytes.ContainsAny(token, redactTerminators) && i < hold {
+			hold = i
+		}
+	}
+	if redactUnprefixed {
+		if i := bytes.LastIndexAny(full, redactTerminators) + 1; i < len(full) && len(full)-i <= redactMaxHold && i < hold {
+			hold = i
+		}
+	}
+	if redactKeys && (r.inKey || firstMarker(keyBeginPattern.FindAllIndex(full, -1), offset) != nil) {
+		if i := bytes.LastIndex(full, keyEndPrefix); i >= 0 && bytes.IndexByte(full[i:], '\n') < 0 && len(full)-i <= redactMaxHold && i < hold {
+			hold = i
+		}
+		if i := partialSuffix(full, keyEndPrefix); i < hold {
+			hold = i
+		}
+	}
+	for _, secret := range r.secrets {
+		if i := partialSuffix(full, secret); i < hold {
+			hold = i
+		}
+	}
+	if hold < offset {
+		hold = offset
+	}
+	return hold
+}
+
+// partialSuffix returns where the longest prefix of s at the end of full
+// starts, len(full) if there is none.
+func partialSuffix(full, s []byte) int {
+	for n := len(s) - 1; n > 0; n-- {
+		if bytes.HasSuffix(full, s[:n]) {
+			return len(full) - n
+		}
+	}
+	return len(full)
+}
+
+// mask returns full[offset:end] with the secrets masked, full[:offset] is the
+// lookbehind, and r.inKey is updated to the state at end.
+func (r *redactor) mask(full []byte, offset, end int) []byte {
+	out := append([]byte(nil), full[offset:end]...)
+	maskRange := func(start, stop int) {
+		if start < offset {
+			start = offset
+		}
+		if stop > end {
+			stop = end
+		}
+		for i := start; i < stop; i++ {
+			if c := out[i-offset]; c != '\n' && c != '\r' {
+				out[i-offset] = '*'
+			}
+		}
+	}
+
+	for _, rule := range redactRules {
+		for _, m := range rule.pattern.FindAllSubmatchIndex(full[:end], -1) {
+			start, stop := m[0], m[1]
+			if len(m) >= 4 && m[2] >= 0 {
+				start, stop = m[2], m[3]
+			}
+			maskRange(start, stop)
+		}
+	}
+	for _, secret := range r.secrets {
+		for i := 0; ; {
+			j := bytes.Index(full[i:end], secret)
+			if j < 0 {
+				break
+			}
+			maskRange(i+j, i+j+len(secret))
+			i += j + 1
+		}
+	}
+
+	if redactKeys {
+		// the markers are kept, the blocks between them are masked.
+		begins := keyBeginPattern.FindAllIndex(full[:end], -1)
+		ends := keyEndPattern.FindAllIndex(full[:end], -1)
+		cursor := offset
+		for {
+			if r.inKey {
+				next := firstMarker(ends, cursor)
+				if next == nil {
+					maskRange(cursor, end)
+					break
+				}
+				maskRange(cursor, next[0])
+				cursor, r.inKey = next[1], false
+				continue
+			}
+			next := firstMarker(begins, cursor)
+			if next == nil {
+				break
+			}
+			cursor, r.inKey = next[1], true
+		}
+	}
+	return out
+}
+
+// firstMarker returns the first marker ending after cursor.
+func firstMarker(markers [][]int, cursor int) []int {
+	i := sort.Search(len(markers), func(i int) bool { return markers[i][1] > cursor })
+	if i == len(markers) {
+		return nil
+	}
+	return markers[i]
+}
+
+// redactWriter redacts the logs line by line before writing them to w.
+type redactWriter struct {
+	w     io.Writer
+	r     *redactor
+	lines *lineWriter
+}
+
+// newRedactWriter returns a redactWriter writing to w, the logs are written
+// to w directly if the redaction is disabled. Flush must be called after the
+// last write.
+func newRedactWriter(w io.Writer, r *redactor) *redactWriter {
+	rw := &redactWriter{w: w, r: r}
+	rw.lines = newLineWriter(func(line []byte) error {
+		_, err := rw.w.Write(append(rw.r.redactLine(line), '\n'))
+		return err
+	})
+	return rw
+}
+
+func (w *redactWriter) Write(p []byte) (int, error) {
+	if w.r == nil {
+		return w.w.Write(p)
+	}
+	return w.lines.Write(p)
+}
+
+// Flush writes the incomplete last line.
+func (w *redactWriter) Flush() error {
+	if w.r == nil {
+		return nil
+	}
+	return w.lines.Flush()
+}
+
+// newContainerRedactWriter returns the redactWriter of the logs of the
+// container, with its own redactor and the Secret values of the container.
+func newContainerRedactWriter(w io.Writer, podObj *corev1.Pod, containerName string) *redactWriter {
+	r := newRedactor()
+	if r != nil {
+		r.addSecrets(podSecretValues(podObj, containerName))
+	}
+	return newRedactWriter(w, r)
+}
+
+// podSecretValues returns the values of the Secret-backed environment
+// variables of the container, or all containers if containerName is empty,
+// if "--redact-secret-env" is set. The Secrets are read with the ServiceAccount
+// of ratel-webterminal, the Secrets can't be read are logged and skipped.
+func podSecretValues(podObj *corev1.Pod, containerName string) []string {
+	if !args.GetRedactSecretEnv() {
+		return nil
+	}
+	secrets := make(map[string]*corev1.Secret)
+	getSecret := func(name string) *corev1.Secret {
+		if secret, ok := secrets[name]; ok {
+			return secret
+		}
+		secret, err := controller.GetSecret(podObj.Namespace, name)
+		if err != nil {
+			log.Warnf("get secret %s/%s to redact error, its values of pod %s are not redacted: %s", podObj.Namespace, name, podObj.Name, err.Error())
+			secret = nil
+		}
+		secrets[name] = secret
+		return secret
+	}
+
+	var values []string
+	containers := append(append([]corev1.Container(nil), podObj.Spec.InitContainers...), podObj.Spec.Containers...)
+	for _, c := range containers {
+		if len(containerName) != 0 && c.Name != containerName {
+			continue
+		}
+		for _, env := range c.Env {
+			if env.ValueFrom == nil || env.ValueFrom.SecretKeyRef == nil {
+				continue
+			}
+			if secret := getSecret(env.ValueFrom.SecretKeyRef.Name); secret != nil {
+				if value, ok := secret.Data[env.ValueFrom.SecretKeyRef.Key]; ok {
+					values = append(values, strings.TrimSpace(string(value)))
+				}
+			}
+		}
+		for _, from := range c.EnvFrom {
+			if from.SecretRef == nil {
+				continue
+			}
+			if secret := getSecret(from.SecretRef.Name); secret != nil {
+				for _, value := range secret.Data {
+					values = append(values, strings.TrimSpace(string(value)))
+				}
+			}
+		}
+	}
+	return values
+}
+
+// redactSecrets adds the Secret values of the container to the redactor of
+// the session.
+func (t *TerminalSession) redactSecrets(podObj *corev1.Pod, containerName string) {
+	if t.redactor == nil {
+		return
+	}
+	values := podSecretValues(podObj, containerName)
+	t.l.Lock()
+	defer t.l.Unlock()
+	t.redactor.addSecrets(values)
+}
+
+// redactSecrets adds the Secret values of the container to the redactor of
+// the logger.
+func (l *Logger) redactSecrets(podObj *corev1.Pod, containerName string) {
+	if l.redactor == nil {
+		return
+	}
+	values := podSecretValues(podObj, containerName)
+	l.l.Lock()
+	defer l.l.Unlock()
+	l.redactor.addSecrets(values)
+}
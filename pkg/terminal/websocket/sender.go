@@ -0,0 +1,294 @@
+package websocket
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/forbearing/ratel-webterminal/pkg/args"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// pongWait is the time allowed to read the next pong message from the peer,
+	// the peer is considered dead if nothing is read within pongWait.
+	pongWait = 60 * time.Second
+	// pingPeriod is the period of sending ping messages, must be less than pongWait.
+	pingPeriod = pongWait * 9 / 10
+	// closeTimeout is the max duration waiting for the queued messages to be
+	// sent when the session closed.
+	closeTimeout = 2 * time.Second
+	// maxCloseReasonSize is the max size of the reason in the close message,
+	// the payload of a control message must not be more than 125 bytes.
+	maxCloseReasonSize = 123
+
+	policyDrop       = "drop"
+	policyDisconnect = "disconnect"
+
+	defaultSendQueueSize = 256
+	defaultWriteTimeout  = 10 * time.Second
+)
+
+// errSlowClient is returned when the send queue is full and the slow client
+// policy is disconnect.
+var errSlowClient = errors.New("websocket client is too slow, send queue is full")
+
+// queuedMessage is a message waiting in the send queue.
+// units is the number of lines or bytes in the message, it is reported by
+// the skipped marker if the message is dropped.
+// binary is true if the message is sent as a binary message, such as the
+// ZMODEM frames, otherwise a text message.
+type queuedMessage struct {
+	data   []byte
+	units  int
+	binary bool
+}
+
+// sender writes messages to websocket in its own goroutine, so a slow browser
+// never blocks the upstream copy of logs or container output.
+//
+// The messages are queued in a bounded send queue. When the queue is full, the
+// oldest message is dropped and a marker made by skipped is sent before the
+// remaining messages, or the websocket is closed, depending on the
+// "--slow-client-policy" argument. Every write has a deadline, and ping messages
+// are sent periodically, so the dead peers are detected by readMessage.
+type sender struct {
+	conn    *websocket.Conn
+	skipped func(n int) []byte
+
+	policy       string
+	queueSize    int
+	writeTimeout time.Duration
+
+	mu       sync.Mutex
+	queue    []queuedMessage
+	dropped  int
+	err      error
+	notifyCh chan struct{}
+	spaceCh  chan struct{}
+	closeCh  chan struct{}
+	doneCh   chan struct{}
+	once     sync.Once
+	// reason is sent to the client in the close message.
+	reason string
+}
+
+// InitSender validates "--slow-client-policy".
+func InitSender() {
+	switch slowClientPolicy := args.GetSlowClientPolicy(); slowClientPolicy {
+	case policyDrop, policyDisconnect:
+	default:
+		log.Fatalf("invalid slow client policy '%s', must be one of '%s' or '%s'", slowClientPolicy, policyDrop, policyDisconnect)
+	}
+}
+
+// newSender creates a sender of the websocket and starts the write goroutine.
+// skipped makes the marker message telling the user n lines or bytes are
+// dropped.
+func newSender(conn *websocket.Conn, skipped func(n int) []byte) *sender {
+	s := &sender{
+		conn:         conn,
+		skipped:      skipped,
+		policy:       args.GetSlowClientPolicy(),
+		queueSize:    args.GetSendQueueSize(),
+		writeTimeout: args.GetWriteTimeout(),
+		notifyCh:     make(chan struct{}, 1),
+		spaceCh:      make(chan struct{}, 1),
+		closeCh:      make(chan struct{}),
+		doneCh:       make(chan struct{}),
+	}
+	if s.queueSize <= 0 {
+		s.queueSize = defaultSendQueueSize
+	}
+	if s.writeTimeout <= 0 {
+		s.writeTimeout = defaultWriteTimeout
+	}
+
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	go s.writeLoop()
+	return s
+}
+
+// readMessage reads the next message from the websocket. The read deadline is
+// extended by every pong message, so the peer is considered dead if neither a
+// message nor a pong is received within pongWait.
+func readMessage(conn *websocket.Conn) (int, []byte, error) {
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	return conn.ReadMessage()
+}
+
+// send queues the text message, it never blocks. It returns error if the
+// websocket is broken, or the client is too slow and the policy is disconnect.
+func (s *sender) send(data []byte, units int) error {
+	return s.enqueue(queuedMessage{data: data, units: units})
+}
+
+// sendWait is the same as send, but it waits for the room in the send queue
+// instead of applying the slow client policy, so no data is dropped and the
+// producer is slowed down to the speed of the client.
+func (s *sender) sendWait(data []byte) error {
+	return s.enqueueWait(queuedMessage{data: data})
+}
+
+// sendBinaryWait is the same as sendWait, but the data is sent as a binary
+// message.
+func (s *sender) sendBinaryWait(data []byte) error {
+	return s.enqueueWait(queuedMessage{data: data, binary: true})
+}
+
+func (s *sender) enqueue(msg queuedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if len(s.queue) >= s.queueSize {
+		if s.policy == policyDisconnect {
+			log.Warn("close websocket: ", errSlowClient)
+			s.err = errSlowClient
+			// closing the connection also stops the reader of the websocket.
+			s.conn.Close()
+			return s.err
+		}
+		s.dropped += s.queue[0].units
+		s.queue[0] = queuedMessage{}
+		s.queue = s.queue[1:]
+	}
+	s.push(msg)
+	return nil
+}
+
+func (s *sender) enqueueWait(msg queuedMessage) error {
+	for {
+		s.mu.Lock()
+		if s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			return err
+		}
+		if len(s.queue) < s.queueSize {
+			s.push(msg)
+			s.mu.Unlock()
+			return nil
+		}
+		s.mu.Unlock()
+		select {
+		case <-s.spaceCh:
+		case <-s.doneCh:
+			return errors.New("websocket is closed")
+		}
+	}
+}
+
+// push appends the message to the send queue and wakes up the write loop.
+// The caller must hold s.mu.
+func (s *sender) push(msg queuedMessage) {
+	s.queue = append(s.queue, msg)
+	select {
+	case s.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// writeLoop writes the queued messages and the ping messages to websocket,
+// until the sender is closed or a write failed.
+func (s *sender) writeLoop() {
+	defer close(s.doneCh)
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.notifyCh:
+			if !s.writeQueued() {
+				return
+			}
+		case <-ticker.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.writeTimeout)); err != nil {
+				s.fail(err)
+				return
+			}
+		case <-s.closeCh:
+			// the normal closure tells the client not to reconnect.
+			if s.writeQueued() {
+				s.mu.Lock()
+				reason := s.reason
+				s.mu.Unlock()
+				s.conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason),
+					time.Now().Add(s.writeTimeout))
+			}
+			return
+		}
+	}
+}
+
+// writeQueued writes all the queued messages, it returns false if a write
+// failed.
+func (s *sender) writeQueued() bool {
+	s.mu.Lock()
+	queue, dropped := s.queue, s.dropped
+	s.queue, s.dropped = nil, 0
+	s.mu.Unlock()
+	select {
+	case s.spaceCh <- struct{}{}:
+	default:
+	}
+
+	if dropped > 0 && s.skipped != nil {
+		queue = append([]queuedMessage{{data: s.skipped(dropped)}}, queue...)
+	}
+	for _, msg := range queue {
+		messageType := websocket.TextMessage
+		if msg.binary {
+			messageType = websocket.BinaryMessage
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+		if err := s.conn.WriteMessage(messageType, msg.data); err != nil {
+			s.fail(err)
+			return false
+		}
+	}
+	return true
+}
+
+// fail records the write error and closes the websocket, so the reader of the
+// websocket is stopped too.
+func (s *sender) fail(err error) {
+	log.Debug("write message err: ", err)
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.queue = nil
+	s.mu.Unlock()
+	s.conn.Close()
+}
+
+// close sends the queued messages, waits at most closeTimeout, then closes
+// the websocket. It is safe to be called multiple times.
+func (s *sender) close() error {
+	return s.closeWithReason("")
+}
+
+// closeWithReason is the same as close, but the reason is sent to the client.
+// The reason is truncated to fit in the close message.
+func (s *sender) closeWithReason(reason string) error {
+	if len(reason) > maxCloseReasonSize {
+		reason = reason[:maxCloseReasonSize]
+	}
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.reason = reason
+		s.mu.Unlock()
+		close(s.closeCh)
+	})
+	select {
+	case <-s.doneCh:
+	case <-time.After(closeTimeout):
+	}
+	return s.conn.Close()
+}
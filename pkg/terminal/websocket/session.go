@@ -0,0 +1,307 @@
+package websocket
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/forbearing/ratel-webterminal/pkg/args"
+	"github.com/forbearing/ratel-webterminal/pkg/errors"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// outputBufferSize is the size of recent output kept by every terminal
+	// session, which is replayed to the client after reconnecting.
+	outputBufferSize = 64 * 1024
+	// floorTimeout is how long a driver holds the input floor after typing.
+	floorTimeout = 2 * time.Second
+
+	roleOwner  = "owner"
+	roleDriver = "driver"
+	roleViewer = "viewer"
+)
+
+// sessions stores all the terminal sessions, the key is the session ID.
+var (
+	sessions   = make(map[string]*TerminalSession)
+	sessionsMu sync.RWMutex
+)
+
+// registerSession stores the terminal session, so the client can reconnect to it.
+func registerSession(session *TerminalSession) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	sessions[session.id] = session
+}
+
+// unregisterSession removes the terminal session.
+func unregisterSession(id string) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	delete(sessions, id)
+}
+
+// getSession returns the terminal session with the given ID, nil if not found.
+func getSession(id string) *TerminalSession {
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	return sessions[id]
+}
+
+// genRandomID generates a random hex string, it is used as session ID and
+// reconnect token.
+func genRandomID() (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// HandleWsReconnect handle "/ws/sessions/{session}" connections.
+//
+// The client connects to an existing terminal session with the query parameter
+// "token", the role of the client is decided by the token:
+//
+//   - the reconnect token, the owner reconnects after the websocket closed
+//     unexpectedly, and replaces the previous owner websocket if any.
+//   - the drive token, a co-driver joins the session, who can type too.
+//   - the view token, a read-only viewer joins the session.
+//
+// The output after the query parameter "offset", the offset of the last stdout
+// message received, is replayed, and the last terminal size is sent to the
+// container again.
+func HandleWsReconnect(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["session"]
+	query := r.URL.Query()
+
+	session := getSession(id)
+	if session == nil {
+		errors.WriteError(w, http.StatusNotFound, errors.CodeSessionNotFound)
+		return
+	}
+	role := session.role(query.Get("token"))
+	if len(role) == 0 {
+		errors.WriteError(w, http.StatusForbidden, errors.CodeInvalidSessionToken)
+		return
+	}
+	var offset int64
+	if value := query.Get("offset"); len(value) != 0 {
+		var err error
+		if offset, err = strconv.ParseInt(value, 10, 64); err != nil || offset < 0 {
+			errors.WriteErrorWithMsg(w, http.StatusBadRequest, errors.CodeInvalidParam, fmt.Sprintf("invalid offset: %q", value))
+			return
+		}
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Error("upgrade websocket error: ", err)
+		return
+	}
+	log.Infof("connect to terminal session %s as %s, offset: %d", id, role, offset)
+	session.attach(conn, role, offset)
+}
+
+// role returns the role of the client with the token, empty if the token is
+// invalid.
+func (t *TerminalSession) role(token string) string {
+	for _, candidate := range []struct {
+		token string
+		role  string
+	}{
+		{t.token, roleOwner},
+		{t.driveToken, roleDriver},
+		{t.viewToken, roleViewer},
+	} {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(candidate.token)) == 1 {
+			return candidate.role
+		}
+	}
+	return ""
+}
+
+// attach connects the websocket to the terminal session with the role. The
+// owner replaces the previous owner websocket if any. The session message is
+// sent first, then the output after offset, and the last terminal size is sent
+// to the container again.
+func (t *TerminalSession) attach(conn *websocket.Conn, role string, offset int64) {
+	client := &terminalClient{conn: conn, sender: newSender(conn, skippedOutput), role: role}
+
+	t.l.Lock()
+	select {
+	case <-t.doneCh:
+		t.l.Unlock()
+		client.sender.close()
+		return
+	default:
+	}
+	var old *terminalClient
+	if role == roleOwner {
+		old = t.owner
+		t.owner = client
+		delete(t.clients, old)
+	}
+	t.clients[client] = true
+	if role != roleViewer && t.graceTimer != nil {
+		t.graceTimer.Stop()
+		t.graceTimer = nil
+	}
+
+	msg := TerminalMessage{Op: "session", Session: t.id, Role: role}
+	// only the owner can reconnect by the token and share the session.
+	if role == roleOwner {
+		msg.Token, msg.ViewToken, msg.DriveToken = t.token, t.viewToken, t.driveToken
+	}
+	data, _ := json.Marshal(msg)
+	client.sender.send(data, 0)
+	if output := t.output.Since(offset); len(output) != 0 {
+		t.sendOutput(client, output)
+	}
+	if role != roleOwner || old == nil {
+		t.notify(client, fmt.Sprintf("%s joined, %d clients attached", role, len(t.clients)))
+	}
+	size := t.size
+	t.l.Unlock()
+
+	if old != nil {
+		old.sender.close()
+	}
+	if size != nil && role != roleViewer {
+		go func() {
+			select {
+			case t.sizeCh <- *size:
+			case <-t.doneCh:
+			}
+		}()
+	}
+	go t.readLoop(client)
+}
+
+// detach disconnects the client from the terminal session after its websocket
+// closed. If no owner or driver is attached, the session is kept for
+// "--session-grace-period" waiting for the client to reconnect, and closed if
+// no client reconnected.
+func (t *TerminalSession) detach(client *terminalClient) {
+	client.sender.close()
+
+	t.l.Lock()
+	defer t.l.Unlock()
+	t.endTransfer(client, true)
+	if !t.clients[client] {
+		return
+	}
+	delete(t.clients, client)
+	if t.owner == client {
+		t.owner = nil
+	}
+	if t.floor == client {
+		t.floor = nil
+	}
+	select {
+	case <-t.doneCh:
+		return
+	default:
+	}
+	t.notify(nil, fmt.Sprintf("%s left, %d clients attached", client.role, len(t.clients)))
+	for c := range t.clients {
+		if c.role != roleViewer {
+			return
+		}
+	}
+
+	grace := args.GetSessionGracePeriod()
+	if grace <= 0 {
+		go t.closeWithReason(closeReasonDisconnected)
+		return
+	}
+	log.Infof("terminal session %s disconnected, waiting %s for reconnecting", t.id, grace)
+	t.graceTimer = time.AfterFunc(grace, func() {
+		log.Infof("terminal session %s is not reconnected in %s, close it", t.id, grace)
+		t.closeWithReason(closeReasonDisconnected)
+	})
+}
+
+// takeFloor returns whether the input of the client is accepted. A driver holds
+// the input floor while typing, the input of other drivers is dropped until the
+// floor stopped typing for floorTimeout.
+func (t *TerminalSession) takeFloor(client *terminalClient) bool {
+	t.l.Lock()
+	defer t.l.Unlock()
+	now := time.Now()
+	if t.floor != nil && t.floor != client && now.Sub(t.floorAt) < floorTimeout {
+		return false
+	}
+	if t.floor != client {
+		t.notify(client, fmt.Sprintf("%s is typing", client.role))
+	}
+	t.floor, t.floorAt = client, now
+	return true
+}
+
+// notify sends the notice to all clients except the given one. The caller
+// must hold t.l.
+func (t *TerminalSession) notify(except *terminalClient, notice string) {
+	data, _ := json.Marshal(TerminalMessage{Op: "notice", Data: notice})
+	for client := range t.clients {
+		if client != except {
+			client.sender.send(data, 0)
+		}
+	}
+}
+
+// ringBuffer keeps the last size bytes written to it, and the total number of
+// bytes written as the offset of the end.
+type ringBuffer struct {
+	buf  []byte
+	size int
+	end  int64
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{buf: make([]byte, 0, size), size: size}
+}
+
+func (b *ringBuffer) Write(p []byte) {
+	b.end += int64(len(p))
+	if len(p) >= b.size {
+		b.buf = append(b.buf[:0], p[len(p)-b.size:]...)
+		return
+	}
+	if over := len(b.buf) + len(p) - b.size; over > 0 {
+		b.buf = append(b.buf[:0], b.buf[over:]...)
+	}
+	b.buf = append(b.buf, p...)
+}
+
+// End returns the offset of the end.
+func (b *ringBuffer) End() int64 {
+	return b.end
+}
+
+// Since returns a copy of the bytes after offset, or all the bytes kept if
+// offset is too old. The incomplete UTF-8 character at the beginning is skipped.
+func (b *ringBuffer) Since(offset int64) []byte {
+	start := b.end - int64(len(b.buf))
+	if offset < start {
+		offset = start
+	}
+	if offset > b.end {
+		offset = b.end
+	}
+	data := b.buf[offset-start:]
+	for len(data) != 0 && !utf8.RuneStart(data[0]) {
+		data = data[1:]
+	}
+	return append([]byte(nil), data...)
+}
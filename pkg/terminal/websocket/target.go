@@ -0,0 +1,59 @@
+package websocket
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/forbearing/k8s/pod"
+	"github.com/forbearing/ratel-webterminal/pkg/controller"
+	"github.com/gorilla/mux"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// resolveTarget returns the namespace, pod name and container name of the request.
+//
+// The pod and container are read from the path parameters, or from the "pod" and
+// "container" query parameters for the routes without them, such as
+// "/ws/{namespace}/shell?pod=deployment/api".
+// The pod can be a pod name or a workload reference like "deployment/api", and
+// a label selector can be given by the "selector" query parameter instead, they
+// are resolved to a ready pod by the pod lister.
+// If the container is not given, the default container of the pod is used.
+func resolveTarget(r *http.Request) (namespace, podName, containerName string, err error) {
+	pathParams := mux.Vars(r)
+	query := r.URL.Query()
+	namespace = pathParams["namespace"]
+	podName, ok := pathParams["pod"]
+	if !ok {
+		podName = query.Get("pod")
+	}
+	containerName, ok = pathParams["container"]
+	if !ok {
+		containerName = query.Get("container")
+	}
+	selector := query.Get("selector")
+
+	// nothing to resolve.
+	isWorkload := strings.Contains(podName, "/") || (len(podName) == 0 && len(selector) != 0)
+	if !isWorkload && len(containerName) != 0 {
+		return namespace, podName, containerName, nil
+	}
+
+	var podObj *corev1.Pod
+	if isWorkload {
+		podObj, err = controller.ResolvePod(namespace, podName, selector)
+	} else {
+		var podHandler *pod.Handler
+		if podHandler, err = newPodHandler(r, namespace); err != nil {
+			return
+		}
+		podObj, err = getPod(podHandler, namespace, podName)
+	}
+	if err != nil {
+		return
+	}
+	if len(containerName) == 0 {
+		containerName = controller.DefaultContainer(podObj)
+	}
+	return namespace, podObj.Name, containerName, nil
+}
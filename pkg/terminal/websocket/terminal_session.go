@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"time"
 
+	"github.com/forbearing/ratel-webterminal/pkg/policy"
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 	"k8s.io/client-go/tools/remotecommand"
@@ -14,28 +17,75 @@ import (
 
 // NewTerminalSessionWs create TerminalSession
 func NewTerminalSessionWs(conn *websocket.Conn) *TerminalSession {
-	return &TerminalSession{
-		conn:   conn,
-		sizeCh: make(chan remotecommand.TerminalSize),
-		doneCh: make(chan struct{}),
+	session, err := newTerminalSession()
+	if err != nil {
+		log.Error("create terminal session error: ", err)
+		return nil
 	}
+	registerSession(session)
+	session.attach(conn, roleOwner, 0)
+	go session.watchLifetime()
+	return session
 }
 
 // NewTerminalSession 创建一个 TerminalSession 对象,  同时将 http 连接升级到 websocket 并放入 TerminalSession 对象.
 // 后续前端 JavaScript 代码可以向 TerminalSession 内部维护的 websocket 写数据和读取数据
+// 会话的 ID 和重连凭证会通过 session 消息发送给前端, 网络中断后前端可以重新连接到这个会话.
 func NewTerminalSession(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*TerminalSession, error) {
-	conn, err := upgrader.Upgrade(w, r, responseHeader)
+	session, err := newTerminalSession()
 	if err != nil {
 		return nil, err
 	}
-	session := &TerminalSession{
-		conn:   conn,
-		sizeCh: make(chan remotecommand.TerminalSize),
-		doneCh: make(chan struct{}),
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		return nil, err
 	}
+	session.user = policy.UserFrom(r).Name
+	registerSession(session)
+	session.attach(conn, roleOwner, 0)
+	go session.watchLifetime()
 	return session, nil
 }
 
+// newTerminalSession creates a TerminalSession without any client.
+func newTerminalSession() (*TerminalSession, error) {
+	id, err := genRandomID()
+	if err != nil {
+		return nil, err
+	}
+	var tokens [3]string
+	for i := range tokens {
+		if tokens[i], err = genRandomID(); err != nil {
+			return nil, err
+		}
+	}
+	return &TerminalSession{
+		id:         id,
+		token:      tokens[0],
+		viewToken:  tokens[1],
+		driveToken: tokens[2],
+		clients:    make(map[*terminalClient]bool),
+		output:     newRingBuffer(outputBufferSize),
+		startedAt:  time.Now(),
+		inputAt:    time.Now(),
+		guard:      newCommandGuard(),
+		redactor:   newRedactor(),
+		inputCh:    make(chan []byte),
+		sizeCh:     make(chan remotecommand.TerminalSize),
+		doneCh:     make(chan struct{}),
+	}, nil
+}
+
+// skippedOutput makes the stdout message telling the user n bytes of output
+// are dropped for the slow client.
+func skippedOutput(n int) []byte {
+	msg, _ := json.Marshal(TerminalMessage{
+		Op:   "stdout",
+		Data: fmt.Sprintf("\r\n\x1b[33m[%d bytes skipped]\x1b[0m\r\n", n),
+	})
+	return msg
+}
+
 // remotecommand 会循环调用 Next() 方法
 func (t *TerminalSession) Next() *remotecommand.TerminalSize {
 	select {
@@ -44,9 +94,8 @@ func (t *TerminalSession) Next() *remotecommand.TerminalSize {
 	case size := <-t.sizeCh:
 		return &size
 
-		// 如果从 doneCh 被关闭了, 表明用户刷新了浏览器的 web 终端或者其他 pod 容器的其他原因,
-		// 或者是网络原因, TerminalSession 将会关闭其内部 websocket, remotecommand 包
-		// 也会断开和 pod 容器建立的双向 shell streams 长连接.
+		// 如果从 doneCh 被关闭了, 表明 pod 容器的 shell 退出了, 或者浏览器断开后没有在
+		// grace 时间内重新连接, remotecommand 包也会断开和 pod 容器建立的双向 shell streams 长连接.
 	case <-t.doneCh:
 		return nil
 	}
@@ -57,45 +106,118 @@ func (t *TerminalSession) Next() *remotecommand.TerminalSize {
 // 1. pod 容器的任何输入都来自 TerminalSession 内部维护的 websocket.
 // 2. pod 容器的任何输出都会写入 TerminalSession 内部维护的 websocket.
 
-// 1.Read 方法用来从 TerminalSession 内部维护的 websocket 读取数据.
+// 1.Read 方法用来读取浏览器 websocket 发送过来的 shell 指令, readLoop() 会将其放入 inputCh.
 // 2.remotecommand 包会调用 TerminalSession 的 Read 方法来获取数据, 作为 pod 容器的 stdin
 // 3.前端 JavaScript 代码将用户在浏览器 web 终端上输入的 shell 指令写入到 TerminalSession 内部的 websocket.
 // 4.最终 pod 容器知道要执行哪个命令.
+// websocket 断开后 Read 会一直等待重新连接, 会话关闭后返回 END_OF_TRANSMISSION.
+// 配置了 "--blocked-command" 或 "--confirm-command" 时, 输入会先经过 commandGuard 检查.
 func (t *TerminalSession) Read(p []byte) (int, error) {
-	// 调用 websocket.ReadMessage() 方法从 websocket 读取数据, 数据类型主要有两种
-	// 一种是用户输入的 shell 指令, 一种是浏览器长宽大小信息.
-	_, message, err := t.conn.ReadMessage()
-	if err != nil {
-		if errors.Is(err, net.ErrClosed) {
-			log.Println("closed network connection")
+	for len(t.pending) == 0 {
+		select {
+		case data := <-t.inputCh:
+			t.pending = t.inspect(data)
+		case <-t.doneCh:
+			if t.eotSent {
+				return 0, io.EOF
+			}
+			t.eotSent = true
 			return copy(p, END_OF_TRANSMISSION), nil
-		} else {
-			log.Printf("read message err: %v", err)
-			return copy(p, END_OF_TRANSMISSION), err
 		}
 	}
-	var msg TerminalMessage
-	if err := json.Unmarshal([]byte(message), &msg); err != nil {
-		log.Printf("read parse message err: %v", err)
-		return copy(p, END_OF_TRANSMISSION), err
-	}
-
-	// 如果 Op 标志位为 stdin, 表示是用户输入的 shell 指令
-	// 具体前端 JavaScript 代码为 ./frontend/terminal.js 34, 35 行
-	switch msg.Op {
-	case "stdin":
-		return copy(p, msg.Data), nil
-
-	// 如果 Op 标志位为 resize, 表示是浏览器长宽大小信息.
-	// 则向 sizeCh 通道发送当前浏览器长宽大小信息, remotecommand 包会循环调用 TerminalSession 的 Next() 方法
-	// 在该 Next() 方法中, remotecommand 包接收到了浏览器新的长宽大小, 就会调整 pod 容器的终端大小.
-	// 具体前端 JavaScript 代码为 "./frontend/terminal.js" 的 39,40行
-	case "resize":
-		t.sizeCh <- remotecommand.TerminalSize{Width: msg.Cols, Height: msg.Rows}
-		return 0, nil
-	default:
-		log.Printf("unknown message type '%s'", msg.Op)
-		return copy(p, END_OF_TRANSMISSION), fmt.Errorf("unknown message type '%s'", msg.Op)
+	n := copy(p, t.pending)
+	t.pending = t.pending[n:]
+	return n, nil
+}
+
+// readLoop 从浏览器的 websocket 读取数据, 直到 websocket 断开. 数据类型主要有两种
+// 一种是用户输入的 shell 指令, 一种是浏览器长宽大小信息.
+func (t *TerminalSession) readLoop(client *terminalClient) {
+	defer t.detach(client)
+	for {
+		messageType, message, err := readMessage(client.conn)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Debug("closed network connection")
+			} else {
+				log.Debugf("read message err: %v", err)
+			}
+			return
+		}
+		// 二进制消息是 ZMODEM 或 trzsz 文件传输的数据, 只接受传输文件的 websocket 发送的.
+		if messageType == websocket.BinaryMessage {
+			t.l.Lock()
+			transferring := t.transferring(client)
+			if transferring {
+				t.inputAt = time.Now()
+			}
+			t.l.Unlock()
+			if !transferring {
+				continue
+			}
+			select {
+			case t.inputCh <- message:
+			case <-t.doneCh:
+				return
+			}
+			continue
+		}
+		var msg TerminalMessage
+		if err := json.Unmarshal([]byte(message), &msg); err != nil {
+			log.Printf("read parse message err: %v", err)
+			continue
+		}
+
+		// 如果 Op 标志位为 stdin, 表示是用户输入的 shell 指令
+		// 具体前端 JavaScript 代码为 ./frontend/terminal.js 34, 35 行
+		switch msg.Op {
+		case "stdin":
+			// 只读用户的输入会被忽略, 多个用户同时输入时只接受 floor 的输入.
+			if client.role == roleViewer || !t.takeFloor(client) {
+				continue
+			}
+			t.l.Lock()
+			// 文件传输期间其他用户的输入会破坏传输的数据.
+			blocked := t.transfer != nil && !t.transferring(client)
+			if !blocked {
+				t.inputAt = time.Now()
+			}
+			t.l.Unlock()
+			if blocked {
+				continue
+			}
+			select {
+			case t.inputCh <- []byte(msg.Data):
+			case <-t.doneCh:
+				return
+			}
+
+		// 如果 Op 标志位为 resize, 表示是浏览器长宽大小信息.
+		// 则向 sizeCh 通道发送当前浏览器长宽大小信息, remotecommand 包会循环调用 TerminalSession 的 Next() 方法
+		// 在该 Next() 方法中, remotecommand 包接收到了浏览器新的长宽大小, 就会调整 pod 容器的终端大小.
+		// 具体前端 JavaScript 代码为 "./frontend/terminal.js" 的 39,40行
+		case "resize":
+			if client.role == roleViewer {
+				continue
+			}
+			size := remotecommand.TerminalSize{Width: msg.Cols, Height: msg.Rows}
+			t.l.Lock()
+			t.size = &size
+			t.l.Unlock()
+			select {
+			case t.sizeCh <- size:
+			case <-t.doneCh:
+				return
+			}
+
+		// 如果 Op 标志位为 transfer, 表示前端的 ZMODEM 或 trzsz 文件传输结束了.
+		case "transfer":
+			t.l.Lock()
+			t.endTransfer(client, false)
+			t.l.Unlock()
+		default:
+			log.Printf("unknown message type '%s'", msg.Op)
+		}
 	}
 }
 
@@ -109,20 +231,104 @@ func (t *TerminalSession) Read(p []byte) (int, error) {
 //   内部维护的 websocket
 // 3.前端 JavaScript 代码从 TerminalSession 内部维护的 websocket 读取数据并输出到浏览器的 web terminal 上.
 // 4.最终用户在 web 终端上得到自己命令的输出结果.
+// 输出会写入到连接到会话的所有 websocket, 同时会保存在 output 中, websocket 断开时不会返回错误,
+// 重连后前端可以继续接收断开期间的输出.
+// 检测到 ZMODEM 或 trzsz 的起始序列后, 输出以二进制消息只发送给传输文件的 websocket, 直到传输结束.
+// 传输的数据不能被丢弃, 在 t.l 之外等待 websocket 发送队列有空间, 容器的输出会降到客户端的速度.
 func (t *TerminalSession) Write(p []byte) (int, error) {
+	t.l.Lock()
+	// start is the transfer message sent before the first binary message.
+	var start, data []byte
+	if t.transfer == nil {
+		protocol, text, binary := t.detectTransfer(p)
+		if len(protocol) == 0 {
+			t.writeText(p, false)
+			t.l.Unlock()
+			return len(p), nil
+		}
+		t.writeText(text, true)
+		var ok bool
+		if start, ok = t.startTransfer(protocol); !ok {
+			t.writeOutput(binary)
+			t.l.Unlock()
+			return len(p), nil
+		}
+		data = binary
+	} else {
+		// the data is sent asynchronously, p may be reused by the caller.
+		data = append([]byte(nil), p...)
+	}
+	sender := t.transfer.client.sender
+	t.l.Unlock()
+
+	if len(start) != 0 {
+		sender.sendWait(start)
+	}
+	sender.sendBinaryWait(data)
+	return len(p), nil
+}
+
+// writeText redacts the output and writes it, the output held back by the
+// redactor is written after heldTimer, or now if flush is true. The caller
+// must hold t.l.
+func (t *TerminalSession) writeText(p []byte, flush bool) {
+	if t.redactor == nil {
+		if len(p) != 0 {
+			t.writeOutput(p)
+		}
+		return
+	}
+	out := t.redactor.redact(p)
+	if flush {
+		out = append(out, t.redactor.flush()...)
+	}
+	if len(out) != 0 {
+		t.writeOutput(out)
+	}
+	if !t.redactor.pending() {
+		return
+	}
+	if t.heldTimer == nil {
+		t.heldTimer = time.AfterFunc(redactHoldTimeout, t.flushHeld)
+	} else {
+		t.heldTimer.Reset(redactHoldTimeout)
+	}
+}
+
+// flushHeld writes the output held back by the redactor.
+func (t *TerminalSession) flushHeld() {
+	t.l.Lock()
+	defer t.l.Unlock()
+	if t.transfer != nil || !t.redactor.pending() {
+		return
+	}
+	t.writeOutput(t.redactor.flush())
+}
+
+// writeOutput records the output and sends it to all clients. The caller must
+// hold t.l.
+func (t *TerminalSession) writeOutput(p []byte) {
+	t.output.Write(p)
+	for client := range t.clients {
+		// 消息先放入发送队列, 由 sender 异步写入 websocket, 浏览器太慢时不会阻塞 pod 容器的输出.
+		if err := t.sendOutput(client, p); err != nil {
+			log.Printf("write message err: %v", err)
+		}
+	}
+}
+
+// sendOutput sends the output to the client, the offset of the message is the
+// end of the session output. The caller must hold t.l.
+func (t *TerminalSession) sendOutput(client *terminalClient, p []byte) error {
 	msg, err := json.Marshal(TerminalMessage{
-		Op:   "stdout",
-		Data: string(p),
+		Op:     "stdout",
+		Data:   string(p),
+		Offset: t.output.End(),
 	})
 	if err != nil {
-		log.Printf("write parse message err: %v", err)
-		return 0, err
-	}
-	if err := t.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
-		log.Printf("write message err: %v", err)
-		return 0, err
+		return err
 	}
-	return len(p), nil
+	return client.sender.send(msg, len(p))
 }
 
 // 浏览器 web 终端重新刷新了, 集群 pod 容器故障, 或者其他网络原因等, 将会关闭一个 TerminalSession
@@ -130,7 +336,34 @@ func (t *TerminalSession) Write(p []byte) (int, error) {
 // Close 函数将会关闭 TerminalSession 内部的 websocket, 并关闭 doneCh 通道.
 // remotecommand 包调用的 Next() 函数感知到 doneCh 通道关闭了,也就会关闭与 pod 容器
 // 建立的双向 shell streams 长连接.
+// Close 可以被多次调用.
 func (t *TerminalSession) Close() error {
-	close(t.doneCh)
-	return t.conn.Close()
+	return t.closeWithReason(closeReasonExited)
+}
+
+// closeWithReason closes the session, the reason is logged, recorded in the
+// metrics, and sent to the clients. Only the first reason takes effect.
+func (t *TerminalSession) closeWithReason(reason string) error {
+	var err error
+	t.once.Do(func() {
+		close(t.doneCh)
+		unregisterSession(t.id)
+		log.Infof("close terminal session %s: %s", t.id, reason)
+		closedSessions.Add(reason, 1)
+
+		t.l.Lock()
+		clients := t.clients
+		t.clients = make(map[*terminalClient]bool)
+		t.owner, t.floor = nil, nil
+		if t.graceTimer != nil {
+			t.graceTimer.Stop()
+		}
+		t.l.Unlock()
+		for client := range clients {
+			if closeErr := client.sender.closeWithReason(reason); closeErr != nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
 }
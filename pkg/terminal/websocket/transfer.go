@@ -0,0 +1,174 @@
+package websocket
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/forbearing/ratel-webterminal/pkg/errors"
+	"github.com/forbearing/ratel-webterminal/pkg/policy"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// transferProgressInterval is the min interval of the progress messages of a
+// file transfer.
+const transferProgressInterval = 500 * time.Millisecond
+
+// transferWatchers stores the websocket receiving the progress of every file
+// transfer, the key is the transfer ID.
+var (
+	transferWatchers   = make(map[string]*transferWatcher)
+	transferWatchersMu sync.Mutex
+)
+
+// transferWatcher is the websocket of a transfer ID, it only receives the
+// progress of the transfers started by the same client to the same container.
+type transferWatcher struct {
+	sender *sender
+	// owner is the clientKey of the watcher.
+	owner string
+	// target is "namespace/pod/container".
+	target string
+}
+
+// HandleWsTransfer handle "/ws/{namespace}/{pod}/{container}/transfers/{transfer}" connections.
+//
+// The client generates a random transfer ID, connects to it, then starts
+// HandleFileUpload or HandleFileDownload of the same container with the query
+// parameter "transfer". The progress of the transfer is sent as
+// TransferMessage, and the websocket is closed after the done or error
+// message. The access policy is the same as the file APIs, and the transfer ID
+// can't be watched by other users.
+func HandleWsTransfer(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	namespace := pathParams["namespace"]
+	podName := pathParams["pod"]
+	containerName := pathParams["container"]
+	id := pathParams["transfer"]
+	if !checkAccess(w, r, policy.ActionFiles, namespace, podName, containerName) {
+		return
+	}
+	watcher := &transferWatcher{owner: clientKey(r), target: transferTarget(namespace, podName, containerName)}
+	if !watcher.available(id) {
+		errors.WriteErrorWithMsg(w, http.StatusConflict, errors.CodeInvalidParam, "transfer is watched by another client")
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Error("upgrade websocket error: ", err)
+		return
+	}
+	watcher.sender = newSender(conn, nil)
+	s := watcher.sender
+
+	transferWatchersMu.Lock()
+	old := transferWatchers[id]
+	if old != nil && old.owner != watcher.owner {
+		// watched by another client after the check.
+		transferWatchersMu.Unlock()
+		s.closeWithReason("transfer is watched by another client")
+		return
+	}
+	transferWatchers[id] = watcher
+	transferWatchersMu.Unlock()
+	if old != nil {
+		old.sender.close()
+	}
+	defer func() {
+		transferWatchersMu.Lock()
+		if transferWatchers[id] == watcher {
+			delete(transferWatchers, id)
+		}
+		transferWatchersMu.Unlock()
+		s.close()
+	}()
+
+	for {
+		if _, _, err := readMessage(conn); err != nil {
+			return
+		}
+	}
+}
+
+// available returns whether the transfer ID is not watched by other clients.
+func (w *transferWatcher) available(id string) bool {
+	transferWatchersMu.Lock()
+	defer transferWatchersMu.Unlock()
+	old, ok := transferWatchers[id]
+	return !ok || old.owner == w.owner
+}
+
+func transferTarget(namespace, podName, containerName string) string {
+	return namespace + "/" + podName + "/" + containerName
+}
+
+// transferProgress is an io.Writer counting the bytes of a file transfer, the
+// progress is sent to the watcher of the transfer ID at most every
+// transferProgressInterval.
+type transferProgress struct {
+	id       string
+	owner    string
+	target   string
+	path     string
+	total    int64
+	bytes    int64
+	start    time.Time
+	reported time.Time
+}
+
+// newTransferProgress returns the progress of copying the file at path of the
+// container, total is the size of the file, 0 if unknown. The progress is only
+// sent to the watcher of the same client and container.
+func newTransferProgress(r *http.Request, id, target, path string, total int64) *transferProgress {
+	now := time.Now()
+	return &transferProgress{id: id, owner: clientKey(r), target: target, path: path, total: total, start: now, reported: now}
+}
+
+func (p *transferProgress) Write(b []byte) (int, error) {
+	p.bytes += int64(len(b))
+	if now := time.Now(); now.Sub(p.reported) >= transferProgressInterval {
+		p.reported = now
+		p.publish(TransferMessage{Op: "progress", Path: p.path, Bytes: p.bytes, Total: p.total}, false)
+	}
+	return len(b), nil
+}
+
+// done sends the done or error message, and closes the watcher.
+func (p *transferProgress) done(err error) {
+	if err != nil {
+		log.Errorf("copy %s error after %d bytes: %s", p.path, p.bytes, err.Error())
+		p.publish(TransferMessage{Op: "error", Path: p.path, Bytes: p.bytes, Error: err.Error()}, true)
+		return
+	}
+	log.Infof("copy %s done, %d bytes in %s", p.path, p.bytes, time.Since(p.start).Round(time.Millisecond))
+	p.publish(TransferMessage{Op: "done", Path: p.path, Bytes: p.bytes}, true)
+}
+
+// publish sends the message to the watcher of the transfer, if any and it's
+// watched by the same client and container. The watcher is closed if final is
+// true.
+func (p *transferProgress) publish(msg TransferMessage, final bool) {
+	if len(p.id) == 0 {
+		return
+	}
+	transferWatchersMu.Lock()
+	watcher := transferWatchers[p.id]
+	if watcher == nil || watcher.owner != p.owner || watcher.target != p.target {
+		transferWatchersMu.Unlock()
+		return
+	}
+	if final {
+		delete(transferWatchers, p.id)
+	}
+	transferWatchersMu.Unlock()
+	s := watcher.sender
+
+	data, _ := json.Marshal(msg)
+	s.send(data, 0)
+	if final {
+		go s.closeWithReason("transfer " + msg.Op)
+	}
+}
@@ -2,7 +2,7 @@ package websocket
 
 import (
 	"io"
-	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -33,19 +33,75 @@ type PtyHandler interface {
 	remotecommand.TerminalSizeQueue
 }
 
-// TerminalSession 三个字段/属性.
-// conn:    内部维护的一个 websocket 连接, NewTerminalSession() 函数可以把 http 连接升级到 websocket.
-//          升级得到的 websocket 就存放在这里.
-//          后续浏览器 JavaScript 会将用户的 shell 指令写入到该 websocket, 并调用 TerminalSession 的 Read() 方法写入到 pod 容器
-//          pod 容器的输出会调用 TerminalSession 的 Write() 方法写入到该 websocket, 前端 JavaScript 代码就可以从该 websocket
-//          读取容器的输出内容,并写到 web 终端浏览器上
+// TerminalSession 的字段/属性.
+// id, token: 会话的 ID 和重连凭证, 网络中断后前端可以通过 "/ws/sessions/{id}?token=xxx" 重新连接到这个会话.
+// viewToken, driveToken: 分享会话的凭证, 其他用户可以通过 "/ws/sessions/{id}?token=xxx" 以只读或者共同操作的方式加入会话.
+// clients: 连接到会话的所有浏览器 websocket, NewTerminalSession() 函数可以把 http 连接升级到 websocket.
+//          后续浏览器 JavaScript 会将用户的 shell 指令写入到该 websocket, 由 readLoop() 放入 inputCh,
+//          再通过 TerminalSession 的 Read() 方法写入到 pod 容器.
+//          pod 容器的输出会调用 TerminalSession 的 Write() 方法写入到所有的 websocket, 前端 JavaScript 代码就可以从该 websocket
+//          读取容器的输出内容,并写到 web 终端浏览器上.
+//          没有可以输入的 websocket 后, pod 容器的 shell 在 grace 时间内会一直保持, 超时后关闭会话.
+// owner:   创建会话的浏览器 websocket.
+// floor:   正在输入的 websocket, 多个用户同时输入时, 只接受 floor 的输入, floor 停止输入 floorTimeout 后其他用户才能输入.
+// inputCh: 浏览器输入的 shell 指令.
+// pending: 上一次 Read() 没有读完的输入.
 // sizeCh:  是一个 remotecommand.TerminalSize, 代表浏览器 web 终端的长宽大小
-// doneCh:  当 remotecommand 包与 pod 容器建立的双向 shell streams 长连接断开后(比如用户刷新浏览器等操作导致的),
-//          remotecommand 包会向 doneCh 发送一个空数据, TerminalSession 会关闭内部维护的 websocket
+// size:    最后一次的终端大小, 重连后会重新发送给 pod 容器.
+// output:  最近的输出, 重连后前端从断开时的 offset 继续接收输出.
+// startedAt, inputAt: 会话的创建时间和最后一次输入的时间, 用来关闭空闲太久或者存在太久的会话.
+// transfer: 正在进行的 ZMODEM 或 trzsz 文件传输, 传输期间输出以二进制消息只发送给传输文件的 websocket.
+// tail:     上一次输出的末尾, 用来检测被拆分到两次输出中的 ZMODEM 或 trzsz 起始序列.
+// user:     创建会话的用户, 记录在审计日志中.
+// guard:    检查用户输入的危险命令, 没有配置 "--blocked-command" 和 "--confirm-command" 时为 nil.
+// redactor: 屏蔽输出中的密钥, 被拆分到多次输出中的密钥会暂缓发送, heldTimer 超时后发送暂缓的输出. 没有开启屏蔽时为 nil.
+// doneCh:  会话关闭后(pod 容器的 shell 退出, 或者断开后没有在 grace 时间内重连), doneCh 会被关闭,
+//          remotecommand 包调用的 Read(), Next() 方法感知到后会断开和 pod 容器建立的双向 shell streams 长连接.
 type TerminalSession struct {
+	id         string
+	token      string
+	viewToken  string
+	driveToken string
+
+	l          sync.Mutex
+	clients    map[*terminalClient]bool
+	owner      *terminalClient
+	floor      *terminalClient
+	floorAt    time.Time
+	size       *remotecommand.TerminalSize
+	output     *ringBuffer
+	graceTimer *time.Timer
+	startedAt  time.Time
+	inputAt    time.Time
+	transfer   *fileTransfer
+	tail       []byte
+	user       string
+	guard      *commandGuard
+	redactor   *redactor
+	heldTimer  *time.Timer
+
+	inputCh chan []byte
+	pending []byte
+	eotSent bool
+	sizeCh  chan remotecommand.TerminalSize
+	doneCh  chan struct{}
+	once    sync.Once
+}
+
+// terminalClient is a browser websocket connected to a TerminalSession, role
+// is one of "owner", "driver" and "viewer".
+type terminalClient struct {
 	conn   *websocket.Conn
-	sizeCh chan remotecommand.TerminalSize
-	doneCh chan struct{}
+	sender *sender
+	role   string
+}
+
+// fileTransfer is a ZMODEM or trzsz file transfer in a TerminalSession,
+// protocol is one of "zmodem" and "trzsz", client is the websocket
+// transferring the files.
+type fileTransfer struct {
+	protocol string
+	client   *terminalClient
 }
 
 // TerminalMessage 是前端 JavaScript 代码和 TerminalSession 内部维护的 websocket 之间的通信协议.
@@ -54,24 +110,97 @@ type TerminalSession struct {
 //         如果为 stdin,  表示前端 JavaScript 代码将用户输出的 shell 指令发送到 TerminalSession 内部维护的 websocket.
 //         如果为 stdout, 表示前端 JavaScript 代码将从 TerminalSession 内部维护的 websocket 读取数据并输出到浏览器 web 终端上.
 //         如果为 resize, 表示前端 JavaScript 代码将浏览器到长宽大小信息发送到 TerminalSession 内部维护 websocket.
+//         如果为 session, 表示服务端将会话的 ID, 重连凭证和分享凭证发送给前端 JavaScript 代码.
+//         如果为 notice, 表示服务端发送给前端的提示信息, 例如有用户加入或者离开了会话.
+//         如果为 transfer, 服务端发送时表示开始 ZMODEM 或 trzsz 文件传输, Data 为协议, 之后的输出和输入都是二进制消息,
+//         前端发送 Data 为 end 的 transfer 消息表示传输结束.
+//         如果为 warning, 表示服务端发送给前端的警告, 例如危险命令被拦截或者需要确认.
 // Data:   前端 JavaScript 代码从 TerminalSession 内部内部维护的 websocket 中写入或读取的数据, Op 为 stdin 或 stdout
 // Rows,Cols:  浏览器的长宽大小信息, Op 为 resize.
+// Session,Token,Role: 会话的 ID, 重连凭证和当前 websocket 的角色, Op 为 session.
+// ViewToken,DriveToken: 只读和共同操作的分享凭证, 只发送给会话的创建者, Op 为 session.
+// Offset: 到这条消息为止会话输出的总字节数, Op 为 stdout, 重连时前端通过 offset 参数告诉服务端从哪里继续输出.
 type TerminalMessage struct {
-	Op   string `json:"op"`
-	Data string `json:"data"`
-	Rows uint16 `json:"rows"`
-	Cols uint16 `json:"cols"`
+	Op         string `json:"op"`
+	Data       string `json:"data"`
+	Rows       uint16 `json:"rows"`
+	Cols       uint16 `json:"cols"`
+	Session    string `json:"session,omitempty"`
+	Token      string `json:"token,omitempty"`
+	Role       string `json:"role,omitempty"`
+	ViewToken  string `json:"viewToken,omitempty"`
+	DriveToken string `json:"driveToken,omitempty"`
+	Offset     int64  `json:"offset,omitempty"`
 }
 
 var upgrader = func() websocket.Upgrader {
 	upgrader := websocket.Upgrader{}
 	upgrader.HandshakeTimeout = time.Second * 2
-	upgrader.CheckOrigin = func(r *http.Request) bool {
-		return true
-	}
+	upgrader.CheckOrigin = checkOrigin
 	return upgrader
 }()
 
+// Logger writes pod logs to websocket line by line, it is safe to be written concurrently.
+// conn:       内部维护的 websocket 连接.
+// sender:     通过有界的发送队列异步写入 websocket, 浏览器太慢时不会阻塞日志流.
+// filter:     服务端日志过滤器, 为 nil 时不过滤, 前端可以通过 LogControlMessage 修改.
+// timestamps: 为 true 时解析每行日志开头的 RFC3339 时间戳, 放在 LogLine.Timestamp 字段.
+// partial:    Write() 写入的不完整的行, 等到换行符后再发送.
+// batch:      等待发送的日志行, 多行日志合并成一个 websocket 消息发送, 减少消息数量.
+// doneCh:     前端关闭 websocket 后会被关闭.
+// stopCh:     Close() 时关闭, 用来停止定时发送 batch 的 goroutine.
 type Logger struct {
-	conn *websocket.Conn
+	conn       *websocket.Conn
+	sender     *sender
+	l          sync.Mutex
+	filter     *logFilter
+	timestamps bool
+	partial    *lineWriter
+	redactor   *redactor
+	batch      []LogLine
+	batchBytes int
+	err        error
+	doneCh     chan struct{}
+	stopCh     chan struct{}
+}
+
+// LogMessage 是 Logger 和前端 JavaScript 代码之间的通信协议.
+//
+// OP       DIRECTION  FIELD(S) USED  DESCRIPTION
+// ---------------------------------------------------------------------
+// lines    be->fe     Lines          A batch of complete log lines
+// error    be->fe     Data           Error message to be shown to the user
+// skipped  be->fe     Skipped        Number of lines dropped for the slow client
+type LogMessage struct {
+	Op      string    `json:"op"`
+	Data    string    `json:"data,omitempty"`
+	Lines   []LogLine `json:"lines,omitempty"`
+	Skipped int       `json:"skipped,omitempty"`
+}
+
+// LogLine is a complete log line without the trailing newline.
+// Source:     the source of the line, such as "pod container", used by aggregated logs.
+// Timestamp:  the RFC3339 timestamp parsed from the line, if timestamps is enabled.
+// Data:       the line.
+// Highlights: the [start, end) byte offsets of Data matched the include filter.
+type LogLine struct {
+	Source     string   `json:"source,omitempty"`
+	Timestamp  string   `json:"timestamp,omitempty"`
+	Data       string   `json:"data"`
+	Highlights [][2]int `json:"highlights,omitempty"`
+}
+
+// TransferMessage 是文件上传下载的进度消息, 由 HandleWsTransfer 发送给前端.
+//
+// OP        FIELD(S) USED        DESCRIPTION
+// ---------------------------------------------------------------------
+// progress  Path, Bytes, Total   Bytes copied so far, Total is 0 if unknown
+// done      Path, Bytes          The transfer succeeded
+// error     Path, Bytes, Error   The transfer failed
+type TransferMessage struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+	Total int64  `json:"total,omitempty"`
+	Error string `json:"error,omitempty"`
 }
@@ -2,12 +2,11 @@ package websocket
 
 import (
 	"context"
+	"fmt"
 	"net/http"
-	"strconv"
 
-	"github.com/forbearing/k8s/pod"
-	"github.com/forbearing/ratel-webterminal/pkg/args"
-	"github.com/forbearing/ratel-webterminal/pkg/controller"
+	"github.com/forbearing/ratel-webterminal/pkg/errors"
+	"github.com/forbearing/ratel-webterminal/pkg/policy"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 )
@@ -18,7 +17,7 @@ func HandleTerminal(w http.ResponseWriter, r *http.Request) {
 		log.Error("HandleTerminal error: ", http.StatusText(http.StatusMethodNotAllowed))
 		http.Error(w, "HandleTerminal: "+http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 	}
-	http.ServeFile(w, r, "./frontend/terminal.html")
+	servePage(w, r, "./frontend/terminal.html")
 }
 
 // HandleLogs handle "/logs" connections.
@@ -27,7 +26,16 @@ func HandleLogs(w http.ResponseWriter, r *http.Request) {
 		log.Error("HandleLogs error: ", http.StatusText(http.StatusMethodNotAllowed))
 		http.Error(w, "HandleLogs: "+http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 	}
-	http.ServeFile(w, r, "./frontend/logs.html")
+	servePage(w, r, "./frontend/logs.html")
+}
+
+// HandleFiles handle "/files" connections.
+func HandleFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		log.Error("HandleFiles error: ", http.StatusText(http.StatusMethodNotAllowed))
+		http.Error(w, "HandleFiles: "+http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+	servePage(w, r, "./frontend/file.html")
 }
 
 // 前端 TypeScript 代码将用户在浏览器输入的 uri,
@@ -38,10 +46,26 @@ func HandleLogs(w http.ResponseWriter, r *http.Request) {
 func HandleWsTerminal(w http.ResponseWriter, r *http.Request) {
 	// 通过 mux.Vars(r) 函数可以分析 URI "/ws/{namespace}/{pod}/{container}/shell"
 	// 来获取 namespace, podName, containerName.
-	pathParams := mux.Vars(r)
-	namespace := pathParams["namespace"]
-	podName := pathParams["pod"]
-	containerName := pathParams["container"]
+	// pod 也可以是 "deployment/api" 这样的 workload 引用或者 label selector,
+	// 会被解析成一个 ready 的 pod, 没有指定 container 时使用 pod 的默认容器.
+	// 在获取 pod 之前先检查访问策略, 被拒绝的 namespace 不会访问 pod lister 和 apiserver.
+	if !checkNamespaceAccess(w, r, policy.ActionExec, mux.Vars(r)["namespace"]) {
+		return
+	}
+	namespace, podName, containerName, err := resolveTarget(r)
+	if err != nil {
+		log.Error("resolve pod error: ", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !checkAccess(w, r, policy.ActionExec, namespace, podName, containerName) {
+		return
+	}
+	release, ok := acquireShell(w, r, namespace+"/"+podName)
+	if !ok {
+		return
+	}
+	defer release()
 	log.Infof("exec pod: %s/%s, container: %s", namespace, podName, containerName)
 
 	// 调用 NewTerminalSession() 函数可以获得一个 TerminalSession 对象.
@@ -101,7 +125,13 @@ func HandleWsTerminal(w http.ResponseWriter, r *http.Request) {
 	// 5. 前端 TypeScript 代码从 websocket 读取数据并写入到浏览器 web 终端
 	// 6. 最终用户看到自己的 shell 命令输出结果.
 
-	podHandler, err := pod.New(context.TODO(), args.GetKubeConfigFile(), namespace)
+	podHandler, err := newPodHandler(r, namespace)
+	if err != nil {
+		// websocket 已经建立, 错误信息写入终端, 返回后 defer 会关闭 terminalSession.
+		log.Error("get pod handler error: ", err)
+		terminalSession.Write([]byte(fmt.Sprintf("get pod handler error: %s\r\n", err.Error())))
+		return
+	}
 	processPodShell := func(podName, containerName string) {
 		err = podHandler.ExecuteWithPty(podName, containerName, []string{"bash"}, terminalSession)
 		if err != nil {
@@ -114,11 +144,12 @@ func HandleWsTerminal(w http.ResponseWriter, r *http.Request) {
 
 	// 从 pod lister 中获取 pod 对象,而不是直接访问 kube-apiserver, 可以减轻 apiserver 压力
 	// 如果从 pod lister 中获取不到 pod, 再直接调用 kube-apiserver api 获取 pod
-	podObj, err := controller.GetPod(namespace, podName)
+	podObj, err := getPod(podHandler, namespace, podName)
 	if err != nil {
-		log.Warn(err)
+		log.Warnf("get pod %s/%s to redact error: %s", namespace, podName, err.Error())
 		processPodShell(podName, containerName)
 	} else {
+		terminalSession.redactSecrets(podObj, containerName)
 		processPodShell(podObj.Name, containerName)
 	}
 }
@@ -142,12 +173,38 @@ func HandleWsTerminal(w http.ResponseWriter, r *http.Request) {
 // 2.前端的 TypeScript 代码再调用 ratel-webtermal 的 api,
 //   也就是这里的 /ws/{namespace}/{pod}/{container}/logs
 func HandleWsLogs(w http.ResponseWriter, r *http.Request) {
-	pathParams := mux.Vars(r)
-	namespace := pathParams["namespace"]
-	podName := pathParams["pod"]
-	containerName := pathParams["container"]
-	tailLines, _ := strconv.ParseInt(r.URL.Query().Get("tail"), 10, 64)
-	log.Infof("get pod logs: %s/%s, container: %s, tailLines: %d\n", namespace, podName, containerName, tailLines)
+	if !checkNamespaceAccess(w, r, policy.ActionLogs, mux.Vars(r)["namespace"]) {
+		return
+	}
+	namespace, podName, containerName, err := resolveTarget(r)
+	if err != nil {
+		log.Error("resolve pod error: ", err)
+		errors.WriteErrorWithMsg(w, http.StatusNotFound, errors.CodePodNotFound, err.Error())
+		return
+	}
+	if !checkAccess(w, r, policy.ActionLogs, namespace, podName, containerName) {
+		return
+	}
+	// 在升级到 websocket 之前校验参数, 参数错误时返回 pkg/errors 中定义的错误码.
+	logOptions, code, err := parseLogOptions(r.URL.Query())
+	if err != nil {
+		log.Error("parse log options error: ", err)
+		errors.WriteErrorWithMsg(w, http.StatusBadRequest, code, err.Error())
+		return
+	}
+	filter, code, err := parseLogFilter(r.URL.Query())
+	if err != nil {
+		log.Error("parse log filter error: ", err)
+		errors.WriteErrorWithMsg(w, http.StatusBadRequest, code, err.Error())
+		return
+	}
+	release, ok := acquireLogs(w, r, logOptions.Follow)
+	if !ok {
+		return
+	}
+	defer release()
+	logOptions.Container = containerName
+	log.Infof("get pod logs: %s/%s, container: %s, options: %s", namespace, podName, containerName, logOptions.String())
 
 	writer, err := NewLogger(w, r, nil)
 	if err != nil {
@@ -158,37 +215,49 @@ func HandleWsLogs(w http.ResponseWriter, r *http.Request) {
 		log.Println("close logs session.")
 		writer.Close()
 	}()
+	// 服务端日志过滤器, 前端也可以通过 filter 消息随时修改过滤条件.
+	writer.SetFilter(filter)
+	writer.SetTimestamps(logOptions.Timestamps)
 
 	// TailLines 字段用来指定获取多少行 Pod 的日志
 	// 如果没有设置 TailLines, 就可以查看到 pod 中所有的日志.
 
 	// Follow 字段的功能类似于 kubectl logs 命令加了一个 -f 标志, 用来持续追踪 pod
-	// 接下来产生的日志.
-	// 如果不将 Follow 设置为 true, 就无法动态获取 pod 接下来生成的日志.
+	// 接下来产生的日志, 默认为 true, 可以通过 follow=false 关闭.
 	// 如果想通过浏览器来持续观察一个 pod 的日志, Follow 应该总是设置成 True.
 
+	// Previous, SinceSeconds, SinceTime, Timestamps, LimitBytes 字段与
+	// kubectl logs 命令的 --previous, --since, --since-time, --timestamps,
+	// --limit-bytes 标志功能相同.
+
 	// 这个 writer 有一个 write 方法, 实现了 io.Writer 接口. 调用这个 writer 的
 	// write 方法, 就会执行 conn.WriteMessage 函数, 即向 websocket 写数据.
 	// 总流程为:
-	// 1.podHandler.Log() 指定 pod 的日志, 默认日志是写入到标准输出, 但是我们通过
-	//   logOptions 设置了 Writer 字段为我们指定的 writer. 也就是说会将 pod 的日志
-	//   远远不断的写入到 writer 对象封装的 websocket 连接中.
+	// 1.streamLogs() 获取 pod 的日志流, 并将 pod 的日志源源不断的写入到 writer,
+	//   writer 将日志按行切分, 多行合并成一个 LogMessage 写入 websocket 连接中.
 	// 2.前端的 TypeScript 脚本会读取 websocket 中的 pod 日志.
 	//   然后我们就可以在浏览器中查看到这个 pod 的日志.
-
-	var logOptions pod.LogOptions
-	logOptions.Writer = writer
-	logOptions.Follow = true
-	logOptions.NewLine = false
-	if tailLines != 0 {
-		logOptions.TailLines = &tailLines
-	}
-	podHandler, err := pod.New(context.TODO(), args.GetKubeConfigFile(), namespace)
+	podHandler, err := newPodHandler(r, namespace)
 	if err != nil {
-		log.Error("get pod handler error")
+		log.Error("get pod handler error: ", err)
 		return
 	}
-	if err = podHandler.Log(podName, &logOptions); err != nil {
-		log.Error("get pod log error")
+	if podObj, err := getPod(podHandler, namespace, podName); err != nil {
+		log.Warnf("get pod %s/%s to redact error: %s", namespace, podName, err.Error())
+	} else {
+		writer.redactSecrets(podObj, containerName)
+	}
+	// 前端关闭 websocket 后, 停止获取 pod 的日志.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-writer.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err = streamLogs(ctx, podHandler, namespace, podName, &logOptions, writer); err != nil && ctx.Err() == nil {
+		log.Error("get pod log error: ", err)
 	}
 }
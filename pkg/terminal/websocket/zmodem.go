@@ -0,0 +1,124 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	protocolZmodem = "zmodem"
+	protocolTrzsz  = "trzsz"
+)
+
+// transferMagics are the sequences printed by "sz"/"rz" and "tsz"/"trz" when
+// they start, the output after them are transferred as binary messages.
+var transferMagics = []struct {
+	protocol string
+	magic    []byte
+	// cancel is typed into the container to stop the transfer if the client
+	// disconnected during the transfer.
+	cancel []byte
+}{
+	// the hex header of ZRQINIT sent by "sz" and ZRINIT sent by "rz".
+	{protocolZmodem, []byte("**\x18B0"), []byte("\x18\x18\x18\x18\x18\x18\x18\x18\x08\x08\x08\x08\x08\x08\x08\x08\x08\x08")},
+	{protocolTrzsz, []byte("::TRZSZ:TRANSFER:"), []byte("\x03")},
+}
+
+// maxMagicSize is the size of the longest transfer magic.
+var maxMagicSize = func() int {
+	size := 0
+	for _, m := range transferMagics {
+		if len(m.magic) > size {
+			size = len(m.magic)
+		}
+	}
+	return size
+}()
+
+// detectTransfer looks for the ZMODEM and trzsz magic in the output. The magic
+// may be split into two writes, so the end of the previous output is kept in
+// t.tail. If found, it returns the output before the magic as text, and the
+// output from the magic as binary. The caller must hold t.l.
+func (t *TerminalSession) detectTransfer(p []byte) (protocol string, text, binary []byte) {
+	for _, m := range transferMagics {
+		if i := bytes.Index(p, m.magic); i >= 0 {
+			return m.protocol, p[:i], append([]byte(nil), p[i:]...)
+		}
+		head := p
+		if len(head) > len(m.magic)-1 {
+			head = head[:len(m.magic)-1]
+		}
+		boundary := append(append([]byte(nil), t.tail...), head...)
+		if i := bytes.Index(boundary, m.magic); i >= 0 {
+			// the beginning of the magic has been sent as text.
+			return m.protocol, nil, append(append([]byte(nil), t.tail[i:]...), p...)
+		}
+	}
+
+	keep := maxMagicSize - 1
+	if len(p) >= keep {
+		t.tail = append(t.tail[:0], p[len(p)-keep:]...)
+	} else if t.tail = append(t.tail, p...); len(t.tail) > keep {
+		t.tail = append(t.tail[:0], t.tail[len(t.tail)-keep:]...)
+	}
+	return "", nil, nil
+}
+
+// startTransfer switches the session to the file transfer. The client typing
+// the command, or the owner, receives the output as binary messages and
+// answers with binary messages, the output to other clients is paused until
+// the transfer ends. It returns the transfer message which must be sent to
+// the client before the binary messages, or false if there is no client to
+// answer the transfer. The caller must hold t.l.
+func (t *TerminalSession) startTransfer(protocol string) ([]byte, bool) {
+	client := t.floor
+	if client == nil {
+		client = t.owner
+	}
+	if client == nil {
+		log.Warnf("terminal session %s: no client to answer the %s file transfer", t.id, protocol)
+		return nil, false
+	}
+	log.Infof("terminal session %s: %s file transfer started by %s", t.id, protocol, client.role)
+	t.transfer = &fileTransfer{protocol: protocol, client: client}
+	t.tail = nil
+	t.notify(client, fmt.Sprintf("%s file transfer started by %s, the output is paused", protocol, client.role))
+
+	data, _ := json.Marshal(TerminalMessage{Op: "transfer", Data: protocol})
+	return data, true
+}
+
+// endTransfer switches the session back to text output if the client is
+// transferring files. If the client disconnected, the transfer is canceled.
+// The caller must hold t.l.
+func (t *TerminalSession) endTransfer(client *terminalClient, disconnected bool) {
+	if t.transfer == nil || t.transfer.client != client {
+		return
+	}
+	protocol := t.transfer.protocol
+	log.Infof("terminal session %s: %s file transfer finished", t.id, protocol)
+	t.transfer = nil
+	t.notify(client, fmt.Sprintf("%s file transfer finished", protocol))
+	if !disconnected {
+		return
+	}
+	for _, m := range transferMagics {
+		if m.protocol == protocol {
+			go func(cancel []byte) {
+				select {
+				case t.inputCh <- cancel:
+				case <-t.doneCh:
+				}
+			}(m.cancel)
+		}
+	}
+}
+
+// transferring returns whether the client is transferring files. The caller
+// must hold t.l.
+func (t *TerminalSession) transferring(client *terminalClient) bool {
+	return t.transfer != nil && t.transfer.client == client
+}
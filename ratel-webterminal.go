@@ -5,12 +5,17 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"time"
 
 	_ "net/http/pprof"
 
 	"github.com/forbearing/ratel-webterminal/pkg/args"
+	"github.com/forbearing/ratel-webterminal/pkg/auth"
 	"github.com/forbearing/ratel-webterminal/pkg/controller"
+	"github.com/forbearing/ratel-webterminal/pkg/janitor"
 	"github.com/forbearing/ratel-webterminal/pkg/logger"
+	"github.com/forbearing/ratel-webterminal/pkg/policy"
 	"github.com/forbearing/ratel-webterminal/pkg/probe"
 	"github.com/forbearing/ratel-webterminal/pkg/terminal/websocket"
 	"github.com/gorilla/mux"
@@ -19,12 +24,48 @@ import (
 )
 
 var (
-	argPort           = pflag.Int("port", 8080, "port to listen to for incoming HTTP requests")
-	argBindAddress    = pflag.IP("bind-address", net.IPv4(0, 0, 0, 0), "IP address on which to serve the --port, set to 0.0.0.0 for all interfaces by default")
-	argKubeConfigFile = pflag.String("kubeconfig", "", "path to kubeconfig file with authorization and master location information")
-	argLogLevel       = pflag.String("log-level", "INFO", "level of API request logging, should be one of   'ERROR', 'WARNING|WARN', 'INFO', 'DEBUG' or 'TRACE'")
-	argLogFormat      = pflag.String("log-format", "TEXT", "specify log format, should be on of 'TEXT' or 'JSON'")
-	argLogFile        = pflag.String("log-output", "/dev/stdout", "specify log file, default output log to /dev/stdout")
+	argPort               = pflag.Int("port", 8080, "port to listen to for incoming HTTP requests")
+	argBindAddress        = pflag.IP("bind-address", net.IPv4(0, 0, 0, 0), "IP address on which to serve the --port, set to 0.0.0.0 for all interfaces by default")
+	argKubeConfigFile     = pflag.String("kubeconfig", "", "path to kubeconfig file with authorization and master location information")
+	argLogLevel           = pflag.String("log-level", "INFO", "level of API request logging, should be one of   'ERROR', 'WARNING|WARN', 'INFO', 'DEBUG' or 'TRACE'")
+	argLogFormat          = pflag.String("log-format", "TEXT", "specify log format, should be on of 'TEXT' or 'JSON'")
+	argLogFile            = pflag.String("log-output", "/dev/stdout", "specify log file, default output log to /dev/stdout")
+	argEnableNodeShell    = pflag.Bool("enable-node-shell", false, "enable node shell by scheduling a privileged pod on the node, it grants root access of nodes to the users allowed by the 'node-shell' action of --policy-file, or to anyone if --policy-file is not set")
+	argEnableCopy         = pflag.Bool("enable-copy", false, "enable the copy mode, which creates a copy of the pod to debug the crashing container")
+	argDebugImage         = pflag.String("debug-image", "busybox:latest", "default image of the ephemeral debug container, can be overridden by the 'image' query parameter")
+	argAllowedDebugImages = pflag.StringArray("allowed-debug-image", nil, "image allowed to be set by the 'image' query parameter of the debug mode, e.g. 'nicolaka/netshoot:*', --debug-image is always allowed, can be specified multiple times")
+	argSlowClientPolicy   = pflag.String("slow-client-policy", "drop", "what to do when the send queue of a websocket session is full, should be one of 'drop' (drop the oldest messages) or 'disconnect'")
+	argSendQueueSize      = pflag.Int("send-queue-size", 256, "max number of messages queued for sending per websocket session")
+	argWriteTimeout       = pflag.Duration("write-timeout", 10*time.Second, "timeout of writing one message to websocket, the session is closed if the write timed out")
+	argSessionGracePeriod = pflag.Duration("session-grace-period", time.Minute, "how long a terminal session is kept after its websocket closed unexpectedly, waiting for the client to reconnect, 0 to close it immediately")
+	argSessionIdleTimeout = pflag.Duration("session-idle-timeout", 0, "close the terminal session if there is no input for this duration, 0 to disable")
+	argSessionMaxDuration = pflag.Duration("session-max-duration", 0, "max lifetime of a terminal session, 0 to disable")
+	argMaxFileSize        = pflag.Int64("max-file-size", 1<<30, "max size in bytes of the files uploaded to or downloaded from containers")
+	argPolicyFile         = pflag.String("policy-file", "", "path to the access policy file of users and groups, it's reloaded when changed, all requests are allowed if not set")
+	argUserHeader         = pflag.String("user-header", "", "request header of the user name set by the trusted authenticating proxy in front of ratel-webterminal, e.g. 'X-Forwarded-User'")
+	argGroupsHeader       = pflag.String("groups-header", "", "request header of the comma separated groups set by the trusted authenticating proxy, e.g. 'X-Forwarded-Groups'")
+	argTrustedProxies     = pflag.StringArray("trusted-proxy", nil, "IP or CIDR of the trusted authenticating proxy, --user-header and --groups-header are only honored from it, e.g. '10.0.0.0/8', can be specified multiple times")
+	argBlockedCommands    = pflag.StringArray("blocked-command", nil, "regular expression of the commands typed into terminals to block, e.g. 'rm -rf /(\\s|$)', can be specified multiple times")
+	argConfirmCommands    = pflag.StringArray("confirm-command", nil, "regular expression of the commands typed into terminals which require the user to press Enter again to run, can be specified multiple times")
+	argRedact             = pflag.Bool("redact", false, "mask bearer tokens, AWS access keys and private key blocks in the output of terminals and logs")
+	argRedactPatterns     = pflag.StringArray("redact-pattern", nil, "regular expression of the secrets to mask in the output of terminals and logs, only the first submatch is masked if any, can be specified multiple times")
+	argRedactSecretEnv    = pflag.Bool("redact-secret-env", false, "mask the values of the Secret-backed environment variables of the pod in the output of terminals and logs, it requires the permission to get secrets")
+	argAllowedOrigins     = pflag.StringArray("allowed-origin", nil, "origin allowed to open websockets besides the same origin, e.g. 'https://*.example.com', '*' allows all origins but still requires the CSRF token issued by the pages, can be specified multiple times")
+	argSessionRate        = pflag.Float64("session-rate", 0, "max number of new shell and log sessions per second of every user, or every IP if the user is not authenticated, 0 to disable")
+	argSessionBurst       = pflag.Int("session-burst", 10, "max number of new sessions at once of every user or IP, used with --session-rate")
+	argMaxShells          = pflag.Int("max-shells", 0, "max number of concurrent shells, including attach, debug, copy and node shell, 0 to disable")
+	argMaxShellsPerUser   = pflag.Int("max-shells-per-user", 0, "max number of concurrent shells of every user, or every IP if the user is not authenticated, 0 to disable")
+	argMaxShellsPerPod    = pflag.Int("max-shells-per-pod", 0, "max number of concurrent shells of every pod or node, 0 to disable")
+	argMaxLogFollowers    = pflag.Int("max-log-followers", 0, "max number of concurrent log sessions following the logs, 0 to disable")
+	argOIDCIssuer         = pflag.String("oidc-issuer", "", "URL of the OpenID Connect issuer, the users must log in to it to open the pages if set, e.g. 'https://accounts.example.com'")
+	argOIDCClientID       = pflag.String("oidc-client-id", "", "client ID of ratel-webterminal registered in the OpenID Connect issuer")
+	argOIDCClientSecret   = pflag.String("oidc-client-secret", os.Getenv("OIDC_CLIENT_SECRET"), "client secret of ratel-webterminal registered in the OpenID Connect issuer, read from the OIDC_CLIENT_SECRET environment variable by default")
+	argOIDCRedirectURL    = pflag.String("oidc-redirect-url", "", "redirect URL registered in the OpenID Connect issuer, e.g. 'https://terminal.example.com/auth/callback', derived from the request if not set")
+	argOIDCScopes         = pflag.StringSlice("oidc-scopes", []string{"openid", "profile", "email"}, "scopes requested from the OpenID Connect issuer, 'openid' is required")
+	argOIDCUsernameClaim  = pflag.String("oidc-username-claim", "email", "claim of the ID token used as the user name")
+	argOIDCGroupsClaim    = pflag.String("oidc-groups-claim", "groups", "claim of the ID token used as the groups of the user, empty to ignore the groups")
+	argOIDCSessionMaxAge  = pflag.Duration("oidc-session-max-age", 12*time.Hour, "max lifetime of a login session even if the tokens can be refreshed, 0 to disable")
+	argImpersonate        = pflag.Bool("impersonate", true, "impersonate the authenticated users and their groups when accessing kube-apiserver, so the requests are authorized by the RBAC of the users, the anonymous users are never impersonated")
 
 	// The flag "--conf" is used to specify a file path, which contains the
 	// configuration about how ratel-webterminal to start/bootstrap, such as
@@ -50,22 +91,93 @@ func init() {
 	builder.SetLogLevel(*argLogLevel)
 	builder.SetLogFormat(*argLogFormat)
 	builder.SetLogFile(*argLogFile)
+	builder.SetDebugImage(*argDebugImage)
+	builder.SetAllowedDebugImages(*argAllowedDebugImages)
+	builder.SetEnableNodeShell(*argEnableNodeShell)
+	builder.SetEnableCopy(*argEnableCopy)
+	builder.SetSlowClientPolicy(*argSlowClientPolicy)
+	builder.SetSendQueueSize(*argSendQueueSize)
+	builder.SetWriteTimeout(*argWriteTimeout)
+	builder.SetSessionGracePeriod(*argSessionGracePeriod)
+	builder.SetSessionIdleTimeout(*argSessionIdleTimeout)
+	builder.SetSessionMaxDuration(*argSessionMaxDuration)
+	builder.SetMaxFileSize(*argMaxFileSize)
+	builder.SetPolicyFile(*argPolicyFile)
+	builder.SetUserHeader(*argUserHeader)
+	builder.SetGroupsHeader(*argGroupsHeader)
+	builder.SetTrustedProxies(*argTrustedProxies)
+	builder.SetBlockedCommands(*argBlockedCommands)
+	builder.SetConfirmCommands(*argConfirmCommands)
+	builder.SetRedact(*argRedact)
+	builder.SetRedactPatterns(*argRedactPatterns)
+	builder.SetRedactSecretEnv(*argRedactSecretEnv)
+	builder.SetAllowedOrigins(*argAllowedOrigins)
+	builder.SetSessionRate(*argSessionRate)
+	builder.SetSessionBurst(*argSessionBurst)
+	builder.SetMaxShells(*argMaxShells)
+	builder.SetMaxShellsPerUser(*argMaxShellsPerUser)
+	builder.SetMaxShellsPerPod(*argMaxShellsPerPod)
+	builder.SetMaxLogFollowers(*argMaxLogFollowers)
+	builder.SetOIDCIssuer(*argOIDCIssuer)
+	builder.SetOIDCClientID(*argOIDCClientID)
+	builder.SetOIDCClientSecret(*argOIDCClientSecret)
+	builder.SetOIDCRedirectURL(*argOIDCRedirectURL)
+	builder.SetOIDCScopes(*argOIDCScopes)
+	builder.SetOIDCUsernameClaim(*argOIDCUsernameClaim)
+	builder.SetOIDCGroupsClaim(*argOIDCGroupsClaim)
+	builder.SetOIDCSessionMaxAge(*argOIDCSessionMaxAge)
+	builder.SetImpersonate(*argImpersonate)
 }
 
 func main() {
 	logger.Init()
 	controller.Init()
+	janitor.Init()
+	policy.Init()
+	auth.Init()
+	websocket.InitSender()
+	websocket.InitCommandGuard()
+	websocket.InitRedaction()
+	websocket.InitOriginCheck()
+	websocket.InitLimits()
 	//election.Init()
 
 	router := mux.NewRouter()
+	router.Use(auth.Middleware)
+	router.HandleFunc("/auth/login", auth.HandleLogin).Methods(http.MethodGet)
+	router.HandleFunc("/auth/callback", auth.HandleCallback).Methods(http.MethodGet)
+	router.HandleFunc("/auth/logout", auth.HandleLogout)
 	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./frontend/"))))
 	router.HandleFunc("/terminal", websocket.HandleTerminal)
 	router.HandleFunc("/logs", websocket.HandleLogs)
+	router.HandleFunc("/files", websocket.HandleFiles)
 	router.HandleFunc("/ws/{namespace}/{pod}/{container}/shell", websocket.HandleWsTerminal)
 	router.HandleFunc("/ws/{namespace}/{pod}/{container}/logs", websocket.HandleWsLogs)
+	router.HandleFunc("/ws/{namespace}/shell", websocket.HandleWsTerminal)
+	router.HandleFunc("/ws/{namespace}/logs", websocket.HandleWsLogs)
+	router.HandleFunc("/ws/{namespace}/logs/aggregate", websocket.HandleWsAggregateLogs)
+	router.HandleFunc("/ws/{namespace}/{pod}/{container}/attach", websocket.HandleWsAttach)
+	router.HandleFunc("/ws/{namespace}/{pod}/{container}/debug", websocket.HandleWsDebug)
+	router.HandleFunc("/ws/{namespace}/{pod}/{container}/copy", websocket.HandleWsCopy)
+	router.HandleFunc("/ws/nodes/{node}/shell", websocket.HandleWsNodeShell)
+	router.HandleFunc("/ws/sessions/{session}", websocket.HandleWsReconnect)
+	router.HandleFunc("/ws/{namespace}/{pod}/events", websocket.HandleWsEvents)
+	router.HandleFunc("/ws/{namespace}/{pod}/{container}/transfers/{transfer}", websocket.HandleWsTransfer)
+	router.HandleFunc("/ws/{namespace}/{pod}/portforward/{port}", websocket.HandleWsPortForward)
+	router.HandleFunc("/api/v1/{namespace}/{pod}/{container}/logs/download", websocket.HandleLogsDownload).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/{namespace}/{pod}/{container}/files", websocket.HandleFileDownload).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/{namespace}/{pod}/{container}/files", websocket.HandleFileUpload).Methods(http.MethodPut)
+	router.HandleFunc("/api/v1/{namespace}/{pod}/{container}/files", websocket.HandleFileDelete).Methods(http.MethodDelete)
+	router.HandleFunc("/api/v1/{namespace}/{pod}/{container}/files/list", websocket.HandleFileList).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/{namespace}/{pod}/{container}/files/stat", websocket.HandleFileStat).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/{namespace}/{pod}/{container}/files/read", websocket.HandleFileRead).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/{namespace}/{pod}/access", websocket.HandleAccess).Methods(http.MethodGet)
+	router.HandleFunc("/proxy/{namespace}/{pod}/{port}", websocket.HandleProxy)
+	router.PathPrefix("/proxy/{namespace}/{pod}/{port}/").HandlerFunc(websocket.HandleProxy)
 	router.HandleFunc("/-/healthy", probe.HandleHealthyProbe)
 	router.HandleFunc("/-/ready", probe.HandleReadyProbe)
 	router.PathPrefix("/debug/pprof/").Handler(http.DefaultServeMux)
+	router.Handle("/debug/vars", http.DefaultServeMux)
 
 	log.Info("Starting ratel-webterminal")
 	addr := fmt.Sprintf("%s:%d", args.GetBindAddress(), args.GetPort())